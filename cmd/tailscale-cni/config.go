@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/clusterconfig"
+	"github.com/lstoll/tailscale-cni/internal/config"
+	"github.com/lstoll/tailscale-cni/internal/controller"
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/routes"
+)
+
+// bindConfigFlags registers the flags that override config fields, writing
+// into c. The defaults shown are c's current values.
+func bindConfigFlags(fs *flag.FlagSet, c *config.Config) {
+	fs.StringVar(&c.CNI.Dir, "cni-dir", c.CNI.Dir, "Host path to write CNI conflist")
+	fs.StringVar(&c.CNI.BinDir, "cni-bin-dir", c.CNI.BinDir, "If set, copy bridge/host-local/portmap from -cni-plugin-source into this dir (host plugin path)")
+	fs.StringVar(&c.CNI.PluginSource, "cni-plugin-source", c.CNI.PluginSource, "Path to built-in CNI plugins in the container (source for copy)")
+	fs.StringVar(&c.CNI.Bridge, "bridge", c.CNI.Bridge, "Bridge name for CNI")
+	fs.IntVar(&c.CNI.MTU, "mtu", c.CNI.MTU, "MTU of the bridge and pod interfaces; 0 leaves the bridge plugin's default")
+	fs.Var((*listValue)(&c.ClusterCIDRs), "cluster-cidr", "Cluster pod CIDR (for routes and CNI config); comma-separated IPv4 and IPv6 CIDRs for dual-stack")
+	fs.StringVar(&c.Tailscale.Socket, "tailscale-socket", c.Tailscale.Socket, "Path to Tailscale socket (default: platform default)")
+	fs.StringVar(&c.Tailscale.Interface, "tailscale-interface", c.Tailscale.Interface, "Tailscale interface name for masq")
+	fs.IntVar(&c.Routes.Table, "route-table", c.Routes.Table, "Routing table for other nodes' pod CIDR routes; 0 uses the main table. A dedicated table gets one policy rule per cluster CIDR at -route-rule-priority")
+	fs.IntVar(&c.Routes.RulePriority, "route-rule-priority", c.Routes.RulePriority, "Priority of the policy rules for -route-table; must be below Tailscale's rules (5210-5270) so pod CIDRs aren't looked up in table 52 first")
+	fs.StringVar(&c.Routes.Mode, "route-mode", c.Routes.Mode, "How to route other nodes' pod CIDRs: \"self\" (out the Tailscale interface; tailscaled picks the peer) or \"peer\" (via the online peer advertising the CIDR; CIDRs without one are skipped)")
+	fs.BoolVar(&c.Masq.Enabled, "masq", c.Masq.Enabled, "Masquerade pod traffic leaving the node other than via the bridge or Tailscale")
+	fs.BoolVar(&c.Masq.ClampMSS, "clamp-mss", c.Masq.ClampMSS, "Clamp the MSS of TCP connections between pods and Tailscale so segments fit in the Tailscale interface's MTU")
+	fs.IntVar(&c.Masq.MSS, "mss", c.Masq.MSS, "MSS to clamp to with -clamp-mss; 0 derives it from the Tailscale interface's MTU")
+	fs.Var((*listValue)(&c.Masq.NonMasqueradeCIDRs), "non-masquerade-cidrs", "Comma-separated destination CIDRs that pod traffic is never masqueraded to (e.g. an on-prem LAN)")
+	fs.DurationVar(&c.Controller.ResyncPeriod.Duration, "resync-period", c.Controller.ResyncPeriod.Duration, "How often to full resync node cache (informer resync)")
+	fs.BoolVar(&c.Controller.AllocateNodeCIDRs, "allocate-node-cidrs", c.Controller.AllocateNodeCIDRs, "Assign pod CIDRs from -cluster-cidr to nodes that have no spec.podCIDR")
+	fs.IntVar(&c.Controller.NodeCIDRMaskSize, "node-cidr-mask-size", c.Controller.NodeCIDRMaskSize, "Prefix length of IPv4 pod CIDRs assigned by -allocate-node-cidrs")
+	fs.IntVar(&c.Controller.NodeCIDRMaskSizeIPv6, "node-cidr-mask-size-ipv6", c.Controller.NodeCIDRMaskSizeIPv6, "Prefix length of IPv6 pod CIDRs assigned by -allocate-node-cidrs")
+	fs.DurationVar(&c.Tailscale.ApprovalRecheck.Duration, "route-approval-recheck", c.Tailscale.ApprovalRecheck.Duration, "How often to re-check whether our advertised pod CIDRs are approved in the tailnet and tailscaled is reachable, for the TailscaleRoutesApproved and NetworkUnavailable Node conditions")
+	fs.BoolVar(&c.CleanupOnExit, "cleanup-on-exit", c.CleanupOnExit, "On SIGTERM, withdraw advertised pod CIDRs and remove the conflist, host routes and nftables table (for uninstall; leaves the node without pod networking)")
+	fs.StringVar(&c.Controller.AllocatorConfigMap, "allocator-configmap", c.Controller.AllocatorConfigMap, "ConfigMap (in POD_NAMESPACE) recording pod CIDR assignments for -allocate-node-cidrs")
+	fs.StringVar(&c.Controller.ClusterConfig, "cluster-config", c.Controller.ClusterConfig, "Name of the TailscaleCNIConfig whose settings override this config; empty disables")
+	fs.BoolVar(&c.Controller.NetworkPolicy, "network-policy", c.Controller.NetworkPolicy, "Enforce Kubernetes NetworkPolicy for this node's pods with nftables (needs br_netfilter for traffic between pods on a node)")
+	fs.BoolVar(&c.Controller.EgressSNAT, "egress-snat", c.Controller.EgressSNAT, "SNAT egress from pods in Namespaces annotated "+controller.EgressSNATAnnotation+" to the annotated address instead of masquerading it (needs -masq)")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Minimum level logged: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Address to serve Prometheus metrics (/metrics) and health probes (/healthz, /readyz) on; empty disables. Use the node's own address rather than all interfaces (\":9850\"), which includes the Tailscale one")
+}
+
+// applyEnv applies the environment variables that set config fields.
+func applyEnv(c *config.Config) {
+	c.CNI.Dir = defaultEnv("CNI_DIR", c.CNI.Dir)
+	c.CNI.BinDir = defaultEnv("CNI_BIN_DIR", c.CNI.BinDir)
+	c.CNI.PluginSource = defaultEnv("CNI_PLUGIN_SOURCE", c.CNI.PluginSource)
+	if v := os.Getenv("CLUSTER_CIDR"); v != "" {
+		c.ClusterCIDRs = splitList(v)
+	}
+}
+
+// listValue is a comma-separated flag.Value.
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+// positiveDuration is a flag.Value for a duration that must be more than 0,
+// e.g. the period of a ticker.
+type positiveDuration time.Duration
+
+func (d *positiveDuration) String() string { return time.Duration(*d).String() }
+
+func (d *positiveDuration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	*d = positiveDuration(v)
+	return nil
+}
+
+// configLoader builds the effective config: defaults, then environment
+// variables, then the config file, then the flags given on the command line.
+type configLoader struct {
+	path  string
+	flags map[string]string // config flags set on the command line
+}
+
+// newConfigLoader records the flags set on fs, which must have been parsed.
+func newConfigLoader(path string, fs *flag.FlagSet) configLoader {
+	l := configLoader{path: path, flags: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) { l.flags[f.Name] = f.Value.String() })
+	return l
+}
+
+// load returns the validated config for the file contents data; nil data
+// (no -config) gives the config from defaults, environment and flags alone.
+func (l configLoader) load(data []byte) (*config.Config, error) {
+	c := config.Default()
+	applyEnv(c)
+	if err := c.Parse(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", l.path, err)
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindConfigFlags(fs, c)
+	for name, value := range l.flags {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		if l.path == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", l.path, err)
+	}
+	return c, nil
+}
+
+// liveConfig is the config in effect: the local config (defaults,
+// environment, config file and flags) with this node's TailscaleCNIConfig
+// settings on top. Changes to either are applied to the running components;
+// fields they only read at startup (e.g. the route table, or the Tailscale
+// socket) are logged and left alone until the next restart.
+type liveConfig struct {
+	loader      configLoader
+	opts        *atomic.Pointer[runReconcileOpts]
+	otherRoutes *otherRoutesReconciler
+	// updateNonMasq queues updating the non-masquerade CIDRs in place
+	// (controller.UpdateNonMasquerade); nil reconciles instead.
+	updateNonMasq func()
+
+	mu      sync.Mutex
+	local   *config.Config
+	cluster *clusterconfig.Settings // nil without a TailscaleCNIConfig
+	running *config.Config
+}
+
+// reloadFile applies new config file contents. It reports whether anything
+// changed, in which case the caller should reconcile again.
+func (l *liveConfig) reloadFile(data []byte) bool {
+	c, err := l.loader.load(data)
+	if err != nil {
+		logging.Component("config").Warn("not reloading", logging.Err(err))
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed, err := l.applyLocked(c, l.cluster)
+	if err != nil {
+		logging.Component("config").Warn("not reloading; invalid with cluster settings", "path", l.loader.path, "kind", clusterconfig.Kind, logging.Err(err))
+		return false
+	}
+	l.local = c
+	return changed
+}
+
+// applyClusterSettings is a controller.ClusterConfigApplier.
+func (l *liveConfig) applyClusterSettings(s *clusterconfig.Settings) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed, err := l.applyLocked(l.local, s)
+	if err != nil {
+		return false, err
+	}
+	l.cluster = s
+	return changed, nil
+}
+
+func (l *liveConfig) applyLocked(local *config.Config, cluster *clusterconfig.Settings) (bool, error) {
+	want := withClusterSettings(local, cluster)
+	if err := want.Validate(); err != nil {
+		return false, err
+	}
+	next := *l.running
+	next.ClusterCIDRs = want.ClusterCIDRs
+	next.CNI.BinDir = want.CNI.BinDir
+	next.CNI.PluginSource = want.CNI.PluginSource
+	next.CNI.Bridge = want.CNI.Bridge
+	next.CNI.MTU = want.CNI.MTU
+	next.Routes.Mode = want.Routes.Mode
+	next.Routes.RulePriority = want.Routes.RulePriority
+	next.Masq = want.Masq
+	next.Log.Level = want.Log.Level
+	if restart := config.Diff(&next, want); len(restart) > 0 {
+		logging.Component("config").Warn("changed fields need a restart to apply", "fields", restart)
+	}
+	changed := config.Diff(l.running, &next)
+	if len(changed) == 0 {
+		return false, nil
+	}
+	logging.Component("config").Info("applying changes", "fields", changed)
+	l.running = &next
+	_ = logging.SetLevel(next.Log.Level) // validated above
+	reconcile := slices.DeleteFunc(slices.Clone(changed), func(f string) bool { return f == "log.level" })
+
+	opts := *l.opts.Load()
+	opts.clusterCIDRs = slices.Clone(next.ClusterCIDRs)
+	opts.cniBinDir = next.CNI.BinDir
+	opts.cniPluginSource = next.CNI.PluginSource
+	opts.bridgeName = next.CNI.Bridge
+	opts.mtu = next.CNI.MTU
+	opts.masq = next.Masq.Enabled
+	opts.nonMasqCIDRs = slices.Clone(next.Masq.NonMasqueradeCIDRs)
+	opts.clampMSS = next.Masq.ClampMSS
+	opts.mss = next.Masq.MSS
+	l.opts.Store(&opts)
+	l.otherRoutes.setMode(next.Routes.Mode)
+	if l.otherRoutes.routeManager.Table() != routes.MainTable {
+		l.otherRoutes.setRules(policyRules(opts.clusterCIDRs, next.Routes.RulePriority))
+	}
+	// The non-masquerade CIDRs are nftables set elements; changing just
+	// those doesn't need the table rebuilt.
+	if slices.Equal(reconcile, []string{"masq.nonMasqueradeCIDRs"}) && next.Masq.Enabled && l.updateNonMasq != nil {
+		l.updateNonMasq()
+		return false, nil
+	}
+	return len(reconcile) > 0, nil
+}
+
+// withClusterSettings returns local with the fields s sets replaced.
+func withClusterSettings(local *config.Config, s *clusterconfig.Settings) *config.Config {
+	c := *local
+	if s == nil {
+		return &c
+	}
+	if len(s.ClusterCIDRs) > 0 {
+		c.ClusterCIDRs = slices.Clone(s.ClusterCIDRs)
+	}
+	if len(s.NonMasqueradeCIDRs) > 0 {
+		c.Masq.NonMasqueradeCIDRs = slices.Clone(s.NonMasqueradeCIDRs)
+	}
+	if s.MTU != 0 {
+		c.CNI.MTU = s.MTU
+	}
+	if s.RouteMode != "" {
+		c.Routes.Mode = s.RouteMode
+	}
+	return &c
+}
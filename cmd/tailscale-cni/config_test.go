@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/clusterconfig"
+	"github.com/lstoll/tailscale-cni/internal/config"
+	"github.com/lstoll/tailscale-cni/internal/routes"
+)
+
+func TestConfigLoader(t *testing.T) {
+	t.Setenv("CNI_DIR", "/env/net.d")
+	t.Setenv("CLUSTER_CIDR", "10.1.0.0/16")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	bindConfigFlags(fs, config.Default())
+	if err := fs.Parse([]string{"-route-mode=peer", "-cluster-cidr=10.3.0.0/16,fd00:3::/48"}); err != nil {
+		t.Fatal(err)
+	}
+	l := newConfigLoader("config.yaml", fs)
+
+	c, err := l.load([]byte("apiVersion: tailscale-cni.lstoll.github.io/v1alpha1\nkind: Config\nclusterCIDRs: [10.2.0.0/16]\nroutes:\n  mode: self\n  table: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags beat the file, the file beats the environment.
+	if c.Routes.Mode != routeModePeer {
+		t.Errorf("routes.mode = %q, want the flag's peer", c.Routes.Mode)
+	}
+	if want := []string{"10.3.0.0/16", "fd00:3::/48"}; !slices.Equal(c.ClusterCIDRs, want) {
+		t.Errorf("clusterCIDRs = %v, want the flag's %v", c.ClusterCIDRs, want)
+	}
+	if c.Routes.Table != 100 {
+		t.Errorf("routes.table = %d, want the file's 100", c.Routes.Table)
+	}
+	if c.CNI.Dir != "/env/net.d" {
+		t.Errorf("cni.dir = %q, want the environment's /env/net.d", c.CNI.Dir)
+	}
+
+	if _, err := l.load([]byte("routes:\n  table: -1\n")); err == nil {
+		t.Error("expected a validation error for a negative table")
+	}
+}
+
+func TestLiveConfigClusterSettings(t *testing.T) {
+	local := config.Default()
+	var opts atomic.Pointer[runReconcileOpts]
+	opts.Store(&runReconcileOpts{clusterCIDRs: local.ClusterCIDRs, bridgeName: local.CNI.Bridge, masq: true})
+	otherRoutes := &otherRoutesReconciler{mode: routeModeSelf, routeManager: routes.NewManager("tailscale0")}
+	live := &liveConfig{opts: &opts, otherRoutes: otherRoutes, local: local, running: local}
+
+	changed, err := live.applyClusterSettings(&clusterconfig.Settings{MTU: 1280, RouteMode: routeModePeer, NonMasqueradeCIDRs: []string{"192.168.0.0/16"}})
+	if err != nil || !changed {
+		t.Fatalf("applyClusterSettings = %v, %v; want changed", changed, err)
+	}
+	o := opts.Load()
+	if o.mtu != 1280 || !slices.Equal(o.nonMasqCIDRs, []string{"192.168.0.0/16"}) || o.bridgeName != "cni0" {
+		t.Errorf("opts = %+v", o)
+	}
+	if otherRoutes.mode != routeModePeer {
+		t.Errorf("route mode = %q, want peer", otherRoutes.mode)
+	}
+
+	if changed, err := live.applyClusterSettings(&clusterconfig.Settings{MTU: 1280, RouteMode: routeModePeer, NonMasqueradeCIDRs: []string{"192.168.0.0/16"}}); err != nil || changed {
+		t.Errorf("same settings again = %v, %v; want unchanged", changed, err)
+	}
+	if _, err := live.applyClusterSettings(&clusterconfig.Settings{ClusterCIDRs: []string{"nope"}}); err == nil {
+		t.Error("expected invalid cluster CIDRs to be rejected")
+	}
+	if opts.Load().mtu != 1280 {
+		t.Error("rejected settings must leave the running config alone")
+	}
+
+	// Only the non-masquerade CIDRs changed: an in-place update of the sets
+	// is queued, to pick them up from opts.
+	var queued int
+	live.updateNonMasq = func() { queued++ }
+	if changed, err := live.applyClusterSettings(&clusterconfig.Settings{MTU: 1280, RouteMode: routeModePeer, NonMasqueradeCIDRs: []string{"10.0.0.0/8"}}); err != nil || changed {
+		t.Errorf("non-masquerade CIDRs only = %v, %v; want no reconcile", changed, err)
+	}
+	if queued != 1 || !slices.Equal(opts.Load().nonMasqCIDRs, []string{"10.0.0.0/8"}) {
+		t.Errorf("queued %d updates, opts %v", queued, opts.Load().nonMasqCIDRs)
+	}
+
+	// Deleting the TailscaleCNIConfig goes back to the local config.
+	if changed, err := live.applyClusterSettings(nil); err != nil || !changed || opts.Load().mtu != 0 {
+		t.Errorf("applyClusterSettings(nil) = %v, %v, mtu %d", changed, err, opts.Load().mtu)
+	}
+}
+
+func TestPositiveDuration(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		want time.Duration // 0 for a parse error
+	}{
+		{"30s", 30 * time.Second},
+		{"0", 0},
+		{"0s", 0},
+		{"-1s", 0},
+		{"soon", 0},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		d := positiveDuration(10 * time.Second)
+		fs.Var(&d, "config-poll-interval", "")
+		err := fs.Parse([]string{"-config-poll-interval=" + tt.arg})
+		switch {
+		case tt.want == 0 && err == nil:
+			t.Errorf("%s: accepted as %v, want an error", tt.arg, time.Duration(d))
+		case tt.want != 0 && (err != nil || time.Duration(d) != tt.want):
+			t.Errorf("%s: got %v, %v, want %v", tt.arg, time.Duration(d), err, tt.want)
+		}
+	}
+}
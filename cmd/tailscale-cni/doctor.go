@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/cni"
+	"github.com/lstoll/tailscale-cni/internal/tailscale"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/preftype"
+)
+
+// Doctor check outcomes.
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// doctorCheck is the result of one preflight check, with a fix for anything
+// not ok.
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string
+}
+
+// Where containerd looks for its config, K3s' generated config first.
+var containerdConfigPaths = []string{
+	"/var/lib/rancher/k3s/agent/etc/containerd/config.toml",
+	"/etc/containerd/config.toml",
+}
+
+type doctorOpts struct {
+	cniDir           string
+	cniBinDir        string
+	clusterCIDRs     []string
+	containerdConfig string // "" if none was found
+	procSys          string
+	tsClient         *tailscale.Client
+}
+
+// runDoctor implements `tailscale-cni doctor`: it checks the host for the
+// failures we see most (see the DaemonSet manifest) and prints how to fix
+// them. It returns 1 if any check failed.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cniDir := fs.String("cni-dir", defaultEnv("CNI_DIR", "/etc/cni/net.d"), "Host path tailscale-cni writes the CNI conflist to")
+	cniBinDir := fs.String("cni-bin-dir", defaultEnv("CNI_BIN_DIR", "/opt/cni/bin"), "Host path tailscale-cni copies CNI plugins to")
+	clusterCIDR := fs.String("cluster-cidr", defaultEnv("CLUSTER_CIDR", "10.99.0.0/16"), "Cluster pod CIDRs, comma-separated (decides which IP forwarding sysctls to check)")
+	containerdConfig := fs.String("containerd-config", "", "containerd config to read the CNI dirs from (default: K3s' or /etc/containerd/config.toml, whichever exists)")
+	tailscaleSocket := fs.String("tailscale-socket", "", "Path to Tailscale socket (default: platform default)")
+	_ = fs.Parse(args)
+
+	o := doctorOpts{
+		cniDir:           *cniDir,
+		cniBinDir:        *cniBinDir,
+		clusterCIDRs:     splitList(*clusterCIDR),
+		containerdConfig: *containerdConfig,
+		procSys:          "/proc/sys",
+		tsClient:         tailscale.NewClient(*tailscaleSocket),
+	}
+	if o.containerdConfig == "" {
+		for _, p := range containerdConfigPaths {
+			if _, err := os.Stat(p); err == nil {
+				o.containerdConfig = p
+				break
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	checks := runDoctorChecks(ctx, o)
+	writeDoctorChecks(os.Stdout, checks)
+	for _, c := range checks {
+		if c.Status == doctorFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+func runDoctorChecks(ctx context.Context, o doctorOpts) []doctorCheck {
+	// The CNI dirs the runtime actually uses, if we can tell.
+	confDir, binDirs := o.cniDir, []string{o.cniBinDir}
+	var checks []doctorCheck
+	if o.containerdConfig == "" {
+		checks = append(checks, doctorCheck{
+			Name: "containerd-config", Status: doctorWarn,
+			Detail: "no containerd config found; only checking -cni-dir and -cni-bin-dir",
+			Fix:    "pass -containerd-config, or run doctor on the host rather than in the pod",
+		})
+	} else if data, err := os.ReadFile(o.containerdConfig); err != nil {
+		checks = append(checks, doctorCheck{Name: "containerd-config", Status: doctorWarn, Detail: err.Error()})
+	} else {
+		cd, bds := containerdCNIDirs(string(data))
+		if cd != "" {
+			confDir = cd
+		}
+		if len(bds) > 0 {
+			binDirs = bds
+		}
+		checks = append(checks, doctorCheck{
+			Name: "containerd-config", Status: doctorOK,
+			Detail: fmt.Sprintf("%s: CNI config in %s, plugins in %s", o.containerdConfig, confDir, strings.Join(binDirs, ", ")),
+		})
+	}
+
+	checks = append(checks, checkPlugins(binDirs, o.cniBinDir))
+	checks = append(checks, checkConflist(confDir, o.cniDir)...)
+	checks = append(checks, checkTailscale(ctx, o.tsClient)...)
+	checks = append(checks, checkForwarding(o.procSys, o.clusterCIDRs)...)
+	checks = append(checks, checkBridgeNetfilter(o.procSys))
+	return checks
+}
+
+// checkPlugins checks each plugin we copy is in one of the dirs the runtime
+// searches. libcni looks for a plugin in each dir in turn and runs the first
+// it finds, so it only has to be in one of them.
+func checkPlugins(binDirs []string, cniBinDir string) doctorCheck {
+	var missing []string
+	for i, dir := range binDirs {
+		m := cni.MissingPlugins(dir)
+		if i == 0 {
+			missing = m
+			continue
+		}
+		missing = slices.DeleteFunc(missing, func(p string) bool { return !slices.Contains(m, p) })
+	}
+	if len(missing) == 0 {
+		return doctorCheck{Name: "cni-plugins", Status: doctorOK, Detail: "plugins present in " + strings.Join(binDirs, ", ")}
+	}
+	detail := fmt.Sprintf("%s not found in %s", strings.Join(missing, ", "), strings.Join(binDirs, ", "))
+	fix := fmt.Sprintf("mount the runtime's plugin dir at -cni-bin-dir (now %s) so the plugins are copied there, or symlink them into it", cniBinDir)
+	if slices.ContainsFunc(binDirs, func(d string) bool { return strings.Contains(d, "/rancher/k3s/") }) {
+		fix += "; for K3s also check the binaries match the node's architecture"
+	}
+	return doctorCheck{Name: "cni-plugins", Status: doctorFail, Detail: detail, Fix: fix}
+}
+
+// checkConflist checks our conflist is where the runtime reads config from
+// and that no other config sorts before it.
+func checkConflist(confDir, cniDir string) []doctorCheck {
+	path := cni.ConflistPath(confDir)
+	exists := doctorCheck{Name: "conflist", Status: doctorOK, Detail: path}
+	if _, err := os.Stat(path); err != nil {
+		exists.Status = doctorFail
+		exists.Detail = err.Error()
+		exists.Fix = "wait for tailscale-cni to reconcile (is the node's pod CIDR set?)"
+		if filepath.Clean(confDir) != filepath.Clean(cniDir) {
+			exists.Fix = fmt.Sprintf("the runtime reads CNI config from %s but tailscale-cni writes to %s; mount %s at -cni-dir", confDir, cniDir, confDir)
+		}
+	}
+
+	shadow := doctorCheck{Name: "conflist-order", Status: doctorOK, Detail: "no other CNI config sorts before ours"}
+	before, err := cni.ConfigsBefore(confDir)
+	switch {
+	case err != nil:
+		shadow.Status = doctorWarn
+		shadow.Detail = err.Error()
+	case len(before) > 0:
+		shadow.Status = doctorFail
+		shadow.Detail = fmt.Sprintf("%s in %s sort before %s; the runtime uses the first one", strings.Join(before, ", "), confDir, filepath.Base(path))
+		shadow.Fix = "remove them (e.g. leftovers of flannel or another CNI) or move them out of " + confDir
+	}
+	return []doctorCheck{exists, shadow}
+}
+
+// checkTailscale checks tailscaled is up and its netfilter settings don't
+// get in the way of routed pod traffic.
+func checkTailscale(ctx context.Context, tsClient *tailscale.Client) []doctorCheck {
+	running := doctorCheck{Name: "tailscaled", Status: doctorOK}
+	st, err := tsClient.Status(ctx)
+	switch {
+	case err != nil:
+		running.Status = doctorFail
+		running.Detail = err.Error()
+		running.Fix = "start tailscaled on the node and make sure its socket dir (/var/run/tailscale) is mounted into the pod"
+		return []doctorCheck{running}
+	case st.BackendState != ipn.Running.String():
+		running.Status = doctorFail
+		running.Detail = "backend state " + st.BackendState
+		running.Fix = "run `tailscale up` on the node (check `tailscale status`)"
+		return []doctorCheck{running}
+	}
+	running.Detail = fmt.Sprintf("running, IPs %v", st.TailscaleIPs)
+
+	netfilter := doctorCheck{Name: "tailscale-netfilter", Status: doctorOK}
+	prefs, err := tsClient.Prefs(ctx)
+	if err != nil {
+		netfilter.Status = doctorWarn
+		netfilter.Detail = err.Error()
+		return []doctorCheck{running, netfilter}
+	}
+	netfilter.Detail = "netfilter-mode " + prefs.NetfilterMode.String()
+	var fixes []string
+	if prefs.NetfilterMode == preftype.NetfilterOn && !prefs.NoStatefulFiltering.EqualBool(true) {
+		netfilter.Status = doctorFail
+		netfilter.Detail += ", stateful filtering drops new connections from other nodes' pods"
+		fixes = append(fixes, "tailscale set --stateful-filtering=false")
+	}
+	if prefs.NetfilterMode == preftype.NetfilterOn && !prefs.NoSNAT {
+		if netfilter.Status == doctorOK {
+			netfilter.Status = doctorWarn
+		}
+		netfilter.Detail += ", subnet route traffic is SNATed so pods see node IPs instead of pod IPs"
+		fixes = append(fixes, "tailscale set --snat-subnet-routes=false")
+	}
+	netfilter.Fix = strings.Join(fixes, "; ")
+	return []doctorCheck{running, netfilter}
+}
+
+// checkForwarding checks IP forwarding is on for each cluster CIDR family.
+func checkForwarding(procSys string, clusterCIDRs []string) []doctorCheck {
+	families := map[string]string{}
+	for _, cidr := range clusterCIDRs {
+		if p, err := netip.ParsePrefix(cidr); err == nil && p.Addr().Is6() {
+			families["net.ipv6.conf.all.forwarding"] = "ipv6/conf/all/forwarding"
+		} else {
+			families["net.ipv4.ip_forward"] = "ipv4/ip_forward"
+		}
+	}
+	var checks []doctorCheck
+	for _, key := range slices.Sorted(maps.Keys(families)) {
+		c := doctorCheck{Name: "ip-forward", Status: doctorOK, Detail: key + " = 1"}
+		data, err := os.ReadFile(filepath.Join(procSys, "net", families[key]))
+		switch {
+		case err != nil:
+			c.Status = doctorWarn
+			c.Detail = err.Error()
+		case strings.TrimSpace(string(data)) != "1":
+			c.Status = doctorFail
+			c.Detail = fmt.Sprintf("%s = %s", key, strings.TrimSpace(string(data)))
+			c.Fix = fmt.Sprintf("sysctl -w %s=1 and persist it in /etc/sysctl.d/", key)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkBridgeNetfilter checks that traffic between pods on the bridge goes
+// through netfilter, which -network-policy needs to filter it.
+func checkBridgeNetfilter(procSys string) doctorCheck {
+	c := doctorCheck{Name: "bridge-netfilter", Status: doctorOK, Detail: "net.bridge.bridge-nf-call-iptables = 1, net.bridge.bridge-nf-call-ip6tables = 1"}
+	if err := bridgeNetfilter(procSys); err != nil {
+		c.Status = doctorWarn
+		c.Detail = err.Error() + " (only matters with -network-policy)"
+		c.Fix = "modprobe br_netfilter and persist it in /etc/modules-load.d/, then sysctl -w net.bridge.bridge-nf-call-iptables=1 net.bridge.bridge-nf-call-ip6tables=1"
+	}
+	return c
+}
+
+// bridgeNetfilter reports an error unless br_netfilter is loaded and passes
+// bridged IPv4 and IPv6 traffic to the netfilter hooks.
+func bridgeNetfilter(procSys string) error {
+	for _, key := range []string{"bridge-nf-call-iptables", "bridge-nf-call-ip6tables"} {
+		data, err := os.ReadFile(filepath.Join(procSys, "net", "bridge", key))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("br_netfilter is not loaded")
+		case err != nil:
+			return err
+		case strings.TrimSpace(string(data)) != "1":
+			return fmt.Errorf("net.bridge.%s = %s", key, strings.TrimSpace(string(data)))
+		}
+	}
+	return nil
+}
+
+var (
+	confDirRe = regexp.MustCompile(`(?m)^\s*conf_dir\s*=\s*"([^"]+)"`)
+	binDirRe  = regexp.MustCompile(`(?m)^\s*bin_dir\s*=\s*"([^"]+)"`)
+	binDirsRe = regexp.MustCompile(`(?m)^\s*bin_dirs\s*=\s*\[([^\]]*)\]`)
+	quotedRe  = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// containerdCNIDirs extracts the CRI plugin's CNI conf_dir and bin_dir (or
+// containerd 2's bin_dirs) from a containerd config.toml. Empty results mean
+// containerd's defaults apply.
+func containerdCNIDirs(config string) (confDir string, binDirs []string) {
+	if m := confDirRe.FindStringSubmatch(config); m != nil {
+		confDir = m[1]
+	}
+	if m := binDirsRe.FindStringSubmatch(config); m != nil {
+		for _, q := range quotedRe.FindAllStringSubmatch(m[1], -1) {
+			binDirs = append(binDirs, q[1])
+		}
+	} else if m := binDirRe.FindStringSubmatch(config); m != nil {
+		binDirs = []string{m[1]}
+	}
+	return confDir, binDirs
+}
+
+// writeDoctorChecks prints checks for humans.
+func writeDoctorChecks(w io.Writer, checks []doctorCheck) {
+	for _, c := range checks {
+		fmt.Fprintf(w, "[%-4s] %s: %s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+		if c.Fix != "" && c.Status != doctorOK {
+			fmt.Fprintf(w, "       fix: %s\n", c.Fix)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestContainerdCNIDirs(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantConfDir string
+		wantBinDirs []string
+	}{
+		{"empty", "", "", nil},
+		{
+			"k3s v2",
+			`version = 2
+
+[plugins."io.containerd.grpc.v1.cri".cni]
+  bin_dir = "/var/lib/rancher/k3s/data/current/bin"
+  conf_dir = "/var/lib/rancher/k3s/agent/etc/cni/net.d"
+`,
+			"/var/lib/rancher/k3s/agent/etc/cni/net.d",
+			[]string{"/var/lib/rancher/k3s/data/current/bin"},
+		},
+		{
+			"containerd 2 bin_dirs",
+			`version = 3
+
+[plugins.'io.containerd.cri.v1.runtime'.cni]
+  bin_dirs = ["/opt/cni/bin", "/usr/lib/cni"]
+  conf_dir = "/etc/cni/net.d"
+`,
+			"/etc/cni/net.d",
+			[]string{"/opt/cni/bin", "/usr/lib/cni"},
+		},
+		{
+			"commented out",
+			`#  conf_dir = "/nope"
+  bin_dir = "/opt/cni/bin"
+`,
+			"",
+			[]string{"/opt/cni/bin"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confDir, binDirs := containerdCNIDirs(tt.config)
+			if confDir != tt.wantConfDir {
+				t.Errorf("confDir = %q, want %q", confDir, tt.wantConfDir)
+			}
+			if !slices.Equal(binDirs, tt.wantBinDirs) {
+				t.Errorf("binDirs = %v, want %v", binDirs, tt.wantBinDirs)
+			}
+		})
+	}
+}
+
+func TestCheckPlugins(t *testing.T) {
+	install := func(dir string, plugins ...string) {
+		for _, p := range plugins {
+			if err := os.WriteFile(filepath.Join(dir, p), []byte("#!/bin/sh\n"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	optBin, usrLib := t.TempDir(), t.TempDir()
+	install(optBin, "bridge", "host-local")
+	install(usrLib, "host-local", "portmap")
+
+	// Split across dirs is fine: libcni takes each from the first dir that has it.
+	install(usrLib, "loopback")
+	if c := checkPlugins([]string{optBin, usrLib}, optBin); c.Status != doctorOK {
+		t.Errorf("plugins split across dirs: %s: %s", c.Status, c.Detail)
+	}
+
+	if err := os.Remove(filepath.Join(usrLib, "loopback")); err != nil {
+		t.Fatal(err)
+	}
+	c := checkPlugins([]string{optBin, usrLib}, optBin)
+	if c.Status != doctorFail || !strings.HasPrefix(c.Detail, "loopback not found") {
+		t.Errorf("loopback in no dir: %s: %s", c.Status, c.Detail)
+	}
+	if c := checkPlugins([]string{optBin}, optBin); c.Status != doctorFail || !strings.HasPrefix(c.Detail, "portmap, loopback not found") {
+		t.Errorf("one dir: %s: %s", c.Status, c.Detail)
+	}
+}
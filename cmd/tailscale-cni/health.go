@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/cni"
+	"github.com/lstoll/tailscale-cni/internal/masq"
+
+	"tailscale.com/ipn"
+)
+
+// healthCheckTimeout bounds a /readyz request; the Tailscale checks talk to
+// tailscaled, which may be hung.
+const healthCheckTimeout = 5 * time.Second
+
+// healthCheck is the result of one readiness check.
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the JSON body of /healthz and /readyz.
+type healthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// readiness checks the node's data plane: what runReconcile and
+// otherRoutesReconciler set up is actually in place.
+type readiness struct {
+	opts        *atomic.Pointer[runReconcileOpts]
+	ctrl        readinessController
+	tailscale   tailscaleRoutes
+	otherRoutes *otherRoutesReconciler
+}
+
+// readinessController is the part of *controller.Controller readiness uses.
+type readinessController interface {
+	AppliedPodCIDRs() []string
+	NetworkPolicyErr() error
+}
+
+// tailscaleRoutes is the part of *tailscale.Client that readiness and the
+// route approval check use.
+type tailscaleRoutes interface {
+	Prefs(ctx context.Context) (*ipn.Prefs, error)
+	UnapprovedRoutes(ctx context.Context, advertised []netip.Prefix) ([]netip.Prefix, error)
+}
+
+// checks runs every readiness check. Checks that need our pod CIDRs fail
+// until the node has been reconciled.
+func (r *readiness) checks(ctx context.Context) []healthCheck {
+	var out []healthCheck
+	add := func(name, okMessage string, err error) {
+		c := healthCheck{Name: name, OK: err == nil, Message: okMessage}
+		if err != nil {
+			c.Message = err.Error()
+		}
+		out = append(out, c)
+	}
+
+	opts := r.opts.Load()
+	podCIDRs := r.ctrl.AppliedPodCIDRs()
+	var podErr error
+	if len(podCIDRs) == 0 {
+		podErr = fmt.Errorf("no pod CIDR applied yet")
+	}
+	add("pod-cidr", strings.Join(podCIDRs, ","), podErr)
+
+	_, err := os.Stat(cni.ConflistPath(opts.cniDir))
+	add("cni-config", cni.ConflistPath(opts.cniDir), err)
+
+	prefs, prefsErr := r.tailscale.Prefs(ctx)
+	advertisedErr := cmp.Or(podErr, prefsErr)
+	if advertisedErr == nil {
+		var missing []string
+		for _, cidr := range podCIDRs {
+			if p, err := netip.ParsePrefix(cidr); err != nil || !slices.Contains(prefs.AdvertiseRoutes, p.Masked()) {
+				missing = append(missing, cidr)
+			}
+		}
+		if len(missing) > 0 {
+			advertisedErr = fmt.Errorf("pod CIDRs %v not advertised via Tailscale", missing)
+		}
+	}
+	add("advertised", "", advertisedErr)
+
+	approvedErr := podErr
+	if podErr == nil {
+		unapproved, err := unapprovedRoutes(ctx, r.tailscale, podCIDRs)
+		switch {
+		case err != nil:
+			approvedErr = err
+		case len(unapproved) > 0:
+			approvedErr = fmt.Errorf("pod CIDRs %v not approved in the tailnet", unapproved)
+		}
+	}
+	add("approved", "", approvedErr)
+
+	acceptErr := prefsErr
+	if prefsErr == nil && !prefs.RouteAll {
+		acceptErr = fmt.Errorf("accept-routes is off")
+	}
+	add("accept-routes", "", acceptErr)
+
+	if opts.nftables() {
+		add("nftables", "", masq.Check(opts.masqConfig(nil)))
+	} else {
+		add("nftables", "masquerading, NetworkPolicy and MSS clamping disabled", nil)
+	}
+	if opts.networkPolicy {
+		add("network-policy", "", r.ctrl.NetworkPolicyErr())
+	}
+
+	summary, err := r.otherRoutes.checkInstalled()
+	add("routes", summary, err)
+
+	return out
+}
+
+// readyzHandler serves /readyz: 200 if every check passes, 503 otherwise,
+// with a JSON breakdown either way.
+func (r *readiness) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+	report := healthReport{OK: true, Checks: r.checks(ctx)}
+	for _, c := range report.Checks {
+		report.OK = report.OK && c.OK
+	}
+	writeHealthReport(w, report)
+}
+
+// healthzHandler serves /healthz: the process is up and serving. It doesn't
+// depend on tailscaled or the API server, so their outages don't restart us.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealthReport(w, healthReport{OK: true})
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lstoll/tailscale-cni/internal/cni"
+	"github.com/lstoll/tailscale-cni/internal/routes"
+
+	"tailscale.com/ipn"
+)
+
+type fakeController struct {
+	podCIDRs  []string
+	policyErr error
+}
+
+func (c fakeController) AppliedPodCIDRs() []string { return c.podCIDRs }
+func (c fakeController) NetworkPolicyErr() error   { return c.policyErr }
+
+type fakeTailscale struct {
+	prefs      ipn.Prefs
+	unapproved []netip.Prefix
+	err        error
+}
+
+func (f fakeTailscale) Prefs(context.Context) (*ipn.Prefs, error) {
+	return &f.prefs, f.err
+}
+
+func (f fakeTailscale) UnapprovedRoutes(context.Context, []netip.Prefix) ([]netip.Prefix, error) {
+	return f.unapproved, f.err
+}
+
+func TestReadinessChecks(t *testing.T) {
+	ours := netip.MustParsePrefix("10.99.1.0/24")
+	ready := fakeTailscale{prefs: ipn.Prefs{AdvertiseRoutes: []netip.Prefix{ours}, RouteAll: true}}
+	for _, tt := range []struct {
+		name      string
+		podCIDRs  []string
+		conflist  bool
+		tailscale fakeTailscale
+		routes    []nodeRoute
+		wantFail  []string
+	}{
+		{name: "ready", podCIDRs: []string{"10.99.1.0/24"}, conflist: true, tailscale: ready},
+		{
+			name:      "no pod CIDR yet",
+			conflist:  true,
+			tailscale: ready,
+			wantFail:  []string{"pod-cidr", "advertised", "approved"},
+		},
+		{name: "conflist missing", podCIDRs: []string{"10.99.1.0/24"}, tailscale: ready, wantFail: []string{"cni-config"}},
+		{
+			name:      "route missing from the kernel",
+			podCIDRs:  []string{"10.99.1.0/24"},
+			conflist:  true,
+			tailscale: ready,
+			routes:    []nodeRoute{{Node: "b", CIDR: "10.99.2.0/24"}},
+			wantFail:  []string{"routes"},
+		},
+		{
+			name:      "routes unapproved",
+			podCIDRs:  []string{"10.99.1.0/24"},
+			conflist:  true,
+			tailscale: fakeTailscale{prefs: ready.prefs, unapproved: []netip.Prefix{ours}},
+			wantFail:  []string{"approved"},
+		},
+		{
+			name:      "not advertised, accept-routes off",
+			podCIDRs:  []string{"10.99.1.0/24"},
+			conflist:  true,
+			tailscale: fakeTailscale{},
+			wantFail:  []string{"advertised", "accept-routes"},
+		},
+		{
+			name:      "tailscaled down",
+			podCIDRs:  []string{"10.99.1.0/24"},
+			conflist:  true,
+			tailscale: fakeTailscale{err: errors.New("connect: no such file or directory")},
+			wantFail:  []string{"advertised", "approved", "accept-routes"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cniDir := t.TempDir()
+			if tt.conflist {
+				if err := os.WriteFile(cni.ConflistPath(cniDir), []byte("{}"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var opts atomic.Pointer[runReconcileOpts]
+			opts.Store(&runReconcileOpts{cniDir: cniDir})
+			r := &readiness{
+				opts:        &opts,
+				ctrl:        fakeController{podCIDRs: tt.podCIDRs},
+				tailscale:   tt.tailscale,
+				otherRoutes: &otherRoutesReconciler{routeManager: routes.NewManager("tscni-test0"), synced: true, table: tt.routes},
+			}
+			var failed []string
+			for _, c := range r.checks(context.Background()) {
+				if !c.OK {
+					failed = append(failed, c.Name)
+				}
+			}
+			if !slices.Equal(failed, tt.wantFail) {
+				t.Errorf("failing checks = %v, want %v", failed, tt.wantFail)
+			}
+
+			rec := httptest.NewRecorder()
+			r.readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			want := http.StatusOK
+			if len(tt.wantFail) > 0 {
+				want = http.StatusServiceUnavailable
+			}
+			if rec.Code != want {
+				t.Errorf("/readyz status = %d, want %d", rec.Code, want)
+			}
+		})
+	}
+}
+
+func TestReadinessNetworkPolicy(t *testing.T) {
+	var opts atomic.Pointer[runReconcileOpts]
+	opts.Store(&runReconcileOpts{cniDir: t.TempDir(), networkPolicy: true})
+	r := &readiness{
+		opts:        &opts,
+		ctrl:        fakeController{podCIDRs: []string{"10.99.1.0/24"}, policyErr: errors.New("caches not synced")},
+		tailscale:   fakeTailscale{},
+		otherRoutes: &otherRoutesReconciler{routeManager: routes.NewManager("tscni-test0"), synced: true},
+	}
+	for _, c := range r.checks(context.Background()) {
+		if c.Name == "network-policy" {
+			if c.OK || c.Message != "caches not synced" {
+				t.Errorf("network-policy check = %+v, want failing with the controller's error", c)
+			}
+			return
+		}
+	}
+	t.Error("no network-policy check with -network-policy")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newHTTPHandler returns the handler for -metrics-addr: metrics and probes.
+func newHTTPHandler(ready *readiness) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", ready.readyzHandler)
+	return mux
+}
+
+// listenHTTP binds addr and serves handler on it until ctx is done. Binding
+// happens before it returns so a port clash fails startup.
+func listenHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http server failed", logging.Err(err))
+		}
+	}()
+	slog.Info("serving metrics and health probes", "addr", ln.Addr().String())
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeConfig returns the client config for the API server. It uses the
+// kubeconfig at path if set, else the usual loading rules ($KUBECONFIG, then
+// ~/.kube/config), and falls back to the in-cluster config when none of those
+// exist. Running outside the cluster (e.g. as a systemd unit) needs one of the
+// kubeconfigs.
+func kubeConfig(path string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// defaultNodeName is NODE_NAME (set from spec.nodeName in the DaemonSet), else
+// the hostname lowercased, which is kubelet's default node name.
+func defaultNodeName() string {
+	if v := os.Getenv("NODE_NAME"); v != "" {
+		return v
+	}
+	h, _ := os.Hostname()
+	return strings.ToLower(h)
+}
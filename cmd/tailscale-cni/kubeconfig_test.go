@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubeConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(path, []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: c
+  cluster:
+    server: https://api.example:6443
+users:
+- name: u
+  user:
+    token: secret
+contexts:
+- name: ctx
+  context: {cluster: c, user: u}
+current-context: ctx
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The explicit path wins over $KUBECONFIG.
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	c, err := kubeConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "https://api.example:6443" || c.BearerToken != "secret" {
+		t.Errorf("got host %q token %q", c.Host, c.BearerToken)
+	}
+
+	t.Setenv("KUBECONFIG", path)
+	if c, err := kubeConfig(""); err != nil || c.Host != "https://api.example:6443" {
+		t.Errorf("from $KUBECONFIG: %v, %v", c, err)
+	}
+
+	if _, err := kubeConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing -kubeconfig")
+	}
+}
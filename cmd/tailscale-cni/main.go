@@ -1,83 +1,206 @@
-// tailscale-cni runs as a DaemonSet and configures the node for pod networking
-// over Tailscale: writes CNI config (bridge+portmap), advertises the node's pod
-// CIDR via Tailscale, ensures accept-routes is on, and sets up nftables masq.
+// tailscale-cni runs as a DaemonSet (or a host systemd unit) and configures the
+// node for pod networking over Tailscale: writes CNI config (bridge+portmap),
+// advertises the node's pod CIDR via Tailscale, ensures accept-routes is on,
+// and sets up nftables masq.
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/lstoll/tailscale-cni/internal/cni"
+	"github.com/lstoll/tailscale-cni/internal/config"
 	"github.com/lstoll/tailscale-cni/internal/controller"
+	"github.com/lstoll/tailscale-cni/internal/logging"
 	"github.com/lstoll/tailscale-cni/internal/masq"
+	"github.com/lstoll/tailscale-cni/internal/netpol"
 	"github.com/lstoll/tailscale-cni/internal/routes"
 	"github.com/lstoll/tailscale-cni/internal/tailscale"
 
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
-
 	"net/netip"
 )
 
 func main() {
-	cniDir := flag.String("cni-dir", defaultEnv("CNI_DIR", "/etc/cni/net.d"), "Host path to write CNI conflist")
-	cniBinDir := flag.String("cni-bin-dir", defaultEnv("CNI_BIN_DIR", ""), "If set, copy bridge/host-local/portmap from -cni-plugin-source into this dir (host plugin path)")
-	cniPluginSource := flag.String("cni-plugin-source", defaultEnv("CNI_PLUGIN_SOURCE", "/cni"), "Path to built-in CNI plugins in the container (source for copy)")
-	bridgeName := flag.String("bridge", "cni0", "Bridge name for CNI")
-	clusterCIDR := flag.String("cluster-cidr", defaultEnv("CLUSTER_CIDR", "10.99.0.0/16"), "Cluster pod CIDR (for routes and CNI config)")
-	tailscaleSocket := flag.String("tailscale-socket", "", "Path to Tailscale socket (default: platform default)")
-	tailscaleIface := flag.String("tailscale-interface", "tailscale0", "Tailscale interface name for masq")
-	nodeName := flag.String("node-name", os.Getenv("NODE_NAME"), "Current node name")
-	resyncPeriod := flag.Duration("resync-period", 30*time.Minute, "How often to full resync node cache (informer resync)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
+
+	cfg := config.Default()
+	applyEnv(cfg)
+	bindConfigFlags(flag.CommandLine, cfg)
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML or JSON config file; flags given on the command line override its fields. Changes are applied without a restart where possible")
+	configPoll := positiveDuration(10 * time.Second)
+	flag.Var(&configPoll, "config-poll-interval", "How often to check -config for changes")
+	nodeName := flag.String("node-name", defaultNodeName(), "Current node name (default: NODE_NAME, else the lowercased hostname as kubelet uses)")
+	kubeconfig := flag.String("kubeconfig", "", "Path to a kubeconfig for running outside the cluster (default: $KUBECONFIG or ~/.kube/config if present, else the in-cluster config)")
 	flag.Parse()
 
+	loader := newConfigLoader(*configFile, flag.CommandLine)
+	var configData []byte
+	if *configFile != "" {
+		var err error
+		if configData, err = os.ReadFile(*configFile); err != nil {
+			fatal("failed to read config file", logging.Err(err))
+		}
+	}
+	cfg, err := loader.load(configData)
+	if err != nil {
+		fatal("invalid config", logging.Err(err))
+	}
+	if err := logging.Setup(os.Stderr, cfg.Log.Level, cfg.Log.Format); err != nil {
+		fatal("failed to set up logging", logging.Err(err))
+	}
+
 	if *nodeName == "" {
-		log.Fatal("node-name or NODE_NAME is required")
+		fatal("node-name or NODE_NAME is required")
 	}
 
-	// K8s client (in-cluster or kubeconfig)
-	kubeConfig, err := rest.InClusterConfig()
+	// K8s client (kubeconfig or in-cluster)
+	restConfig, err := kubeConfig(*kubeconfig)
 	if err != nil {
-		log.Fatalf("kube config: %v", err)
-
+		fatal("failed to load kube config", logging.Err(err))
 	}
 
-	tsClient := tailscale.NewClient(*tailscaleSocket)
-	routeManager := routes.NewManager(*tailscaleIface)
+	tsClient := tailscale.NewClient(cfg.Tailscale.Socket)
+	var routeOpts []routes.Option
+	if cfg.Routes.Mode == routeModePeer {
+		routeOpts = append(routeOpts, routes.WithOnLinkGateways())
+	}
+	routeOpts = append(routeOpts, routes.WithTable(cfg.Routes.Table))
+	routeManager := routes.NewManager(cfg.Tailscale.Interface, routeOpts...)
 
-	opts := runReconcileOpts{
+	opts := &runReconcileOpts{
 		tsClient:        tsClient,
-		cniDir:          *cniDir,
-		cniBinDir:       *cniBinDir,
-		cniPluginSource: *cniPluginSource,
-		bridgeName:      *bridgeName,
-		clusterCIDR:     *clusterCIDR,
-		tailscaleIface:  *tailscaleIface,
-	}
-
-	ctrl, err := controller.New(kubeConfig, *nodeName, func(ctx context.Context, ourPodCIDR string) error {
-		return runReconcile(ctx, opts, ourPodCIDR)
-	},
-		controller.WithResyncPeriod(*resyncPeriod),
-		controller.WithOtherRoutesReconciler(func(ctx context.Context, store cache.Store) error {
-			return reconcileOtherNodeRoutes(ctx, store, *nodeName, tsClient, routeManager)
+		cniDir:          cfg.CNI.Dir,
+		cniBinDir:       cfg.CNI.BinDir,
+		cniPluginSource: cfg.CNI.PluginSource,
+		bridgeName:      cfg.CNI.Bridge,
+		clusterCIDRs:    slices.Clone(cfg.ClusterCIDRs),
+		tailscaleIface:  cfg.Tailscale.Interface,
+		mtu:             cfg.CNI.MTU,
+		masq:            cfg.Masq.Enabled,
+		nonMasqCIDRs:    slices.Clone(cfg.Masq.NonMasqueradeCIDRs),
+		networkPolicy:   cfg.Controller.NetworkPolicy,
+		clampMSS:        cfg.Masq.ClampMSS,
+		mss:             cfg.Masq.MSS,
+		table:           &tableState{},
+	}
+	// A config reload swaps in new opts.
+	var currentOpts atomic.Pointer[runReconcileOpts]
+	currentOpts.Store(opts)
+
+	otherRoutes := &otherRoutesReconciler{
+		selfNodeName: *nodeName,
+		mode:         cfg.Routes.Mode,
+		tsClient:     tsClient,
+		routeManager: routeManager,
+	}
+	if routeManager.Table() != routes.MainTable {
+		otherRoutes.rules = policyRules(opts.clusterCIDRs, cfg.Routes.RulePriority)
+	}
+	live := &liveConfig{loader: loader, opts: &currentOpts, otherRoutes: otherRoutes, local: cfg, running: cfg}
+
+	ctrlOpts := []controller.Option{
+		controller.WithResyncPeriod(cfg.Controller.ResyncPeriod.Duration),
+		controller.WithOtherRoutesReconciler(otherRoutes.reconcile),
+		controller.WithRouteApprovalChecker(func(ctx context.Context, podCIDRs []string) ([]string, error) {
+			return unapprovedRoutes(ctx, tsClient, podCIDRs)
+		}, cfg.Tailscale.ApprovalRecheck.Duration),
+		controller.WithNonMasqueradeUpdater(func(ctx context.Context) error {
+			return masq.SetNonMasqueradeCIDRs(currentOpts.Load().nonMasqCIDRs)
 		}),
-	)
+	}
+	if cfg.Controller.ClusterConfig != "" {
+		ctrlOpts = append(ctrlOpts, controller.WithClusterConfig(cfg.Controller.ClusterConfig, live.applyClusterSettings))
+	}
+	loadOpts := func() runReconcileOpts { return *currentOpts.Load() }
+	if cfg.Controller.EgressSNAT {
+		if !cfg.Masq.Enabled {
+			slog.Warn("egress SNAT has no effect while masq is disabled")
+		}
+		ctrlOpts = append(ctrlOpts, controller.WithEgressSNAT(opts.table.egressSNAT(loadOpts)))
+	}
+	if cfg.Controller.NetworkPolicy {
+		if err := bridgeNetfilter("/proc/sys"); err != nil {
+			slog.Warn("NetworkPolicy is not enforced between pods on this node", logging.Err(err))
+		}
+		ctrlOpts = append(ctrlOpts, controller.WithNetworkPolicy(opts.table.networkPolicy(loadOpts)))
+	}
+	if cfg.Controller.AllocateNodeCIDRs {
+		ctrlOpts = append(ctrlOpts, controller.WithAllocator(controller.AllocatorConfig{
+			ClusterCIDRs:  opts.clusterCIDRs,
+			MaskSizeIPv4:  cfg.Controller.NodeCIDRMaskSize,
+			MaskSizeIPv6:  cfg.Controller.NodeCIDRMaskSizeIPv6,
+			Namespace:     defaultEnv("POD_NAMESPACE", "kube-system"),
+			ConfigMapName: cfg.Controller.AllocatorConfigMap,
+		}))
+	}
+
+	ctrl, err := controller.New(restConfig, *nodeName, func(ctx context.Context, ourPodCIDRs, previousPodCIDRs []string) error {
+		return runReconcile(ctx, *currentOpts.Load(), ourPodCIDRs, previousPodCIDRs)
+	}, ctrlOpts...)
 	if err != nil {
-		log.Fatalf("controller: %v", err)
+		fatal("failed to create controller", logging.Err(err))
 	}
+	opts.table.podCIDRs = ctrl.AppliedPodCIDRs
+	live.updateNonMasq = ctrl.UpdateNonMasquerade
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if cfg.MetricsAddr != "" {
+		ready := &readiness{opts: &currentOpts, ctrl: ctrl, tailscale: tsClient, otherRoutes: otherRoutes}
+		if err := listenHTTP(ctx, cfg.MetricsAddr, newHTTPHandler(ready)); err != nil {
+			fatal("failed to listen for metrics", logging.Err(err))
+		}
+	}
+
+	// Re-apply prefs and host routes when tailscaled restarts, re-logs-in,
+	// changes address or someone edits our advertised routes by hand, and
+	// only other nodes' routes when a peer's routes or online status change.
+	// When tailscaled goes away, re-check it so NetworkUnavailable says so.
+	go tsClient.WatchChanges(ctx, ctrl.Resync, ctrl.ResyncOtherRoutes, ctrl.RecheckNetwork)
+	// Re-add host routes as soon as one is deleted or tailscale0 is recreated.
+	go routeManager.Watch(ctx, ctrl.ResyncOtherRoutes)
+	if *configFile != "" {
+		go config.Watch(ctx, *configFile, time.Duration(configPoll), func(data []byte) {
+			if live.reloadFile(data) {
+				ctrl.Resync()
+			}
+		})
+	}
+
 	ctrl.Run(ctx)
+
+	if cfg.CleanupOnExit {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second) // within the default 30s termination grace period
+		defer cancel()
+		if err := cleanup(cleanupCtx, *currentOpts.Load(), routeManager, ctrl.AppliedPodCIDRs()); err != nil {
+			fatal("cleanup failed", logging.Err(err))
+		}
+		slog.Info("cleanup: removed advertised routes, CNI config, host routes and rules and nftables table")
+	}
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 func defaultEnv(key, fallback string) string {
@@ -87,74 +210,161 @@ func defaultEnv(key, fallback string) string {
 	return fallback
 }
 
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 type runReconcileOpts struct {
 	tsClient        *tailscale.Client
 	cniDir          string
 	cniBinDir       string
 	cniPluginSource string
 	bridgeName      string
-	clusterCIDR     string
+	clusterCIDRs    []string
 	tailscaleIface  string
+	mtu             int
+	masq            bool
+	nonMasqCIDRs    []string
+	networkPolicy   bool
+	clampMSS        bool
+	mss             int
+	table           *tableState // shared by every copy
+}
+
+// nftables reports whether anything goes in the nftables table.
+func (o runReconcileOpts) nftables() bool {
+	return o.masq || o.networkPolicy || o.clampMSS
+}
+
+// masqConfig returns the nftables table config for our pod CIDRs.
+func (o runReconcileOpts) masqConfig(ourPodCIDRs []string) masq.Config {
+	snat, policy := o.table.get()
+	c := masq.Config{
+		PodCIDRs:           ourPodCIDRs,
+		Masquerade:         o.masq,
+		BridgeName:         o.bridgeName,
+		TailscaleInterface: o.tailscaleIface,
+		NonMasqueradeCIDRs: o.nonMasqCIDRs,
+		EgressSNAT:         snat,
+		ClampMSS:           o.clampMSS,
+		MSS:                o.mss,
+	}
+	if o.networkPolicy {
+		c.NetworkPolicy = policy
+		if policy == nil {
+			c.NetworkPolicy = &netpol.Policy{} // not synced yet
+		}
+	}
+	return c
 }
 
-func runReconcile(ctx context.Context, o runReconcileOpts, ourPodCIDR string) error {
-	if ourPodCIDR == "" {
+func runReconcile(ctx context.Context, o runReconcileOpts, ourPodCIDRs, previousPodCIDRs []string) error {
+	if len(ourPodCIDRs) == 0 {
 		return nil
 	}
 
 	// 1) Optionally copy built-in CNI plugins to host, then write CNI config
 	if o.cniBinDir != "" {
 		if err := cni.CopyPlugins(o.cniPluginSource, o.cniBinDir); err != nil {
-			return fmt.Errorf("copy CNI plugins: %w", err)
+			return controller.NewConditionError(controller.ReasonCNIConfigFailed, fmt.Errorf("copy CNI plugins: %w", err))
 		}
 	}
-	if err := cni.WriteConflist(o.cniDir, "tailscale-cni", o.bridgeName, ourPodCIDR, o.clusterCIDR); err != nil {
-		return fmt.Errorf("write CNI config: %w", err)
+	if err := cni.WriteConflist(o.cniDir, "tailscale-cni", o.bridgeName, o.mtu, ourPodCIDRs, o.clusterCIDRs); err != nil {
+		return controller.NewConditionError(controller.ReasonCNIConfigFailed, fmt.Errorf("write CNI config: %w", err))
 	}
 
-	// 2) Advertise our pod CIDR via Tailscale and ensure we accept routes
-	prefix, err := netip.ParsePrefix(ourPodCIDR)
-	if err != nil {
-		return fmt.Errorf("parse pod CIDR: %w", err)
+	// 2) Advertise our pod CIDRs via Tailscale and ensure we accept routes
+	prefixes := make([]netip.Prefix, 0, len(ourPodCIDRs))
+	for _, cidr := range ourPodCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("parse pod CIDR: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
 	}
-	log.Printf("advertising route %s via Tailscale (approve in admin console if using ACLs)", ourPodCIDR)
-	if err := o.tsClient.AdvertiseRoute(ctx, prefix); err != nil {
-		return fmt.Errorf("advertise route %s via Tailscale: %w (is tailscaled running on this node?)", ourPodCIDR, err)
+	slog.Debug("advertising pod CIDRs via Tailscale (approve in admin console if using ACLs)", logging.CIDRs(ourPodCIDRs))
+	if _, err := o.tsClient.SetOwnedRoutes(ctx, prefixes, ownedPrefix(previousPodCIDRs)); err != nil {
+		return controller.NewConditionError(controller.ReasonAdvertiseFailed, fmt.Errorf("advertise routes %v via Tailscale: %w (is tailscaled running on this node?)", ourPodCIDRs, err))
 	}
 	if err := o.tsClient.EnsureAcceptRoutes(ctx, true); err != nil {
-		return fmt.Errorf("enable accept-routes: %w", err)
+		return controller.NewConditionError(controller.ReasonTailscaleUnavailable, fmt.Errorf("enable accept-routes: %w", err))
 	}
 
-	// 3) Masq traffic from our pod CIDR that goes out the host (internet); exclude bridge and Tailscale
-	if err := masq.Setup(ourPodCIDR, o.bridgeName, o.tailscaleIface); err != nil {
-		return fmt.Errorf("nftables masq: %w", err)
+	// 3) Masq traffic from our pod CIDRs that goes out the host (internet); exclude bridge and Tailscale.
+	// Enforce NetworkPolicy and clamp the MSS of traffic via Tailscale in the same table.
+	if !o.nftables() {
+		if err := masq.Teardown(); err != nil {
+			return controller.NewConditionError(controller.ReasonMasqSetupFailed, fmt.Errorf("remove nftables masq: %w", err))
+		}
+		return nil
+	}
+	if err := masq.Setup(o.masqConfig(ourPodCIDRs)); err != nil {
+		return controller.NewConditionError(controller.ReasonMasqSetupFailed, fmt.Errorf("nftables masq: %w", err))
 	}
 
 	return nil
 }
 
-// reconcileOtherNodeRoutes builds desired routes: other nodes' pod CIDR -> our Tailscale IP.
-// Using our own IP as gateway forces traffic out tailscale0; Tailscale then routes it
-// to the peer that advertises that subnet.
-func reconcileOtherNodeRoutes(ctx context.Context, store cache.Store, selfNodeName string, tsClient *tailscale.Client, routeManager *routes.Manager) error {
-	list := store.List()
-	st, _ := tsClient.Status(ctx)
-	selfIP, ok := tailscale.SelfTailscaleIPv4(st)
-	if !ok {
-		return fmt.Errorf("no Tailscale IPv4 for this node (tailscale status has no TailscaleIPs)")
-	}
-	selfVia := selfIP.String()
-	desired := make(map[string]string)
-	for _, obj := range list {
-		node, ok := obj.(*corev1.Node)
-		if !ok || node.Name == selfNodeName {
-			continue
+// unapprovedRoutes returns which of podCIDRs the tailnet has not approved yet.
+func unapprovedRoutes(ctx context.Context, tsClient tailscaleRoutes, podCIDRs []string) ([]string, error) {
+	prefixes := make([]netip.Prefix, 0, len(podCIDRs))
+	for _, cidr := range podCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parse pod CIDR: %w", err)
 		}
-		cidr := node.Spec.PodCIDR
-		if cidr == "" {
-			continue
+		prefixes = append(prefixes, prefix)
+	}
+	unapproved, err := tsClient.UnapprovedRoutes(ctx, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(unapproved))
+	for _, p := range unapproved {
+		out = append(out, p.String())
+	}
+	return out, nil
+}
+
+// ownedPrefix reports whether an advertised prefix is one of ours: one of
+// podCIDRs, the pod CIDRs we applied earlier or that were recorded for our
+// node. Anything else, even inside the cluster CIDR (e.g. a subnet router
+// for another node's pods running on this host), is left alone.
+func ownedPrefix(podCIDRs []string) func(netip.Prefix) bool {
+	var owned []netip.Prefix
+	for _, cidr := range podCIDRs {
+		if p, err := netip.ParsePrefix(cidr); err == nil {
+			owned = append(owned, p.Masked())
 		}
-		desired[cidr] = selfVia
 	}
-	return routeManager.EnsureRoutes(desired)
+	return func(r netip.Prefix) bool {
+		return slices.Contains(owned, r.Masked())
+	}
+}
+
+// cleanup undoes everything runReconcile and otherRoutesReconciler set up:
+// advertised pod CIDRs, the conflist, host routes and rules, and the nftables table.
+// It keeps going after a failure so as much as possible is removed.
+func cleanup(ctx context.Context, o runReconcileOpts, routeManager *routes.Manager, ownedPodCIDRs []string) error {
+	var errs []error
+	if _, err := o.tsClient.SetOwnedRoutes(ctx, nil, ownedPrefix(ownedPodCIDRs)); err != nil {
+		errs = append(errs, fmt.Errorf("withdraw Tailscale routes: %w", err))
+	}
+	if err := cni.Remove(o.cniDir); err != nil {
+		errs = append(errs, fmt.Errorf("remove CNI config: %w", err))
+	}
+	if err := routeManager.RemoveAll(); err != nil {
+		errs = append(errs, fmt.Errorf("remove host routes and rules: %w", err))
+	}
+	if err := masq.Teardown(); err != nil {
+		errs = append(errs, fmt.Errorf("remove nftables table: %w", err))
+	}
+	return errors.Join(errs...)
 }
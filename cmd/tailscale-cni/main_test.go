@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestOwnedPrefix(t *testing.T) {
+	owned := ownedPrefix([]string{"10.99.1.0/24", "fd00:99:0:1::/64", "bogus"})
+	for _, tt := range []struct {
+		prefix string
+		want   bool
+	}{
+		{"10.99.1.0/24", true},
+		{"fd00:99:0:1::/64", true},
+		{"10.99.2.0/24", false},     // another node's, from the same cluster CIDR
+		{"10.99.1.0/25", false},     // inside ours, but not ours
+		{"10.99.0.0/16", false},     // the cluster CIDR itself
+		{"0.0.0.0/0", false},        // exit node
+		{"fd00:99:0:2::/64", false}, // another node's IPv6
+	} {
+		if got := owned(netip.MustParsePrefix(tt.prefix)); got != tt.want {
+			t.Errorf("owned(%s) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+	if ownedPrefix(nil)(netip.MustParsePrefix("10.99.1.0/24")) {
+		t.Error("nothing is owned without pod CIDRs")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lstoll/tailscale-cni/internal/config"
+	"github.com/lstoll/tailscale-cni/internal/controller"
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/routes"
+	"github.com/lstoll/tailscale-cni/internal/tailscale"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// Routing modes for other nodes' pod CIDRs (-route-mode).
+const (
+	// routeModeSelf routes every remote pod CIDR out tailscale0 with no
+	// gateway (the kernel won't take our own IPv6 address as one);
+	// tailscaled (with accept-routes) then picks the peer advertising the
+	// subnet. We still need a Tailscale address of the CIDR's family.
+	routeModeSelf = config.RouteModeSelf
+	// routeModePeer routes each remote pod CIDR via the Tailscale IP of the
+	// peer serving it (ipnstate PrimaryRoutes). CIDRs with no serving peer,
+	// or whose peer is offline, get no route.
+	routeModePeer = config.RouteModePeer
+)
+
+// nodeRoute describes how one remote node's pod CIDR is routed. The set of
+// them is the node -> Tailscale peer mapping, logged whenever it changes.
+type nodeRoute struct {
+	Node    string `json:"node"`
+	CIDR    string `json:"cidr"`
+	Via     string `json:"via,omitempty"`  // empty in self mode
+	Peer    string `json:"peer,omitempty"` // serving peer's host name (peer mode)
+	Online  bool   `json:"online"`         // serving peer is online (peer mode)
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// logAttrs returns the attributes logged for r.
+func (r nodeRoute) logAttrs() []any {
+	attrs := []any{logging.Node(r.Node), logging.CIDR(r.CIDR)}
+	if r.Peer != "" {
+		attrs = append(attrs, "peer", r.Peer, "online", r.Online)
+	}
+	if r.Skipped != "" {
+		return append(attrs, "skipped", r.Skipped)
+	}
+	if r.Via == "" {
+		return attrs // out the Tailscale interface (self mode)
+	}
+	return append(attrs, logging.Via(r.Via))
+}
+
+// otherRoutesReconciler installs host routes to other nodes' pod CIDRs.
+type otherRoutesReconciler struct {
+	selfNodeName string
+	tsClient     *tailscale.Client
+	routeManager *routes.Manager
+
+	mu     sync.Mutex
+	mode   string
+	rules  []routes.Rule // policy rules for a dedicated route table
+	table  []nodeRoute   // from the last reconcile
+	synced bool          // a reconcile has completed
+}
+
+// setMode changes the routing mode; routes change on the next reconcile.
+func (r *otherRoutesReconciler) setMode(mode string) {
+	r.mu.Lock()
+	r.mode = mode
+	r.mu.Unlock()
+	r.routeManager.SetOnLinkGateways(mode == routeModePeer)
+}
+
+// setRules replaces the policy rules, e.g. after the cluster CIDRs changed.
+// They are applied on the next reconcile.
+func (r *otherRoutesReconciler) setRules(rules []routes.Rule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+}
+
+// reconcile is a controller.OtherRoutesReconciler.
+func (r *otherRoutesReconciler) reconcile(ctx context.Context, store cache.Store) error {
+	st, err := r.tsClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("tailscale status: %w", err)
+	}
+	if len(st.TailscaleIPs) == 0 {
+		return fmt.Errorf("no Tailscale IPs for this node (tailscale status has no TailscaleIPs)")
+	}
+	r.mu.Lock()
+	mode := r.mode
+	r.mu.Unlock()
+	var nodes []*corev1.Node
+	for _, obj := range store.List() {
+		if node, ok := obj.(*corev1.Node); ok {
+			nodes = append(nodes, node)
+		}
+	}
+
+	desired, table := desiredOtherNodeRoutes(nodes, r.selfNodeName, st, mode)
+
+	r.mu.Lock()
+	changed := !slices.Equal(r.table, table)
+	r.table = table
+	rules := r.rules
+	r.mu.Unlock()
+	if changed {
+		for _, nr := range table {
+			logging.Component("routes").Info("route to node", nr.logAttrs()...)
+		}
+	}
+
+	if err := r.routeManager.EnsureRules(rules); err != nil {
+		return err
+	}
+	if err := r.routeManager.EnsureRoutes(desired); err != nil {
+		if errors.Is(err, routes.ErrGatewayUnreachable) {
+			return controller.NewConditionError(controller.ReasonGatewayUnreachable, fmt.Errorf("%w; will retry", err))
+		}
+		return err
+	}
+	r.mu.Lock()
+	r.synced = true
+	r.mu.Unlock()
+	return nil
+}
+
+// checkInstalled reports an error unless every route from the last reconcile
+// is in the kernel, as it is now rather than as the route manager last left
+// it. Skipped CIDRs (e.g. a peer is offline) don't count: one bad node
+// shouldn't make every other node unready. They are listed in the returned
+// summary instead.
+func (r *otherRoutesReconciler) checkInstalled() (string, error) {
+	r.mu.Lock()
+	table, synced := r.table, r.synced
+	r.mu.Unlock()
+	if !synced {
+		return "", fmt.Errorf("routes to other nodes not reconciled yet")
+	}
+	installed, err := r.routeManager.Installed()
+	if err != nil {
+		return "", fmt.Errorf("list installed routes: %w", err)
+	}
+	var missing, skipped []string
+	for _, nr := range table {
+		via, ok := installed[nr.CIDR]
+		switch {
+		case nr.Skipped != "":
+			skipped = append(skipped, nr.CIDR)
+		case !ok || via != nr.Via:
+			missing = append(missing, nr.CIDR)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("routes to %v not installed", missing)
+	}
+	summary := fmt.Sprintf("%d routes installed", len(table)-len(skipped))
+	if len(skipped) > 0 {
+		summary += fmt.Sprintf(", skipped %v", skipped)
+	}
+	return summary, nil
+}
+
+// policyRules returns the rules sending traffic to the cluster CIDRs to the
+// dedicated route table. Our own pod CIDR has no route there, so traffic to
+// local pods falls through to the main table and the bridge.
+func policyRules(clusterCIDRs []string, priority int) []routes.Rule {
+	rules := make([]routes.Rule, 0, len(clusterCIDRs))
+	for _, cidr := range clusterCIDRs {
+		rules = append(rules, routes.Rule{Dst: cidr, Priority: priority})
+	}
+	return rules
+}
+
+// desiredOtherNodeRoutes computes the host routes (cidr -> via) for every
+// node other than selfNodeName, plus a per-CIDR description of the decision,
+// sorted by node then CIDR.
+func desiredOtherNodeRoutes(nodes []*corev1.Node, selfNodeName string, st *ipnstate.Status, mode string) (map[string]string, []nodeRoute) {
+	owners := tailscale.RouteOwners(st)
+	desired := make(map[string]string)
+	var table []nodeRoute
+	for _, node := range nodes {
+		if node.Name == selfNodeName {
+			continue
+		}
+		for _, cidr := range controller.NodePodCIDRs(node) {
+			nr := nodeRoute{Node: node.Name, CIDR: cidr}
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				nr.Skipped = fmt.Sprintf("invalid pod CIDR: %v", err)
+				table = append(table, nr)
+				continue
+			}
+			// The route manager and the kernel only know the masked prefix.
+			prefix = prefix.Masked()
+			nr.CIDR = prefix.String()
+
+			var via netip.Addr
+			switch mode {
+			case routeModePeer:
+				peer, ok := owners[prefix]
+				if !ok {
+					nr.Skipped = "no Tailscale peer serves this CIDR (not advertised or not approved)"
+					break
+				}
+				nr.Peer, nr.Online = peer.HostName, peer.Online
+				if !peer.Online {
+					nr.Skipped = "serving peer is offline"
+					break
+				}
+				if via, ok = tailscale.PeerTailscaleIPFor(peer, prefix); !ok {
+					nr.Skipped = "serving peer has no Tailscale address of the same family"
+				}
+			default:
+				if _, ok := tailscale.SelfTailscaleIPFor(st, prefix); !ok {
+					nr.Skipped = "no Tailscale address of the same family on this node"
+				}
+			}
+			if nr.Skipped == "" {
+				if via.IsValid() {
+					nr.Via = via.String()
+				}
+				desired[nr.CIDR] = nr.Via
+			}
+			table = append(table, nr)
+		}
+	}
+	slices.SortFunc(table, func(a, b nodeRoute) int {
+		if c := strings.Compare(a.Node, b.Node); c != 0 {
+			return c
+		}
+		return strings.Compare(a.CIDR, b.CIDR)
+	})
+	return desired, table
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/lstoll/tailscale-cni/internal/routes"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+func TestDesiredOtherNodeRoutes(t *testing.T) {
+	node := func(name string, cidrs ...string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.NodeSpec{PodCIDRs: cidrs}}
+	}
+	peer := func(host, ip string, online bool, routes ...string) *ipnstate.PeerStatus {
+		var prefixes []netip.Prefix
+		for _, r := range routes {
+			prefixes = append(prefixes, netip.MustParsePrefix(r))
+		}
+		primary := views.SliceOf(prefixes)
+		return &ipnstate.PeerStatus{
+			HostName:      host,
+			TailscaleIPs:  []netip.Addr{netip.MustParseAddr(ip)},
+			Online:        online,
+			PrimaryRoutes: &primary,
+		}
+	}
+	st := &ipnstate.Status{
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): peer("host-b", "100.64.0.2", true, "10.99.2.0/24"),
+			key.NewNode().Public(): peer("host-c", "100.64.0.3", false, "10.99.3.0/24"),
+		},
+	}
+	nodes := []*corev1.Node{
+		node("a", "10.99.1.0/24"),
+		node("b", "10.99.2.0/24"),
+		node("c", "10.99.3.0/24"),
+		node("d", "10.99.4.0/24"),
+	}
+
+	desired, table := desiredOtherNodeRoutes(nodes, "a", st, routeModeSelf)
+	if via, ok := desired["10.99.4.0/24"]; len(desired) != 3 || !ok || via != "" {
+		t.Errorf("self mode: desired = %v", desired)
+	}
+	if len(table) != 3 {
+		t.Errorf("self mode: table = %v", table)
+	}
+
+	desired, table = desiredOtherNodeRoutes(nodes, "a", st, routeModePeer)
+	if len(desired) != 1 || desired["10.99.2.0/24"] != "100.64.0.2" {
+		t.Errorf("peer mode: desired = %v, want only 10.99.2.0/24 via 100.64.0.2", desired)
+	}
+	if len(table) != 3 {
+		t.Fatalf("peer mode: table = %v", table)
+	}
+	if table[0].Peer != "host-b" || table[0].Skipped != "" {
+		t.Errorf("node b: %+v", table[0])
+	}
+	if table[1].Peer != "host-c" || table[1].Online || table[1].Skipped == "" {
+		t.Errorf("node c should be skipped as offline: %+v", table[1])
+	}
+	if table[2].Peer != "" || table[2].Skipped == "" {
+		t.Errorf("node d should be skipped with no peer: %+v", table[2])
+	}
+}
+
+func TestDesiredOtherNodeRoutesPeerMode(t *testing.T) {
+	addrs := func(ips ...string) []netip.Addr {
+		var out []netip.Addr
+		for _, ip := range ips {
+			out = append(out, netip.MustParseAddr(ip))
+		}
+		return out
+	}
+	routes := func(cidrs ...string) *views.Slice[netip.Prefix] {
+		var prefixes []netip.Prefix
+		for _, c := range cidrs {
+			prefixes = append(prefixes, netip.MustParsePrefix(c))
+		}
+		v := views.SliceOf(prefixes)
+		return &v
+	}
+	st := &ipnstate.Status{
+		TailscaleIPs: addrs("100.64.0.1", "fd7a:115c:a1e0::1"),
+		Self:         &ipnstate.PeerStatus{HostName: "host-a", TailscaleIPs: addrs("100.64.0.1", "fd7a:115c:a1e0::1")},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				HostName:      "host-b",
+				TailscaleIPs:  addrs("100.64.0.2", "fd7a:115c:a1e0::2"),
+				Online:        true,
+				PrimaryRoutes: routes("10.99.2.0/24", "fd00:99:0:2::/64"),
+			},
+			key.NewNode().Public(): {
+				HostName:      "host-c",
+				TailscaleIPs:  addrs("100.64.0.3"), // no IPv6
+				Online:        true,
+				PrimaryRoutes: routes("10.99.3.0/24", "fd00:99:0:3::/64"),
+			},
+		},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: corev1.NodeSpec{PodCIDRs: []string{"10.99.1.0/24", "fd00:99:0:1::/64"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: corev1.NodeSpec{PodCIDRs: []string{"10.99.2.0/24", "fd00:99:0:2::/64"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c"}, Spec: corev1.NodeSpec{PodCIDRs: []string{"10.99.3.0/24", "fd00:99:0:3::/64"}}},
+	}
+
+	desired, table := desiredOtherNodeRoutes(nodes, "a", st, routeModePeer)
+	for _, tt := range []struct {
+		cidr, via string // via "" means no route
+	}{
+		{"10.99.2.0/24", "100.64.0.2"},
+		{"fd00:99:0:2::/64", "fd7a:115c:a1e0::2"},
+		{"10.99.3.0/24", "100.64.0.3"},
+		// Not via our own IPv6 address, even though we have one.
+		{"fd00:99:0:3::/64", ""},
+	} {
+		if via, ok := desired[tt.cidr]; via != tt.via || ok != (tt.via != "") {
+			t.Errorf("%s: via %q (routed %v), want %q", tt.cidr, via, ok, tt.via)
+		}
+	}
+	if len(desired) != 3 {
+		t.Errorf("desired = %v, want 3 routes", desired)
+	}
+	for _, nr := range table {
+		if nr.CIDR == "fd00:99:0:3::/64" && (nr.Peer != "host-c" || nr.Skipped == "") {
+			t.Errorf("fd00:99:0:3::/64 should be skipped for host-c's missing IPv6: %+v", nr)
+		}
+	}
+}
+
+func TestDesiredOtherNodeRoutesNonCanonical(t *testing.T) {
+	primary := views.SliceOf([]netip.Prefix{netip.MustParsePrefix("10.99.2.0/24"), netip.MustParsePrefix("fd00:99:0:2::/64")})
+	st := &ipnstate.Status{
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				HostName:      "host-b",
+				TailscaleIPs:  []netip.Addr{netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd7a:115c:a1e0::2")},
+				Online:        true,
+				PrimaryRoutes: &primary,
+			},
+		},
+	}
+	// Host bits set and a long-hand IPv6 spelling: routes are keyed by the
+	// masked prefix, as the route manager and the kernel report them.
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: corev1.NodeSpec{PodCIDRs: []string{"10.99.2.1/24", "fd00:99:0:2:0:0:0:0/64"}}},
+	}
+	for _, mode := range []string{routeModeSelf, routeModePeer} {
+		desired, table := desiredOtherNodeRoutes(nodes, "a", st, mode)
+		if len(desired) != 2 {
+			t.Errorf("%s mode: desired = %v, want 2 routes", mode, desired)
+		}
+		for _, cidr := range []string{"10.99.2.0/24", "fd00:99:0:2::/64"} {
+			if _, ok := desired[cidr]; !ok {
+				t.Errorf("%s mode: desired = %v, missing %s", mode, desired, cidr)
+			}
+		}
+		for _, nr := range table {
+			if nr.Skipped != "" || (nr.CIDR != "10.99.2.0/24" && nr.CIDR != "fd00:99:0:2::/64") {
+				t.Errorf("%s mode: table entry %+v", mode, nr)
+			}
+		}
+	}
+}
+
+func TestCheckInstalled(t *testing.T) {
+	// No such interface, so the kernel has none of its routes.
+	r := &otherRoutesReconciler{routeManager: routes.NewManager("tscni-test0")}
+	if _, err := r.checkInstalled(); err == nil {
+		t.Error("want an error before the first reconcile")
+	}
+
+	r.synced = true
+	r.table = []nodeRoute{{Node: "b", CIDR: "10.99.2.0/24"}}
+	if _, err := r.checkInstalled(); err == nil || !strings.Contains(err.Error(), "10.99.2.0/24") {
+		t.Errorf("route missing from the kernel: err = %v", err)
+	}
+
+	r.table = []nodeRoute{{Node: "c", CIDR: "10.99.3.0/24", Skipped: "serving peer is offline"}}
+	summary, err := r.checkInstalled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0 routes installed, skipped [10.99.3.0/24]"; summary != want {
+		t.Errorf("summary = %q, want %q", summary, want)
+	}
+}
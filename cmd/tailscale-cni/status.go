@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/cni"
+	"github.com/lstoll/tailscale-cni/internal/controller"
+	"github.com/lstoll/tailscale-cni/internal/masq"
+	"github.com/lstoll/tailscale-cni/internal/routes"
+	"github.com/lstoll/tailscale-cni/internal/tailscale"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// statusReport is the output of `tailscale-cni status`. Sections are filled in
+// independently and failures collected in Errors, so one broken dependency
+// (e.g. tailscaled down) doesn't hide the rest.
+type statusReport struct {
+	Node      string           `json:"node"`
+	PodCIDRs  []string         `json:"podCIDRs"`
+	Tailscale *tailscaleReport `json:"tailscale,omitempty"`
+	Routes    *routesReport    `json:"routes,omitempty"`
+	Nftables  string           `json:"nftables,omitempty"`
+	Conflist  any              `json:"conflist,omitempty"` // parsed JSON, or the raw text if it doesn't parse
+	Errors    []string         `json:"errors,omitempty"`
+
+	conflistPath string
+}
+
+type tailscaleReport struct {
+	BackendState string   `json:"backendState"`
+	SelfIPs      []string `json:"selfIPs"`
+	Advertised   []string `json:"advertised"`
+	Unapproved   []string `json:"unapproved,omitempty"`
+	AcceptRoutes bool     `json:"acceptRoutes"`
+}
+
+// routesReport compares the host routes in the kernel with the routes we
+// would install for each Node right now.
+type routesReport struct {
+	Mode      string            `json:"mode"`
+	Table     int               `json:"table"`
+	Installed map[string]string `json:"installed"`         // cidr -> via, tagged as ours
+	Desired   []nodeRoute       `json:"desired"`           // per Node
+	Missing   []string          `json:"missing,omitempty"` // desired but not installed, or via another gateway
+	Stale     []string          `json:"stale,omitempty"`   // installed but not desired
+}
+
+type statusOpts struct {
+	nodeName       string
+	cniDir         string
+	tailscaleIface string
+	routeTable     int
+	routeMode      string
+	tsClient       *tailscale.Client
+	routeManager   *routes.Manager
+	clientset      kubernetes.Interface // nil if there is no cluster access
+}
+
+// runStatus implements `tailscale-cni status` and returns the exit code:
+// 1 if any section could not be collected.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	output := fs.String("o", "text", "Output format: text or json")
+	nodeName := fs.String("node-name", defaultNodeName(), "Current node name (default: NODE_NAME, else the lowercased hostname)")
+	kubeconfig := fs.String("kubeconfig", "", "Path to a kubeconfig (default: $KUBECONFIG or ~/.kube/config if present, else the in-cluster config)")
+	cniDir := fs.String("cni-dir", defaultEnv("CNI_DIR", "/etc/cni/net.d"), "Host path of the CNI conflist")
+	tailscaleSocket := fs.String("tailscale-socket", "", "Path to Tailscale socket (default: platform default)")
+	tailscaleIface := fs.String("tailscale-interface", "tailscale0", "Tailscale interface name")
+	routeTable := fs.Int("route-table", 0, "Routing table the DaemonSet uses (-route-table); 0 is the main table")
+	routeMode := fs.String("route-mode", routeModeSelf, "Routing mode the DaemonSet uses (-route-mode)")
+	_ = fs.Parse(args)
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "-o must be text or json\n")
+		return 2
+	}
+
+	o := statusOpts{
+		nodeName:       *nodeName,
+		cniDir:         *cniDir,
+		tailscaleIface: *tailscaleIface,
+		routeTable:     *routeTable,
+		routeMode:      *routeMode,
+		tsClient:       tailscale.NewClient(*tailscaleSocket),
+		routeManager:   routes.NewManager(*tailscaleIface, routes.WithTable(*routeTable)),
+	}
+	var clientErr error
+	if config, err := kubeConfig(*kubeconfig); err != nil {
+		clientErr = fmt.Errorf("kube config: %w", err)
+	} else if o.clientset, err = kubernetes.NewForConfig(config); err != nil {
+		clientErr = fmt.Errorf("kube client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	report := collectStatus(ctx, o)
+	if clientErr != nil {
+		report.Errors = append([]string{clientErr.Error()}, report.Errors...)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		writeStatusText(os.Stdout, report)
+	}
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// collectStatus gathers every section of the report.
+func collectStatus(ctx context.Context, o statusOpts) *statusReport {
+	r := &statusReport{Node: o.nodeName, conflistPath: cni.ConflistPath(o.cniDir)}
+	fail := func(section string, err error) {
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", section, err))
+	}
+
+	var nodes []*corev1.Node
+	if o.clientset != nil {
+		list, err := o.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			fail("nodes", err)
+		} else {
+			for i := range list.Items {
+				n := &list.Items[i]
+				nodes = append(nodes, n)
+				if n.Name == o.nodeName {
+					r.PodCIDRs = controller.NodePodCIDRs(n)
+				}
+			}
+		}
+	}
+
+	st, err := o.tsClient.Status(ctx)
+	if err != nil {
+		fail("tailscale status", err)
+	}
+	prefs, err := o.tsClient.Prefs(ctx)
+	if err != nil {
+		fail("tailscale prefs", err)
+	}
+	if st != nil && prefs != nil {
+		ts := &tailscaleReport{BackendState: st.BackendState, AcceptRoutes: prefs.RouteAll}
+		for _, ip := range st.TailscaleIPs {
+			ts.SelfIPs = append(ts.SelfIPs, ip.String())
+		}
+		for _, p := range prefs.AdvertiseRoutes {
+			ts.Advertised = append(ts.Advertised, p.String())
+		}
+		for _, p := range tailscale.UnapprovedRoutes(st, prefs.AdvertiseRoutes) {
+			ts.Unapproved = append(ts.Unapproved, p.String())
+		}
+		r.Tailscale = ts
+	}
+
+	installed, err := o.routeManager.Installed()
+	if err != nil {
+		fail("host routes", err)
+	} else {
+		rr := &routesReport{Mode: o.routeMode, Table: o.routeManager.Table(), Installed: installed}
+		if st != nil && nodes != nil {
+			var desired map[string]string
+			desired, rr.Desired = desiredOtherNodeRoutes(nodes, o.nodeName, st, o.routeMode)
+			rr.Missing, rr.Stale = diffRoutes(desired, installed)
+		}
+		r.Routes = rr
+	}
+
+	if r.Nftables, err = masq.Ruleset(); err != nil {
+		fail("nftables", err)
+	}
+
+	if data, err := os.ReadFile(r.conflistPath); err != nil {
+		fail("conflist", err)
+	} else if json.Valid(data) {
+		r.Conflist = json.RawMessage(data)
+	} else {
+		r.Conflist = string(data)
+	}
+	return r
+}
+
+// diffRoutes returns the CIDRs in desired that are not installed with the same
+// gateway, and the CIDRs installed but not desired, both sorted.
+func diffRoutes(desired, installed map[string]string) (missing, stale []string) {
+	for cidr, via := range desired {
+		if got, ok := installed[cidr]; !ok || got != via {
+			missing = append(missing, cidr)
+		}
+	}
+	for cidr := range installed {
+		if _, ok := desired[cidr]; !ok {
+			stale = append(stale, cidr)
+		}
+	}
+	slices.Sort(missing)
+	slices.Sort(stale)
+	return missing, stale
+}
+
+// writeStatusText prints r for humans.
+func writeStatusText(w io.Writer, r *statusReport) {
+	fmt.Fprintf(w, "Node:       %s\n", r.Node)
+	fmt.Fprintf(w, "Pod CIDRs:  %s\n", orNone(r.PodCIDRs))
+
+	if ts := r.Tailscale; ts != nil {
+		fmt.Fprintf(w, "\nTailscale:  %s, IPs %s\n", ts.BackendState, orNone(ts.SelfIPs))
+		fmt.Fprintf(w, "  accept-routes: %v\n", ts.AcceptRoutes)
+		for _, p := range ts.Advertised {
+			state := "approved"
+			if slices.Contains(ts.Unapproved, p) {
+				state = "NOT approved"
+			}
+			fmt.Fprintf(w, "  advertised:    %s (%s)\n", p, state)
+		}
+	}
+
+	if rr := r.Routes; rr != nil {
+		fmt.Fprintf(w, "\nRoutes (mode %s, table %d):\n", rr.Mode, rr.Table)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, nr := range rr.Desired {
+			state := "installed"
+			switch {
+			case nr.Skipped != "":
+				state = "skipped: " + nr.Skipped
+			case slices.Contains(rr.Missing, nr.CIDR):
+				state = "MISSING"
+				if via, ok := rr.Installed[nr.CIDR]; ok {
+					state += " (installed via " + via + ")"
+				}
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", nr.Node, nr.CIDR, orDash(nr.Via), state)
+		}
+		_ = tw.Flush()
+		for _, cidr := range rr.Stale {
+			fmt.Fprintf(w, "  stale: %s via %s (no Node wants it)\n", cidr, rr.Installed[cidr])
+		}
+	}
+
+	if r.Nftables != "" {
+		fmt.Fprintf(w, "\nnftables:\n%s", indent(r.Nftables))
+	}
+
+	if r.Conflist != nil {
+		fmt.Fprintf(w, "\nConflist %s:\n", r.conflistPath)
+		switch c := r.Conflist.(type) {
+		case json.RawMessage:
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, c, "", "  "); err != nil {
+				buf.Write(c)
+			}
+			fmt.Fprint(w, indent(buf.String()+"\n"))
+		case string:
+			fmt.Fprint(w, indent(c))
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(w, "\nErrors:\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(w, "  - %s\n", e)
+		}
+	}
+}
+
+func orNone(s []string) string {
+	if len(s) == 0 {
+		return "(none)"
+	}
+	return strings.Join(s, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// indent prefixes every line of s with two spaces.
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = "  " + l
+		}
+	}
+	return strings.Join(lines, "")
+}
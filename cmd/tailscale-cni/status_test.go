@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		desired        map[string]string
+		installed      map[string]string
+		missing, stale []string
+	}{
+		{name: "empty"},
+		{
+			name:      "in sync",
+			desired:   map[string]string{"10.99.2.0/24": "", "fd00:99:0:2::/64": ""},
+			installed: map[string]string{"10.99.2.0/24": "", "fd00:99:0:2::/64": ""},
+		},
+		{
+			name:      "not installed",
+			desired:   map[string]string{"10.99.3.0/24": "", "10.99.2.0/24": ""},
+			installed: map[string]string{},
+			missing:   []string{"10.99.2.0/24", "10.99.3.0/24"},
+		},
+		{
+			name:      "via another gateway",
+			desired:   map[string]string{"10.99.2.0/24": "100.64.0.2"},
+			installed: map[string]string{"10.99.2.0/24": "100.64.0.9"},
+			missing:   []string{"10.99.2.0/24"},
+		},
+		{
+			name:      "node removed",
+			desired:   map[string]string{"10.99.2.0/24": ""},
+			installed: map[string]string{"10.99.2.0/24": "", "10.99.4.0/24": "", "10.99.3.0/24": ""},
+			stale:     []string{"10.99.3.0/24", "10.99.4.0/24"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, stale := diffRoutes(tt.desired, tt.installed)
+			if !slices.Equal(missing, tt.missing) {
+				t.Errorf("missing = %v, want %v", missing, tt.missing)
+			}
+			if !slices.Equal(stale, tt.stale) {
+				t.Errorf("stale = %v, want %v", stale, tt.stale)
+			}
+		})
+	}
+}
+
+func TestWriteStatusText(t *testing.T) {
+	// tailscaled is down, so there is no Tailscale section and nothing to
+	// compute desired routes from; the installed routes are still listed.
+	r := &statusReport{
+		Node: "node-a",
+		Routes: &routesReport{
+			Mode:      routeModePeer,
+			Table:     52,
+			Installed: map[string]string{"10.99.2.0/24": "100.64.0.9", "10.99.4.0/24": "100.64.0.4"},
+			Desired: []nodeRoute{
+				{Node: "b", CIDR: "10.99.2.0/24", Via: "100.64.0.2", Peer: "host-b", Online: true},
+				{Node: "c", CIDR: "10.99.3.0/24", Peer: "host-c", Skipped: "serving peer is offline"},
+			},
+			Missing: []string{"10.99.2.0/24"},
+			Stale:   []string{"10.99.4.0/24"},
+		},
+		Conflist:     json.RawMessage(`{"name":"tailscale-cni"}`),
+		Errors:       []string{"tailscale status: dial unix /var/run/tailscale/tailscaled.sock: connect: no such file or directory"},
+		conflistPath: "/etc/cni/net.d/10-tailscale-cni.conflist",
+	}
+	var b strings.Builder
+	writeStatusText(&b, r)
+	out := b.String()
+
+	for _, want := range []string{
+		"Pod CIDRs:  (none)\n",
+		"Routes (mode peer, table 52):\n",
+		"MISSING (installed via 100.64.0.9)",
+		"skipped: serving peer is offline",
+		"  stale: 10.99.4.0/24 via 100.64.0.4 (no Node wants it)\n",
+		"Conflist /etc/cni/net.d/10-tailscale-cni.conflist:\n  {\n    \"name\": \"tailscale-cni\"\n  }\n",
+		"\nErrors:\n  - tailscale status: dial unix /var/run/tailscale/tailscaled.sock: connect: no such file or directory\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Tailscale:", "nftables:"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output has a %q section for a failed or empty section:\n%s", unwanted, out)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/lstoll/tailscale-cni/internal/controller"
+	"github.com/lstoll/tailscale-cni/internal/masq"
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+)
+
+// tableState holds what the controller's watches put in the nftables table,
+// the egress SNAT rules and the NetworkPolicy, so every masq.Setup includes
+// them. Without -egress-snat and -network-policy it stays empty.
+type tableState struct {
+	// podCIDRs returns the pod CIDRs applied on this node, if any
+	// (Controller.AppliedPodCIDRs).
+	podCIDRs func() []string
+
+	mu     sync.Mutex
+	snat   []masq.SNAT
+	policy *netpol.Policy
+}
+
+func (s *tableState) get() ([]masq.SNAT, *netpol.Policy) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.snat), s.policy
+}
+
+// egressSNAT is a controller.EgressSNATReconciler: it records rules and
+// updates the nftables table with them.
+func (s *tableState) egressSNAT(opts func() runReconcileOpts) controller.EgressSNATReconciler {
+	return func(ctx context.Context, rules []controller.EgressSNAT) error {
+		snat := make([]masq.SNAT, 0, len(rules))
+		for _, r := range rules {
+			snat = append(snat, masq.SNAT{To: r.Addr, Sources: r.PodIPs})
+		}
+		s.mu.Lock()
+		s.snat = snat
+		s.mu.Unlock()
+		return s.apply(opts())
+	}
+}
+
+// networkPolicy is a controller.NetworkPolicyReconciler: it records policy
+// and updates the nftables table with it.
+func (s *tableState) networkPolicy(opts func() runReconcileOpts) controller.NetworkPolicyReconciler {
+	return func(ctx context.Context, policy *netpol.Policy) error {
+		s.mu.Lock()
+		s.policy = policy
+		s.mu.Unlock()
+		return s.apply(opts())
+	}
+}
+
+// apply updates the nftables table. Before the node's first reconcile
+// there's no table yet; that reconcile picks the state up.
+func (s *tableState) apply(o runReconcileOpts) error {
+	podCIDRs := s.podCIDRs()
+	if !o.nftables() || len(podCIDRs) == 0 {
+		return nil
+	}
+	return masq.Setup(o.masqConfig(podCIDRs))
+}
@@ -0,0 +1,147 @@
+// Package clusterconfig is the TailscaleCNIConfig custom resource: cluster-wide
+// settings that override each node's local config (flags and config file),
+// optionally per node selector, with per-node rollout state in its status.
+// See deploy/tailscale-cni-crd.yaml for the CustomResourceDefinition.
+package clusterconfig
+
+import (
+	"fmt"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// API group, version, kind and resource of TailscaleCNIConfig.
+const (
+	Group    = "tailscale-cni.lstoll.github.io"
+	Version  = "v1alpha1"
+	Kind     = "TailscaleCNIConfig"
+	Resource = "tailscalecniconfigs"
+)
+
+// GroupVersionResource is used with the dynamic client.
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// Rollout states of a node in Status.Nodes.
+const (
+	// StatePending: the node has seen this generation but not finished
+	// reconciling with it (e.g. it has no pod CIDR yet).
+	StatePending = "Pending"
+	// StateApplied: the node reconciled successfully with this generation.
+	StateApplied = "Applied"
+	// StateFailed: the settings are invalid for the node or reconciling
+	// with them failed; Message says why.
+	StateFailed = "Failed"
+)
+
+// TailscaleCNIConfig is cluster-scoped. Nodes only use the one named by
+// tailscale-cni's -cluster-config flag.
+type TailscaleCNIConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec holds the settings for every node, then overrides for nodes matching
+// a selector. Overrides apply in order, so later ones win.
+type Spec struct {
+	Settings  `json:",inline"`
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+// Settings override the node's local config. Unset (empty) fields keep the
+// local value.
+type Settings struct {
+	ClusterCIDRs       []string `json:"clusterCIDRs,omitempty"`
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs,omitempty"`
+	MTU                int      `json:"mtu,omitempty"`
+	RouteMode          string   `json:"routeMode,omitempty"`
+}
+
+// Override applies Settings to the nodes matching NodeSelector.
+type Override struct {
+	NodeSelector metav1.LabelSelector `json:"nodeSelector"`
+	Settings     `json:",inline"`
+}
+
+// Status reports each node's rollout state. Every node owns its own entry
+// (server-side apply, keyed by name).
+type Status struct {
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+}
+
+type NodeStatus struct {
+	Name               string      `json:"name"`
+	ObservedGeneration int64       `json:"observedGeneration"`
+	State              string      `json:"state"`
+	Message            string      `json:"message,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// FromUnstructured converts an object from the dynamic client or informer.
+func FromUnstructured(obj *unstructured.Unstructured) (*TailscaleCNIConfig, error) {
+	var c TailscaleCNIConfig
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &c); err != nil {
+		return nil, fmt.Errorf("decode %s %q: %w", Kind, obj.GetName(), err)
+	}
+	return &c, nil
+}
+
+// ForNode returns the settings for a node with nodeLabels: the spec's
+// settings with every matching override applied in order.
+func (s *Spec) ForNode(nodeLabels map[string]string) (Settings, error) {
+	out := s.Settings.clone()
+	for i, o := range s.Overrides {
+		sel, err := metav1.LabelSelectorAsSelector(&o.NodeSelector)
+		if err != nil {
+			return Settings{}, fmt.Errorf("spec.overrides[%d].nodeSelector: %w", i, err)
+		}
+		if sel.Matches(labels.Set(nodeLabels)) {
+			out.merge(o.Settings)
+		}
+	}
+	return out, nil
+}
+
+// merge sets the fields that are set in o.
+func (s *Settings) merge(o Settings) {
+	if len(o.ClusterCIDRs) > 0 {
+		s.ClusterCIDRs = slices.Clone(o.ClusterCIDRs)
+	}
+	if len(o.NonMasqueradeCIDRs) > 0 {
+		s.NonMasqueradeCIDRs = slices.Clone(o.NonMasqueradeCIDRs)
+	}
+	if o.MTU != 0 {
+		s.MTU = o.MTU
+	}
+	if o.RouteMode != "" {
+		s.RouteMode = o.RouteMode
+	}
+}
+
+func (s Settings) clone() Settings {
+	s.ClusterCIDRs = slices.Clone(s.ClusterCIDRs)
+	s.NonMasqueradeCIDRs = slices.Clone(s.NonMasqueradeCIDRs)
+	return s
+}
+
+// NodeStatusApply returns a server-side apply object for the status
+// subresource of the TailscaleCNIConfig called name that sets only st's entry.
+func NodeStatusApply(name string, st NodeStatus) (*unstructured.Unstructured, error) {
+	entry, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&st)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Group + "/" + Version,
+		"kind":       Kind,
+		"metadata":   map[string]interface{}{"name": name},
+		"status":     map[string]interface{}{"nodes": []interface{}{entry}},
+	}}, nil
+}
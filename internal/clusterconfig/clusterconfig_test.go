@@ -0,0 +1,72 @@
+package clusterconfig
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestForNode(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Group + "/" + Version,
+		"kind":       Kind,
+		"metadata":   map[string]interface{}{"name": "default", "generation": int64(3)},
+		"spec": map[string]interface{}{
+			"clusterCIDRs": []interface{}{"10.99.0.0/16"},
+			"mtu":          int64(1400),
+			"overrides": []interface{}{
+				map[string]interface{}{
+					"nodeSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"site": "dc1"}},
+					"mtu":          int64(1280),
+					"routeMode":    "peer",
+				},
+				map[string]interface{}{
+					"nodeSelector":       map[string]interface{}{"matchExpressions": []interface{}{map[string]interface{}{"key": "lan", "operator": "Exists"}}},
+					"nonMasqueradeCIDRs": []interface{}{"192.168.0.0/16"},
+					"routeMode":          "self",
+				},
+			},
+		},
+	}}
+	c, err := FromUnstructured(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Generation != 3 {
+		t.Errorf("generation = %d, want 3", c.Generation)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+		want   Settings
+	}{
+		{"no override", nil, Settings{ClusterCIDRs: []string{"10.99.0.0/16"}, MTU: 1400}},
+		{"one override", map[string]string{"site": "dc1"}, Settings{ClusterCIDRs: []string{"10.99.0.0/16"}, MTU: 1280, RouteMode: "peer"}},
+		{"later override wins", map[string]string{"site": "dc1", "lan": ""}, Settings{
+			ClusterCIDRs:       []string{"10.99.0.0/16"},
+			NonMasqueradeCIDRs: []string{"192.168.0.0/16"},
+			MTU:                1280,
+			RouteMode:          "self",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Spec.ForNode(tt.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	bad := Spec{Overrides: []Override{{NodeSelector: metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "x", Operator: "Sometimes"}},
+	}}}}
+	if _, err := bad.ForNode(nil); err == nil {
+		t.Error("expected an error for an invalid selector")
+	}
+}
@@ -6,41 +6,87 @@ package cni
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/netip"
 	"os"
 	"path/filepath"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
 )
 
+func logger() *slog.Logger { return logging.Component("cni") }
+
 // WriteConflist writes a CNI conflist (list format) so we can chain bridge + portmap.
 // dir is the host CNI config directory (e.g. /etc/cni/net.d).
-// bridgeName, subnet are used for the bridge and host-local IPAM.
-// If clusterCIDR is non-empty, we add a route for it so pods can reach other nodes' pods.
-func WriteConflist(dir, name, bridgeName, subnet, clusterCIDR string) error {
+// bridgeName, subnets are used for the bridge and host-local IPAM; pass one
+// subnet per address family (e.g. an IPv4 and an IPv6 range for dual-stack).
+// A non-zero mtu sets the MTU of the bridge and pod interfaces.
+// For each clusterCIDR whose family matches a subnet we add a route so pods
+// can reach other nodes' pods.
+func WriteConflist(dir, name, bridgeName string, mtu int, subnets, clusterCIDRs []string) error {
+	if len(subnets) == 0 {
+		return fmt.Errorf("no subnets")
+	}
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", dir, err)
 	}
 
-	gateway := gatewayFromSubnet(subnet)
-	routes := []map[string]string{{"dst": "0.0.0.0/0", "gw": gateway}}
-	if clusterCIDR != "" && clusterCIDR != "0.0.0.0/0" {
-		routes = append([]map[string]string{{"dst": clusterCIDR}}, routes...)
+	var (
+		ranges [][]map[string]string
+		routes []map[string]string
+		has4   bool
+		has6   bool
+	)
+	for _, subnet := range subnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return fmt.Errorf("parse subnet %q: %w", subnet, err)
+		}
+		defaultDst := "0.0.0.0/0"
+		if prefix.Addr().Is6() {
+			defaultDst = "::/0"
+			has6 = true
+		} else {
+			has4 = true
+		}
+		ranges = append(ranges, []map[string]string{{"subnet": prefix.Masked().String()}})
+		routes = append(routes, map[string]string{"dst": defaultDst, "gw": gatewayFromSubnet(subnet)})
+	}
+
+	var clusterRoutes []map[string]string
+	for _, cidr := range clusterCIDRs {
+		if cidr == "" || cidr == "0.0.0.0/0" || cidr == "::/0" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("parse cluster CIDR %q: %w", cidr, err)
+		}
+		if (prefix.Addr().Is4() && has4) || (prefix.Addr().Is6() && has6) {
+			clusterRoutes = append(clusterRoutes, map[string]string{"dst": cidr})
+		}
 	}
+	routes = append(clusterRoutes, routes...)
 
+	bridge := map[string]interface{}{
+		"type":      "bridge",
+		"bridge":    bridgeName,
+		"isGateway": true,
+		"ipMasq":    false, // we manage masq via nftables
+		"ipam": map[string]interface{}{
+			"type":   "host-local",
+			"ranges": ranges,
+			"routes": routes,
+		},
+	}
+	if mtu > 0 {
+		bridge["mtu"] = mtu
+	}
 	conflist := map[string]interface{}{
 		"cniVersion": "1.0.0",
 		"name":       name,
 		"plugins": []map[string]interface{}{
-			{
-				"type":      "bridge",
-				"bridge":    bridgeName,
-				"isGateway": true,
-				"ipMasq":    false, // we manage masq via nftables
-				"ipam": map[string]interface{}{
-					"type":   "host-local",
-					"subnet": subnet,
-					"routes": routes,
-				},
-			},
+			bridge,
 			{
 				"type": "portmap",
 				"capabilities": map[string]bool{
@@ -55,38 +101,64 @@ func WriteConflist(dir, name, bridgeName, subnet, clusterCIDR string) error {
 		return fmt.Errorf("marshal conflist: %w", err)
 	}
 
-	path := filepath.Join(dir, "10-tailscale-cni.conflist")
+	path := ConflistPath(dir)
 	if err := os.WriteFile(path, data, 0644); err != nil {
 		return fmt.Errorf("write %s: %w", path, err)
 	}
+	logger().Debug("wrote conflist", "path", path, logging.CIDRs(subnets), logging.Iface(bridgeName))
 	return nil
 }
 
-// gatewayFromSubnet returns the first usable IP in the subnet as gateway (e.g. 10.99.0.0/24 -> 10.99.0.1).
+// gatewayFromSubnet returns the first usable IP in the subnet as gateway
+// (e.g. 10.99.0.0/24 -> 10.99.0.1, fd00:99::/64 -> fd00:99::1).
+// Returns "" if subnet does not parse.
 func gatewayFromSubnet(subnet string) string {
 	prefix, err := netip.ParsePrefix(subnet)
 	if err != nil {
-		return "10.99.0.1"
+		return ""
+	}
+	// First address in subnet + 1
+	return prefix.Masked().Addr().Next().String()
+}
+
+// ConflistPath returns the path of our config file in dir.
+func ConflistPath(dir string) string {
+	return filepath.Join(dir, "10-tailscale-cni.conflist")
+}
+
+// ConfigsBefore returns the CNI config files in dir that sort before ours.
+// Container runtimes use the first config file in lexical order, so any of
+// them shadows our conflist.
+func ConfigsBefore(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
-	addr := prefix.Addr()
-	if !addr.Is4() {
-		return "10.99.0.1"
+	ours := filepath.Base(ConflistPath(dir))
+	var before []string
+	for _, e := range entries { // sorted by name
+		if e.Name() >= ours {
+			break
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".conf", ".conflist", ".json":
+			if !e.IsDir() {
+				before = append(before, e.Name())
+			}
+		}
 	}
-	// First address in subnet + 1 (e.g. 10.99.0.0/24 -> 10.99.0.1)
-	ip := prefix.Masked().Addr()
-	return netip.AddrFrom4([4]byte{
-		ip.AsSlice()[0],
-		ip.AsSlice()[1],
-		ip.AsSlice()[2],
-		ip.AsSlice()[3] + 1,
-	}).String()
+	return before, nil
 }
 
 // Remove removes our config file from dir.
 func Remove(dir string) error {
-	path := filepath.Join(dir, "10-tailscale-cni.conflist")
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+	path := ConflistPath(dir)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
+	logger().Info("removed conflist", "path", path)
 	return nil
 }
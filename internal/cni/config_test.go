@@ -3,13 +3,14 @@ package cni
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
 
 func TestWriteConflist(t *testing.T) {
 	dir := t.TempDir()
-	err := WriteConflist(dir, "testnet", "cni0", "10.99.0.0/24", "10.99.0.0/16")
+	err := WriteConflist(dir, "testnet", "cni0", 0, []string{"10.99.0.0/24"}, []string{"10.99.0.0/16"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,6 +34,62 @@ func TestWriteConflist(t *testing.T) {
 	if !strings.Contains(string(data), "portmap") {
 		t.Error("expected portmap plugin")
 	}
+	if strings.Contains(string(data), "mtu") {
+		t.Error("expected no mtu when unset")
+	}
+}
+
+func TestWriteConflistMTU(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteConflist(dir, "testnet", "cni0", 1280, []string{"10.99.0.0/24"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(ConflistPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"mtu": 1280`) {
+		t.Errorf("expected bridge mtu in conflist:\n%s", data)
+	}
+}
+
+func TestWriteConflistDualStack(t *testing.T) {
+	dir := t.TempDir()
+	err := WriteConflist(dir, "testnet", "cni0", 0,
+		[]string{"10.99.0.0/24", "fd00:99:0:1::/64"},
+		[]string{"10.99.0.0/16", "fd00:99::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "10-tailscale-cni.conflist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"10.99.0.0/24", "fd00:99:0:1::/64", // ranges
+		"10.99.0.0/16", "fd00:99::/48", // cluster routes
+		"0.0.0.0/0", "::/0", // default routes
+		"10.99.0.1", "fd00:99:0:1::1", // gateways
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in conflist", want)
+		}
+	}
+}
+
+func TestWriteConflistSkipsOtherFamilyClusterCIDR(t *testing.T) {
+	dir := t.TempDir()
+	err := WriteConflist(dir, "testnet", "cni0", 0, []string{"10.99.0.0/24"}, []string{"10.99.0.0/16", "fd00:99::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "10-tailscale-cni.conflist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "fd00:99::/48") {
+		t.Error("did not expect IPv6 cluster route for IPv4-only pod subnet")
+	}
 }
 
 func TestGatewayFromSubnet(t *testing.T) {
@@ -43,6 +100,8 @@ func TestGatewayFromSubnet(t *testing.T) {
 		{"10.99.0.0/24", "10.99.0.1"},
 		{"10.99.1.0/24", "10.99.1.1"},
 		{"10.99.0.0/16", "10.99.0.1"},
+		{"fd00:99:0:1::/64", "fd00:99:0:1::1"},
+		{"not-a-cidr", ""},
 	}
 	for _, tt := range tests {
 		got := gatewayFromSubnet(tt.subnet)
@@ -54,7 +113,7 @@ func TestGatewayFromSubnet(t *testing.T) {
 
 func TestRemove(t *testing.T) {
 	dir := t.TempDir()
-	_ = WriteConflist(dir, "x", "cni0", "10.1.0.0/24", "")
+	_ = WriteConflist(dir, "x", "cni0", 0, []string{"10.1.0.0/24"}, nil)
 	if err := Remove(dir); err != nil {
 		t.Fatal(err)
 	}
@@ -91,3 +150,34 @@ func TestCopyPlugins(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigsBefore(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"05-cilium.conflist", "10-flannel.conflist", "99-loopback.conf", "00-notes.txt", "10-tailscale-cni.conflist"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ConfigsBefore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"05-cilium.conflist", "10-flannel.conflist"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMissingPlugins(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bridge"), []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "portmap"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"host-local", "portmap", "loopback"}
+	if got := MissingPlugins(dir); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
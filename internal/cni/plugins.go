@@ -25,9 +25,23 @@ func CopyPlugins(sourceDir, destDir string) error {
 			return fmt.Errorf("copy %s: %w", name, err)
 		}
 	}
+	logger().Debug("copied plugins", "plugins", pluginNames, "dir", destDir)
 	return nil
 }
 
+// MissingPlugins returns the plugins CopyPlugins installs that are not
+// executable files in dir.
+func MissingPlugins(dir string) []string {
+	var missing []string
+	for _, name := range pluginNames {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
 // copyFile copies src to dst by streaming and sets mode. It overwrites dst if it exists.
 func copyFile(src, dst string, mode os.FileMode) error {
 	in, err := os.Open(src)
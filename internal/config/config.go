@@ -0,0 +1,338 @@
+// Package config is tailscale-cni's versioned configuration file. It covers
+// every component (CNI, routes, masq, Tailscale, controller) and is usually
+// mounted from a ConfigMap; flags override individual fields. Watch polls the
+// file so edits can be applied without restarting the DaemonSet.
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kjson "sigs.k8s.io/json"
+	"sigs.k8s.io/yaml"
+)
+
+// APIVersion and Kind identify a config file. Bump the version for changes
+// that aren't backwards compatible.
+const (
+	APIVersion = "tailscale-cni.lstoll.github.io/v1alpha1"
+	Kind       = "Config"
+)
+
+// Routing modes for other nodes' pod CIDRs (routes.mode).
+const (
+	RouteModeSelf = "self"
+	RouteModePeer = "peer"
+)
+
+// Config is the whole configuration. Fields missing from a file keep their
+// Default values.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// ClusterCIDRs are the cluster's pod CIDRs, at most one per address
+	// family. Used for the conflist, policy rules, route ownership and the
+	// allocator.
+	ClusterCIDRs []string `json:"clusterCIDRs"`
+	// MetricsAddr serves /metrics, /healthz and /readyz; empty disables. The
+	// default is loopback only, so they aren't exposed on tailscale0.
+	MetricsAddr string `json:"metricsAddr"`
+	// CleanupOnExit removes everything we set up on SIGTERM (for uninstall).
+	CleanupOnExit bool `json:"cleanupOnExit"`
+
+	CNI        CNIConfig        `json:"cni"`
+	Routes     RoutesConfig     `json:"routes"`
+	Masq       MasqConfig       `json:"masq"`
+	Tailscale  TailscaleConfig  `json:"tailscale"`
+	Controller ControllerConfig `json:"controller"`
+	Log        LogConfig        `json:"log"`
+}
+
+type CNIConfig struct {
+	// Dir is the host path the conflist is written to.
+	Dir string `json:"dir"`
+	// BinDir, if set, is the host plugin path PluginSource is copied to.
+	BinDir string `json:"binDir"`
+	// PluginSource is where the built-in plugins are in the container.
+	PluginSource string `json:"pluginSource"`
+	// Bridge is the name of the bridge pods are attached to.
+	Bridge string `json:"bridge"`
+	// MTU of the bridge and pod interfaces; 0 leaves the plugin default.
+	MTU int `json:"mtu"`
+}
+
+type RoutesConfig struct {
+	// Mode is RouteModeSelf or RouteModePeer.
+	Mode string `json:"mode"`
+	// Table is the routing table for other nodes' pod CIDRs; 0 is main.
+	Table int `json:"table"`
+	// RulePriority is the priority of the policy rules for Table.
+	RulePriority int `json:"rulePriority"`
+}
+
+type MasqConfig struct {
+	// Enabled masquerades traffic from pods leaving the node other than via
+	// the bridge or Tailscale. Disable it if something else does SNAT.
+	Enabled bool `json:"enabled"`
+	// NonMasqueradeCIDRs are destinations that see pod IPs even when
+	// reached via another interface, e.g. an on-prem LAN or VPC peers.
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs"`
+	// ClampMSS lowers the MSS of TCP connections between pods and Tailscale
+	// so segments fit in its MTU without path MTU discovery. Unlike the
+	// fields above it doesn't need Enabled.
+	ClampMSS bool `json:"clampMSS"`
+	// MSS is what ClampMSS clamps to; 0 derives it from the MTU of
+	// Tailscale's interface.
+	MSS int `json:"mss"`
+}
+
+type TailscaleConfig struct {
+	// Socket is tailscaled's LocalAPI socket; empty is the platform default.
+	Socket string `json:"socket"`
+	// Interface is the Tailscale interface name.
+	Interface string `json:"interface"`
+	// ApprovalRecheck is how often route approval (and with it, whether
+	// tailscaled is reachable) is re-checked.
+	ApprovalRecheck metav1.Duration `json:"approvalRecheck"`
+}
+
+type ControllerConfig struct {
+	// ResyncPeriod is the Node informer's resync period.
+	ResyncPeriod metav1.Duration `json:"resyncPeriod"`
+	// AllocateNodeCIDRs assigns pod CIDRs to Nodes that have none.
+	AllocateNodeCIDRs bool `json:"allocateNodeCIDRs"`
+	// NodeCIDRMaskSize and NodeCIDRMaskSizeIPv6 are the prefix lengths of
+	// the pod CIDRs assigned.
+	NodeCIDRMaskSize     int `json:"nodeCIDRMaskSize"`
+	NodeCIDRMaskSizeIPv6 int `json:"nodeCIDRMaskSizeIPv6"`
+	// AllocatorConfigMap records assignments, in the pod's namespace.
+	AllocatorConfigMap string `json:"allocatorConfigMap"`
+	// ClusterConfig names the TailscaleCNIConfig whose settings override
+	// this config; empty disables watching it.
+	ClusterConfig string `json:"clusterConfig"`
+	// EgressSNAT watches Namespaces and this node's Pods to apply the
+	// egress SNAT annotation (controller.EgressSNATAnnotation).
+	EgressSNAT bool `json:"egressSNAT"`
+	// NetworkPolicy watches NetworkPolicies, Namespaces and Pods to enforce
+	// NetworkPolicy for this node's pods in the nftables table.
+	NetworkPolicy bool `json:"networkPolicy"`
+}
+
+type LogConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is logging.FormatText or logging.FormatJSON.
+	Format string `json:"format"`
+}
+
+// Default returns the configuration used when there is no file and no flags.
+func Default() *Config {
+	return &Config{
+		APIVersion:   APIVersion,
+		Kind:         Kind,
+		ClusterCIDRs: []string{"10.99.0.0/16"},
+		MetricsAddr:  "127.0.0.1:9850",
+		CNI: CNIConfig{
+			Dir:          "/etc/cni/net.d",
+			PluginSource: "/cni",
+			Bridge:       "cni0",
+		},
+		Routes: RoutesConfig{
+			Mode:         RouteModeSelf,
+			RulePriority: 5200,
+		},
+		Masq: MasqConfig{Enabled: true, ClampMSS: true},
+		Tailscale: TailscaleConfig{
+			Interface:       "tailscale0",
+			ApprovalRecheck: metav1.Duration{Duration: time.Minute},
+		},
+		Controller: ControllerConfig{
+			ResyncPeriod:         metav1.Duration{Duration: 30 * time.Minute},
+			NodeCIDRMaskSize:     24,
+			NodeCIDRMaskSizeIPv6: 64,
+			AllocatorConfigMap:   "tailscale-cni-allocations",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logging.FormatText,
+		},
+	}
+}
+
+// Parse decodes a YAML or JSON config file onto c, so fields the file leaves
+// out keep their current values. Field names are case-sensitive; unknown and
+// duplicate fields are errors naming the field (e.g. `unknown field
+// "routes.mdoe"`). On error c may be partly updated.
+func (c *Config) Parse(data []byte) error {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	strictErrs, err := kjson.UnmarshalStrict(data, c)
+	if err != nil {
+		return err
+	}
+	return errors.Join(strictErrs...)
+}
+
+// Validate reports every invalid field, each with its path in the file
+// (e.g. `routes.mode: Unsupported value: ...`).
+func (c *Config) Validate() error {
+	var errs field.ErrorList
+	if c.APIVersion != APIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{APIVersion}))
+	}
+	if c.Kind != Kind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{Kind}))
+	}
+
+	cidrsPath := field.NewPath("clusterCIDRs")
+	if len(c.ClusterCIDRs) == 0 {
+		errs = append(errs, field.Required(cidrsPath, "at least one cluster CIDR"))
+	}
+	var has4, has6 bool
+	for i, cidr := range c.ClusterCIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(cidrsPath.Index(i), cidr, err.Error()))
+		case p.Addr().Is4() && has4, p.Addr().Is6() && has6:
+			errs = append(errs, field.Invalid(cidrsPath.Index(i), cidr, "at most one CIDR per address family"))
+		default:
+			has4, has6 = has4 || p.Addr().Is4(), has6 || p.Addr().Is6()
+		}
+	}
+
+	cniPath := field.NewPath("cni")
+	if c.CNI.Dir == "" {
+		errs = append(errs, field.Required(cniPath.Child("dir"), ""))
+	}
+	if c.CNI.BinDir != "" && c.CNI.PluginSource == "" {
+		errs = append(errs, field.Required(cniPath.Child("pluginSource"), "needed to copy plugins to binDir"))
+	}
+	if c.CNI.Bridge == "" {
+		errs = append(errs, field.Required(cniPath.Child("bridge"), ""))
+	} else if len(c.CNI.Bridge) > 15 {
+		errs = append(errs, field.TooLong(cniPath.Child("bridge"), c.CNI.Bridge, 15))
+	}
+
+	if c.CNI.MTU != 0 && (c.CNI.MTU < 576 || c.CNI.MTU > 65535) {
+		errs = append(errs, field.Invalid(cniPath.Child("mtu"), c.CNI.MTU, "must be 0 (plugin default) or between 576 and 65535"))
+	}
+
+	routesPath := field.NewPath("routes")
+	if c.Routes.Mode != RouteModeSelf && c.Routes.Mode != RouteModePeer {
+		errs = append(errs, field.NotSupported(routesPath.Child("mode"), c.Routes.Mode, []string{RouteModeSelf, RouteModePeer}))
+	}
+	if c.Routes.Table < 0 {
+		errs = append(errs, field.Invalid(routesPath.Child("table"), c.Routes.Table, "must not be negative"))
+	}
+	if c.Routes.RulePriority < 1 || c.Routes.RulePriority > 32765 {
+		errs = append(errs, field.Invalid(routesPath.Child("rulePriority"), c.Routes.RulePriority, "must be between 1 and 32765"))
+	}
+
+	nonMasqPath := field.NewPath("masq", "nonMasqueradeCIDRs")
+	for i, cidr := range c.Masq.NonMasqueradeCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, field.Invalid(nonMasqPath.Index(i), cidr, err.Error()))
+		}
+	}
+	if c.Masq.MSS != 0 && (c.Masq.MSS < 536 || c.Masq.MSS > 65495) {
+		errs = append(errs, field.Invalid(field.NewPath("masq", "mss"), c.Masq.MSS, "must be 0 (from the Tailscale MTU) or between 536 and 65495"))
+	}
+
+	tsPath := field.NewPath("tailscale")
+	if c.Tailscale.Interface == "" {
+		errs = append(errs, field.Required(tsPath.Child("interface"), ""))
+	}
+	if c.Tailscale.ApprovalRecheck.Duration <= 0 {
+		errs = append(errs, field.Invalid(tsPath.Child("approvalRecheck"), c.Tailscale.ApprovalRecheck.Duration.String(), "must be positive"))
+	}
+
+	ctrlPath := field.NewPath("controller")
+	if c.Controller.ResyncPeriod.Duration < 0 {
+		errs = append(errs, field.Invalid(ctrlPath.Child("resyncPeriod"), c.Controller.ResyncPeriod.Duration.String(), "must not be negative"))
+	}
+	if m := c.Controller.NodeCIDRMaskSize; m < 1 || m > 32 {
+		errs = append(errs, field.Invalid(ctrlPath.Child("nodeCIDRMaskSize"), m, "must be between 1 and 32"))
+	}
+	if m := c.Controller.NodeCIDRMaskSizeIPv6; m < 1 || m > 128 {
+		errs = append(errs, field.Invalid(ctrlPath.Child("nodeCIDRMaskSizeIPv6"), m, "must be between 1 and 128"))
+	}
+	if c.Controller.AllocateNodeCIDRs && c.Controller.AllocatorConfigMap == "" {
+		errs = append(errs, field.Required(ctrlPath.Child("allocatorConfigMap"), "needed by allocateNodeCIDRs"))
+	}
+
+	logPath := field.NewPath("log")
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, field.NotSupported(logPath.Child("level"), c.Log.Level, []string{"debug", "info", "warn", "error"}))
+	}
+	if c.Log.Format != logging.FormatText && c.Log.Format != logging.FormatJSON {
+		errs = append(errs, field.NotSupported(logPath.Child("format"), c.Log.Format, []string{logging.FormatText, logging.FormatJSON}))
+	}
+	return errs.ToAggregate()
+}
+
+// Diff returns the paths of the fields (e.g. "routes.mode") whose values
+// differ between a and b.
+func Diff(a, b *Config) []string {
+	return diffStruct(reflect.ValueOf(*a), reflect.ValueOf(*b), "")
+}
+
+func diffStruct(a, b reflect.Value, prefix string) []string {
+	var out []string
+	for i := range a.NumField() {
+		f := a.Type().Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		path := prefix + name
+		// Recurse into our own sections; anything else (e.g. metav1.Duration)
+		// is a single value.
+		if f.Type.Kind() == reflect.Struct && f.Type.PkgPath() == a.Type().PkgPath() {
+			out = append(out, diffStruct(a.Field(i), b.Field(i), path+".")...)
+		} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+// Watch polls path every interval and calls onChange with the new contents
+// whenever they change (ConfigMap volumes are updated by swapping a symlink,
+// which inotify on the file doesn't see). It blocks until ctx is done.
+// Read errors are logged and retried; it's up to onChange to load and
+// validate the data.
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func(data []byte)) {
+	log := logging.Component("config").With("path", path)
+	last, err := os.ReadFile(path)
+	if err != nil {
+		log.Warn("failed to read config file", logging.Err(err))
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Warn("failed to read config file", logging.Err(err))
+			continue
+		}
+		if !bytes.Equal(data, last) {
+			last = data
+			onChange(data)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c := Default()
+	err := c.Parse([]byte(`
+apiVersion: tailscale-cni.lstoll.github.io/v1alpha1
+kind: Config
+clusterCIDRs: ["10.42.0.0/16", "fd00:42::/48"]
+routes:
+  mode: peer
+tailscale:
+  approvalRecheck: 5m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.42.0.0/16", "fd00:42::/48"}; !slices.Equal(c.ClusterCIDRs, want) {
+		t.Errorf("clusterCIDRs = %v, want %v", c.ClusterCIDRs, want)
+	}
+	if c.Routes.Mode != RouteModePeer {
+		t.Errorf("routes.mode = %q, want peer", c.Routes.Mode)
+	}
+	if c.Tailscale.ApprovalRecheck.Duration != 5*time.Minute {
+		t.Errorf("tailscale.approvalRecheck = %s, want 5m", c.Tailscale.ApprovalRecheck.Duration)
+	}
+	// Fields the file leaves out keep their defaults.
+	if c.Routes.RulePriority != 5200 || c.CNI.Bridge != "cni0" || !c.Masq.Enabled {
+		t.Errorf("defaults not kept: %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	if err := Default().Parse([]byte("routes:\n  mdoe: peer\n")); err == nil || !strings.Contains(err.Error(), `unknown field "routes.mdoe"`) {
+		t.Errorf("unknown field: got %v", err)
+	}
+	if err := Default().Parse(nil); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.ClusterCIDRs = []string{"10.42.0.0/16", "10.43.0.0/16", "nope"}
+	c.Routes.Mode = "both"
+	c.CNI.Bridge = "a-very-long-bridge-name"
+	c.Controller.NodeCIDRMaskSize = 40
+	c.Masq.MSS = 100
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"clusterCIDRs[1]", "clusterCIDRs[2]", "routes.mode", "cni.bridge", "masq.mss", "controller.nodeCIDRMaskSize"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, b := Default(), Default()
+	if d := Diff(a, b); len(d) != 0 {
+		t.Errorf("Diff of defaults = %v", d)
+	}
+	b.ClusterCIDRs = []string{"10.42.0.0/16"}
+	b.Routes.Table = 100
+	b.Controller.ResyncPeriod.Duration = time.Hour
+	want := []string{"clusterCIDRs", "routes.table", "controller.resyncPeriod"}
+	if d := Diff(a, b); !slices.Equal(d, want) {
+		t.Errorf("Diff = %v, want %v", d, want)
+	}
+}
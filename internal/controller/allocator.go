@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// AllocatorConfig configures the built-in pod CIDR allocator, for clusters
+// (e.g. K3s without flannel) that leave spec.podCIDR empty.
+type AllocatorConfig struct {
+	// ClusterCIDRs are carved into per-node subnets; at most one per address family.
+	ClusterCIDRs []string
+	// MaskSizeIPv4 and MaskSizeIPv6 are the prefix lengths of per-node subnets.
+	MaskSizeIPv4 int
+	MaskSizeIPv6 int
+	// Namespace and ConfigMapName locate the ConfigMap holding assignments.
+	Namespace     string
+	ConfigMapName string
+}
+
+// allocator assigns pod CIDRs to nodes. Assignments are persisted in a
+// ConfigMap (node name -> comma-separated CIDRs) before the Node is patched, so
+// a subnet is never handed out twice even if the patch fails. Every DaemonSet
+// replica runs an allocator for its own node; updates to the ConfigMap carry
+// its resourceVersion, so the API server rejects concurrent writers and the
+// loser retries against the fresh assignments.
+type allocator struct {
+	clientset kubernetes.Interface
+	cfg       AllocatorConfig
+	clusters  []netip.Prefix
+}
+
+func newAllocator(clientset kubernetes.Interface, cfg AllocatorConfig) (*allocator, error) {
+	if len(cfg.ClusterCIDRs) == 0 {
+		return nil, fmt.Errorf("allocator: no cluster CIDRs")
+	}
+	a := &allocator{clientset: clientset, cfg: cfg}
+	seen4, seen6 := false, false
+	for _, cidr := range cfg.ClusterCIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("allocator: cluster CIDR %q: %w", cidr, err)
+		}
+		mask := cfg.MaskSizeIPv4
+		if p.Addr().Is6() {
+			if seen6 {
+				return nil, fmt.Errorf("allocator: more than one IPv6 cluster CIDR")
+			}
+			seen6 = true
+			mask = cfg.MaskSizeIPv6
+		} else {
+			if seen4 {
+				return nil, fmt.Errorf("allocator: more than one IPv4 cluster CIDR")
+			}
+			seen4 = true
+		}
+		if mask < p.Bits() || mask > p.Addr().BitLen() {
+			return nil, fmt.Errorf("allocator: mask size /%d does not fit in cluster CIDR %s", mask, p)
+		}
+		a.clusters = append(a.clusters, p.Masked())
+	}
+	return a, nil
+}
+
+func (a *allocator) maskSize(p netip.Prefix) int {
+	if p.Addr().Is6() {
+		return a.cfg.MaskSizeIPv6
+	}
+	return a.cfg.MaskSizeIPv4
+}
+
+// ensure makes sure node has pod CIDRs, allocating and patching them if
+// spec.podCIDR is empty. nodes are all known nodes; their existing pod CIDRs
+// are treated as taken so we never collide with manually assigned subnets.
+func (a *allocator) ensure(ctx context.Context, node *corev1.Node, nodes []*corev1.Node) error {
+	if len(NodePodCIDRs(node)) > 0 {
+		return nil
+	}
+
+	var cidrs []string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.getOrCreateConfigMap(ctx)
+		if err != nil {
+			return err
+		}
+		if existing := cm.Data[node.Name]; existing != "" {
+			cidrs = strings.Split(existing, ",")
+			return nil
+		}
+
+		used := usedPrefixes(cm.Data, nodes)
+		cidrs = nil
+		for _, cluster := range a.clusters {
+			p, err := nextFreeSubnet(cluster, a.maskSize(cluster), used)
+			if err != nil {
+				return err
+			}
+			used = append(used, p)
+			cidrs = append(cidrs, p.String())
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[node.Name] = strings.Join(cidrs, ",")
+		_, err = a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("allocate pod CIDR for node %q: %w", node.Name, err)
+	}
+
+	logger().Info("assigning pod CIDRs", logging.Node(node.Name), logging.CIDRs(cidrs))
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"podCIDR":  cidrs[0],
+			"podCIDRs": cidrs,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := a.clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("patch node %q pod CIDRs: %w", node.Name, err)
+	}
+	return nil
+}
+
+// assigned returns the pod CIDRs the ConfigMap records for nodeName, if any.
+func (a *allocator) assigned(ctx context.Context, nodeName string) ([]string, error) {
+	cm, err := a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace).Get(ctx, a.cfg.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v := cm.Data[nodeName]; v != "" {
+		return strings.Split(v, ","), nil
+	}
+	return nil, nil
+}
+
+// release frees the subnets assigned to nodeName once the node no longer
+// exists. The node is looked up live (not from the informer cache) so a
+// replica with a stale cache can't reclaim a newly joined node's subnet.
+func (a *allocator) release(ctx context.Context, nodeName string) error {
+	_, err := a.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("get node %q: %w", nodeName, err)
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace).Get(ctx, a.cfg.ConfigMapName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cidrs, ok := cm.Data[nodeName]
+		if !ok {
+			return nil
+		}
+		delete(cm.Data, nodeName)
+		if _, err := a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		logger().Info("released pod CIDRs of deleted node", logging.Node(nodeName), logging.CIDRs(strings.Split(cidrs, ",")))
+		return nil
+	})
+}
+
+// sweep releases assignments for nodes that are not in nodes, e.g. nodes
+// deleted while no replica was running.
+func (a *allocator) sweep(ctx context.Context, nodes []*corev1.Node) error {
+	cm, err := a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace).Get(ctx, a.cfg.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		known[n.Name] = true
+	}
+	var names []string
+	for name := range cm.Data {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := a.release(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *allocator) getOrCreateConfigMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	cms := a.clientset.CoreV1().ConfigMaps(a.cfg.Namespace)
+	cm, err := cms.Get(ctx, a.cfg.ConfigMapName, metav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	cm, err = cms.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: a.cfg.ConfigMapName, Namespace: a.cfg.Namespace},
+	}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// Another replica created it first; retry the read-modify-write.
+		return nil, apierrors.NewConflict(corev1.Resource("configmaps"), a.cfg.ConfigMapName, err)
+	}
+	return cm, err
+}
+
+// usedPrefixes returns every prefix recorded in the assignments ConfigMap or
+// already set on a node.
+func usedPrefixes(assignments map[string]string, nodes []*corev1.Node) []netip.Prefix {
+	var used []netip.Prefix
+	add := func(cidr string) {
+		if p, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err == nil {
+			used = append(used, p.Masked())
+		}
+	}
+	for _, v := range assignments {
+		for _, cidr := range strings.Split(v, ",") {
+			add(cidr)
+		}
+	}
+	for _, n := range nodes {
+		for _, cidr := range NodePodCIDRs(n) {
+			add(cidr)
+		}
+	}
+	return used
+}
+
+// nextFreeSubnet returns the lowest subnet of length maskSize inside cluster
+// that does not overlap any prefix in used.
+func nextFreeSubnet(cluster netip.Prefix, maskSize int, used []netip.Prefix) (netip.Prefix, error) {
+	cluster = cluster.Masked()
+	if maskSize < cluster.Bits() || maskSize > cluster.Addr().BitLen() {
+		return netip.Prefix{}, fmt.Errorf("mask size /%d does not fit in %s", maskSize, cluster)
+	}
+	candidate := netip.PrefixFrom(cluster.Addr(), maskSize)
+	for cluster.Contains(candidate.Addr()) {
+		var overlap netip.Prefix
+		for _, u := range used {
+			if u.Overlaps(candidate) {
+				overlap = u
+				break
+			}
+		}
+		if !overlap.IsValid() {
+			return candidate, nil
+		}
+		// Skip past whichever of the two is larger; both are aligned, so
+		// the next address starts a fresh candidate subnet.
+		skip := candidate
+		if overlap.Bits() < candidate.Bits() {
+			skip = overlap
+		}
+		next := lastAddr(skip).Next()
+		if !next.IsValid() {
+			break
+		}
+		candidate = netip.PrefixFrom(next, maskSize)
+	}
+	return netip.Prefix{}, fmt.Errorf("no free /%d subnet left in %s", maskSize, cluster)
+}
+
+// lastAddr returns the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
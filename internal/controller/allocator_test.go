@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNextFreeSubnet(t *testing.T) {
+	mp := netip.MustParsePrefix
+	tests := []struct {
+		name    string
+		cluster string
+		mask    int
+		used    []netip.Prefix
+		want    string
+		wantErr bool
+	}{
+		{"empty", "10.99.0.0/16", 24, nil, "10.99.0.0/24", false},
+		{"skip used", "10.99.0.0/16", 24, []netip.Prefix{mp("10.99.0.0/24"), mp("10.99.1.0/24")}, "10.99.2.0/24", false},
+		{"fill hole", "10.99.0.0/16", 24, []netip.Prefix{mp("10.99.0.0/24"), mp("10.99.2.0/24")}, "10.99.1.0/24", false},
+		{"skip larger", "10.99.0.0/16", 24, []netip.Prefix{mp("10.99.0.0/20")}, "10.99.16.0/24", false},
+		{"skip smaller", "10.99.0.0/16", 24, []netip.Prefix{mp("10.99.0.128/25")}, "10.99.1.0/24", false},
+		{"unaligned cluster", "10.99.3.7/16", 24, nil, "10.99.0.0/24", false},
+		{"exhausted", "10.99.0.0/23", 24, []netip.Prefix{mp("10.99.0.0/24"), mp("10.99.1.0/24")}, "", true},
+		{"mask too small", "10.99.0.0/16", 8, nil, "", true},
+		{"ipv6", "fd00:99::/48", 64, []netip.Prefix{mp("fd00:99::/64")}, "fd00:99:0:1::/64", false},
+		{"end of space", "255.255.255.0/24", 25, []netip.Prefix{mp("255.255.255.0/25"), mp("255.255.255.128/25")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextFreeSubnet(mp(tt.cluster), tt.mask, tt.used)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocatorEnsureAndRelease(t *testing.T) {
+	ctx := context.Background()
+	nodeA := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a"}}
+	nodeB := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "b"}}
+	manual := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "manual"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.0.0/24", PodCIDRs: []string{"10.99.0.0/24"}},
+	}
+	clientset := fake.NewSimpleClientset(nodeA, nodeB, manual)
+	a, err := newAllocator(clientset, AllocatorConfig{
+		ClusterCIDRs:  []string{"10.99.0.0/16", "fd00:99::/48"},
+		MaskSizeIPv4:  24,
+		MaskSizeIPv6:  64,
+		Namespace:     "kube-system",
+		ConfigMapName: "allocations",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*corev1.Node{nodeA, nodeB, manual}
+
+	if err := a.ensure(ctx, nodeA, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ensure(ctx, nodeB, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	gotA := getPodCIDRs(t, clientset, "a")
+	gotB := getPodCIDRs(t, clientset, "b")
+	if want := []string{"10.99.1.0/24", "fd00:99::/64"}; !slices.Equal(gotA, want) {
+		t.Errorf("node a: got %v, want %v", gotA, want)
+	}
+	if want := []string{"10.99.2.0/24", "fd00:99:0:1::/64"}; !slices.Equal(gotB, want) {
+		t.Errorf("node b: got %v, want %v", gotB, want)
+	}
+
+	// Deleting node a frees its subnets for the next node.
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// Release of a node that still exists is a no-op.
+	if err := a.release(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	nodeC := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "c"}}
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, nodeC, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := clientset.CoreV1().Nodes().Get(ctx, "b", metav1.GetOptions{})
+	if err := a.ensure(ctx, nodeC, []*corev1.Node{b, manual, nodeC}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getPodCIDRs(t, clientset, "c"), []string{"10.99.1.0/24", "fd00:99::/64"}; !slices.Equal(got, want) {
+		t.Errorf("node c: got %v, want %v", got, want)
+	}
+}
+
+func TestAllocatorSweep(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "live"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "allocations", Namespace: "kube-system"},
+			Data:       map[string]string{"live": "10.99.0.0/24", "gone": "10.99.1.0/24"},
+		},
+	)
+	a, err := newAllocator(clientset, AllocatorConfig{
+		ClusterCIDRs:  []string{"10.99.0.0/16"},
+		MaskSizeIPv4:  24,
+		Namespace:     "kube-system",
+		ConfigMapName: "allocations",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty node list must not reclaim "live": it still exists in the API.
+	if err := a.sweep(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "allocations", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["gone"]; ok {
+		t.Error("expected assignment of deleted node to be released")
+	}
+	if _, ok := cm.Data["live"]; !ok {
+		t.Error("expected assignment of existing node to be kept")
+	}
+}
+
+func getPodCIDRs(t *testing.T, clientset *fake.Clientset, name string) []string {
+	t.Helper()
+	n, err := clientset.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Spec.PodCIDRs) > 0 && n.Spec.PodCIDR != n.Spec.PodCIDRs[0] {
+		t.Errorf("node %s: podCIDR %q != podCIDRs[0] %q", name, n.Spec.PodCIDR, n.Spec.PodCIDRs[0])
+	}
+	return n.Spec.PodCIDRs
+}
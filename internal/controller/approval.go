@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RouteApprovalChecker reports which of podCIDRs are advertised via Tailscale
+// but not approved in the tailnet.
+type RouteApprovalChecker func(ctx context.Context, podCIDRs []string) (unapproved []string, err error)
+
+// WithRouteApprovalChecker enables reporting of unapproved routes. After each
+// successful reconcile the checker runs; while any pod CIDR is unapproved the
+// TailscaleRoutesApproved Node condition is False and a Warning event is
+// recorded. The check is repeated every recheck, so both that condition and
+// NetworkUnavailable follow approvals being granted or revoked and tailscaled
+// becoming unreachable without waiting for a reconcile.
+func WithRouteApprovalChecker(fn RouteApprovalChecker, recheck time.Duration) Option {
+	return func(c *Controller) {
+		c.approvalCheck = fn
+		c.approvalRecheck = recheck
+	}
+}
+
+// checkRouteApproval runs the approval checker against the pod CIDRs we last
+// applied and publishes the result as a Node condition, event and metric.
+func (c *Controller) checkRouteApproval(ctx context.Context) error {
+	if c.approvalCheck == nil {
+		return nil
+	}
+	cidrs := c.AppliedPodCIDRs()
+	if len(cidrs) == 0 {
+		return nil
+	}
+	unapproved, err := c.approvalCheck(ctx, cidrs)
+	if err != nil {
+		c.mu.Lock()
+		c.approvalErr = err
+		c.mu.Unlock()
+		c.queue.Add(networkKey)
+		return fmt.Errorf("check route approval: %w", err)
+	}
+	metrics.AdvertisedRoutes.Set(float64(len(cidrs)))
+	metrics.ApprovedRoutes.Set(float64(len(cidrs) - len(unapproved)))
+	metrics.UnapprovedRoutes.Set(float64(len(unapproved)))
+
+	c.mu.Lock()
+	prev, known := c.unapproved, c.approvalKnown
+	c.unapproved, c.approvalKnown, c.approvalErr = unapproved, true, nil
+	c.mu.Unlock()
+	c.queue.Add(networkKey)
+
+	cond := corev1.NodeCondition{Type: ConditionRoutesApproved}
+	if len(unapproved) == 0 {
+		cond.Status = corev1.ConditionTrue
+		cond.Reason = ReasonRoutesApproved
+		cond.Message = fmt.Sprintf("Pod CIDRs %s are approved in the tailnet", strings.Join(cidrs, ", "))
+		if known && len(prev) > 0 {
+			c.eventf(corev1.EventTypeNormal, ReasonRoutesApproved, "Pod CIDRs %s are now approved in the tailnet", strings.Join(prev, ", "))
+		}
+	} else {
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = ReasonRoutesNotApproved
+		cond.Message = fmt.Sprintf("Pod CIDRs %s are advertised but not approved; approve them in the Tailscale admin console or with autoApprovers", strings.Join(unapproved, ", "))
+		if !known || !slices.Equal(prev, unapproved) {
+			c.eventf(corev1.EventTypeWarning, ReasonRoutesNotApproved, "%s", cond.Message)
+		}
+	}
+	c.queue.AddAfter(approvalKey, c.approvalRecheck)
+	return c.setNodeCondition(ctx, cond)
+}
+
+// RecheckNetwork queues a route approval check, which also updates
+// NetworkUnavailable. Use it when tailscaled may have become unreachable,
+// e.g. the IPN bus watch dropped, so the condition doesn't wait for the next
+// reconcile or recheck to say so.
+func (c *Controller) RecheckNetwork() {
+	c.queue.Add(approvalKey)
+	c.queue.Add(networkKey)
+}
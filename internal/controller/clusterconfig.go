@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/clusterconfig"
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Event reasons for the TailscaleCNIConfig.
+const (
+	ReasonClusterConfigApplied = "ClusterConfigApplied"
+	ReasonClusterConfigInvalid = "ClusterConfigInvalid"
+)
+
+// clusterConfigSyncTimeout bounds the wait for the TailscaleCNIConfig cache at
+// startup. If the CRD isn't installed the informer never syncs; we carry on
+// with the local config rather than leave the node without networking.
+const clusterConfigSyncTimeout = 15 * time.Second
+
+// ClusterConfigApplier applies the TailscaleCNIConfig settings for this node
+// (nil when there is no TailscaleCNIConfig) on top of the local config. It
+// reports whether anything the reconcilers use changed, in which case the node
+// is reconciled again just as for a pod CIDR change, and returns an error if
+// the settings are invalid, leaving the running config alone.
+type ClusterConfigApplier func(settings *clusterconfig.Settings) (changed bool, err error)
+
+// WithClusterConfig watches the cluster-scoped TailscaleCNIConfig called name
+// and applies its settings for this node (spec plus the overrides whose node
+// selector matches our labels) with apply. This node's rollout state is
+// reported in the resource's status.
+func WithClusterConfig(name string, apply ClusterConfigApplier) Option {
+	return func(c *Controller) {
+		c.clusterConfig = &clusterConfigWatch{name: name, apply: apply}
+	}
+}
+
+type clusterConfigWatch struct {
+	name   string
+	apply  ClusterConfigApplier
+	client dynamic.Interface
+	store  cache.Store // set in Run
+	synced cache.InformerSynced
+}
+
+// clusterConfigState is our view of the TailscaleCNIConfig rollout, guarded by
+// Controller.mu.
+type clusterConfigState struct {
+	settings    *clusterconfig.Settings // last applied; nil if none
+	generation  int64                   // generation last seen
+	err         error                   // settings invalid for this node
+	appliedGen  int64                   // generation in effect at the last successful reconcile
+	reported    *clusterconfig.NodeStatus
+	initialized bool
+}
+
+// startClusterConfigInformer starts the TailscaleCNIConfig informer and waits
+// (up to clusterConfigSyncTimeout) for its cache to sync.
+func (c *Controller) startClusterConfigInformer(ctx context.Context) {
+	w := c.clusterConfig
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.client, c.resyncPeriod, "", func(o *metav1.ListOptions) {
+		o.FieldSelector = "metadata.name=" + w.name
+	})
+	informer := factory.ForResource(clusterconfig.GroupVersionResource).Informer()
+	w.store, w.synced = informer.GetStore(), informer.HasSynced
+	enqueue := func() { c.queue.Add(clusterConfigKey) }
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { enqueue() },
+		UpdateFunc: func(_, _ interface{}) { enqueue() },
+		DeleteFunc: func(interface{}) { enqueue() },
+	}); err != nil {
+		c.log.Error("failed to add event handler", "kind", clusterconfig.Kind, logging.Err(err))
+		return
+	}
+	factory.Start(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, clusterConfigSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		c.log.Warn("cluster config not synced (is the CRD installed?); using local config until it is", "kind", clusterconfig.Kind, "name", w.name, "timeout", clusterConfigSyncTimeout)
+	}
+}
+
+// syncClusterConfig applies the TailscaleCNIConfig settings for this node and
+// queues a reconcile if they changed. Invalid settings are reported in the
+// status and as an event rather than retried; a fixed resource brings us back.
+func (c *Controller) syncClusterConfig(ctx context.Context) error {
+	w := c.clusterConfig
+	if !w.synced() {
+		return nil
+	}
+	var nodeLabels map[string]string
+	if obj, exists, _ := c.store.GetByKey(c.nodeName); exists {
+		if n, ok := obj.(*corev1.Node); ok {
+			nodeLabels = n.Labels
+		}
+	}
+
+	c.mu.Lock()
+	settings, prevErr, initialized := c.cluster.settings, c.cluster.err, c.cluster.initialized
+	c.mu.Unlock()
+
+	var generation int64
+	var cfgErr error
+	obj, exists, err := w.store.GetByKey(w.name)
+	if err != nil {
+		return err
+	}
+	next := (*clusterconfig.Settings)(nil)
+	if exists {
+		u, _ := obj.(*unstructured.Unstructured)
+		if u == nil {
+			return fmt.Errorf("unexpected %T in %s cache", obj, clusterconfig.Kind)
+		}
+		generation = u.GetGeneration()
+		cr, err := clusterconfig.FromUnstructured(u)
+		if err == nil {
+			var s clusterconfig.Settings
+			s, err = cr.Spec.ForNode(nodeLabels)
+			next = &s
+		}
+		cfgErr = err
+	}
+
+	changed := false
+	switch {
+	case cfgErr != nil:
+		// Keep what's running.
+	case initialized && reflect.DeepEqual(next, settings):
+		cfgErr = prevErr
+	default:
+		settings = next
+		changed, cfgErr = w.apply(next)
+	}
+
+	c.mu.Lock()
+	c.cluster.initialized = true
+	c.cluster.settings = settings
+	c.cluster.generation = generation
+	c.cluster.err = cfgErr
+	if !changed && cfgErr == nil && c.reconcileErr == nil && len(c.lastAppliedCIDRs) > 0 {
+		// Nothing to do for this node; the running config is this generation's.
+		c.cluster.appliedGen = generation
+	}
+	if changed {
+		c.forceReconcile = true
+	}
+	c.mu.Unlock()
+
+	switch {
+	case cfgErr != nil && (prevErr == nil || cfgErr.Error() != prevErr.Error()):
+		c.eventf(corev1.EventTypeWarning, ReasonClusterConfigInvalid, "%s %q is invalid for this node: %v", clusterconfig.Kind, w.name, cfgErr)
+	case changed:
+		c.log.Info("cluster config changed this node's settings, reconciling", "kind", clusterconfig.Kind, "name", w.name, "generation", generation)
+		c.eventf(corev1.EventTypeNormal, ReasonClusterConfigApplied, "Applying %s %q generation %d", clusterconfig.Kind, w.name, generation)
+		c.queue.Add(selfKey)
+		c.queue.Add(otherRoutesKey)
+	}
+	c.queueClusterStatus()
+	return nil
+}
+
+// nodeClusterConfigStatus returns this node's rollout state for the current
+// TailscaleCNIConfig generation. Callers hold c.mu.
+func (c *Controller) nodeClusterConfigStatus() clusterconfig.NodeStatus {
+	st := clusterconfig.NodeStatus{Name: c.nodeName, ObservedGeneration: c.cluster.generation}
+	switch {
+	case c.cluster.err != nil:
+		st.State, st.Message = clusterconfig.StateFailed, c.cluster.err.Error()
+	case c.cluster.appliedGen == c.cluster.generation:
+		st.State = clusterconfig.StateApplied
+	case c.reconcileErr != nil:
+		st.State, st.Message = clusterconfig.StateFailed, c.reconcileErr.Error()
+	case len(c.lastAppliedCIDRs) == 0:
+		st.State, st.Message = clusterconfig.StatePending, "waiting for the node's pod CIDR"
+	default:
+		st.State, st.Message = clusterconfig.StatePending, "waiting for reconcile"
+	}
+	return st
+}
+
+// updateClusterConfigStatus writes this node's entry in the TailscaleCNIConfig
+// status if it changed, and removes entries of Nodes that no longer exist.
+func (c *Controller) updateClusterConfigStatus(ctx context.Context) error {
+	w := c.clusterConfig
+	if !w.synced() {
+		return nil
+	}
+	obj, exists, err := w.store.GetByKey(w.name)
+	if err != nil || !exists {
+		return err
+	}
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		c.pruneClusterConfigStatus(ctx, u)
+	}
+
+	c.mu.Lock()
+	st := c.nodeClusterConfigStatus()
+	prev := c.cluster.reported
+	c.mu.Unlock()
+	st.LastTransitionTime = metav1.Now()
+	if prev != nil && prev.State == st.State {
+		st.LastTransitionTime = prev.LastTransitionTime
+		if prev.ObservedGeneration == st.ObservedGeneration && prev.Message == st.Message {
+			return nil
+		}
+	}
+
+	apply, err := clusterconfig.NodeStatusApply(w.name, st)
+	if err != nil {
+		return err
+	}
+	if _, err := w.client.Resource(clusterconfig.GroupVersionResource).ApplyStatus(ctx, w.name, apply, metav1.ApplyOptions{
+		FieldManager: "tailscale-cni/" + c.nodeName,
+		Force:        true,
+	}); err != nil {
+		return fmt.Errorf("update %s %q status: %w", clusterconfig.Kind, w.name, err)
+	}
+	c.mu.Lock()
+	c.cluster.reported = &st
+	c.mu.Unlock()
+	return nil
+}
+
+// pruneClusterConfigStatus removes status entries for deleted Nodes. Only the
+// first node by name does it, so nodes don't race; the test op makes sure a
+// stale cache can't remove the wrong entry.
+func (c *Controller) pruneClusterConfigStatus(ctx context.Context, u *unstructured.Unstructured) {
+	for _, n := range c.listNodes() {
+		if n.Name < c.nodeName {
+			return
+		}
+	}
+	nodes, _, _ := unstructured.NestedSlice(u.Object, "status", "nodes")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		entry, _ := nodes[i].(map[string]interface{})
+		name, _ := entry["name"].(string)
+		if name == "" {
+			continue
+		}
+		if _, exists, _ := c.store.GetByKey(name); exists {
+			continue
+		}
+		path := fmt.Sprintf("/status/nodes/%d", i)
+		patch, _ := json.Marshal([]map[string]interface{}{
+			{"op": "test", "path": path + "/name", "value": name},
+			{"op": "remove", "path": path},
+		})
+		_, err := c.clusterConfig.client.Resource(clusterconfig.GroupVersionResource).Patch(ctx, u.GetName(), types.JSONPatchType, patch, metav1.PatchOptions{}, "status")
+		if err != nil {
+			logger().Warn("failed to remove deleted node from cluster config status", logging.Node(name), "kind", clusterconfig.Kind, "name", u.GetName(), logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lstoll/tailscale-cni/internal/clusterconfig"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestClusterConfigRollout(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self", Labels: map[string]string{"site": "dc1"}},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24"},
+	}
+	cr := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": clusterconfig.Group + "/" + clusterconfig.Version,
+		"kind":       clusterconfig.Kind,
+		"metadata":   map[string]interface{}{"name": "default", "generation": int64(2)},
+		"spec": map[string]interface{}{
+			"mtu": int64(1400),
+			"overrides": []interface{}{map[string]interface{}{
+				"nodeSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"site": "dc1"}},
+				"mtu":          int64(1280),
+			}},
+		},
+	}}
+
+	var applied []*clusterconfig.Settings
+	var reconciles int
+	c, err := newController(fake.NewSimpleClientset(node), "self", func(ctx context.Context, ours, previous []string) error {
+		reconciles++
+		return nil
+	}, WithClusterConfig("default", func(s *clusterconfig.Settings) (bool, error) {
+		applied = append(applied, s)
+		return true, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := c.store.Add(node); err != nil {
+		t.Fatal(err)
+	}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{clusterconfig.GroupVersionResource: clusterconfig.Kind + "List"}, cr)
+	var statuses []string
+	dyn.PrependReactor("patch", clusterconfig.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		p := action.(k8stesting.PatchAction)
+		if p.GetSubresource() == "status" && p.GetPatchType() == types.ApplyPatchType {
+			statuses = append(statuses, string(p.GetPatch()))
+		}
+		return true, cr, nil
+	})
+	c.clusterConfig.client = dyn
+	c.clusterConfig.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	c.clusterConfig.synced = func() bool { return true }
+	if err := c.clusterConfig.store.Add(cr); err != nil {
+		t.Fatal(err)
+	}
+
+	c.queue.Add(clusterConfigKey)
+	for c.queue.Len() > 0 {
+		c.processNextItem(ctx)
+	}
+	if len(applied) != 1 || applied[0] == nil || applied[0].MTU != 1280 {
+		t.Fatalf("applied = %+v, want the dc1 override's MTU", applied)
+	}
+	if reconciles != 1 {
+		t.Errorf("reconciles = %d, want 1", reconciles)
+	}
+	if len(statuses) == 0 || !strings.Contains(statuses[len(statuses)-1], `"state":"Applied"`) || !strings.Contains(statuses[len(statuses)-1], `"observedGeneration":2`) {
+		t.Errorf("status patches = %v, want the last to report generation 2 Applied", statuses)
+	}
+
+	// Unchanged settings don't reconcile again, and the same status isn't rewritten.
+	n := len(statuses)
+	c.queue.Add(clusterConfigKey)
+	for c.queue.Len() > 0 {
+		c.processNextItem(ctx)
+	}
+	if len(applied) != 1 || reconciles != 1 || len(statuses) != n {
+		t.Errorf("after a no-op sync: applied %d, reconciles %d, status patches %d", len(applied), reconciles, len(statuses)-n)
+	}
+}
@@ -1,44 +1,119 @@
 // Package controller runs a node watch and reconciles only when the current
 // node's pod CIDR (or relevant state) actually changes, using a cache to avoid
 // redundant work.
+//
+// Informer event handlers only enqueue work keys on a rate-limited workqueue;
+// a single worker applies them, so bursts of Node updates coalesce into one
+// reconcile and failed reconciles are retried with exponential backoff.
 package controller
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func logger() *slog.Logger { return logging.Component("controller") }
+
+// Work queue keys. Each key names a unit of work; the queue never holds a key
+// twice, which is what coalesces bursts of events.
+const (
+	selfKey          = "self"           // reconcile our node's pod CIDRs
+	otherRoutesKey   = "other-routes"   // reconcile routes to other nodes
+	approvalKey      = "route-approval" // check whether our advertised routes are approved
+	networkKey       = "network"        // update the NetworkUnavailable condition
+	clusterConfigKey = "cluster-config" // apply the TailscaleCNIConfig settings for our node
+	clusterStatusKey = "cluster-status" // report our rollout state in the TailscaleCNIConfig status
+	egressKey        = "egress-snat"    // apply fixed egress addresses of our node's pods
+	networkPolicyKey = "network-policy" // enforce NetworkPolicy for our node's pods
+	nonMasqKey       = "non-masquerade" // update the non-masquerade CIDRs in place
+	releaseKeyPrefix = "release/"       // release/<node>: reclaim a deleted node's allocation
+)
+
+// PodCIDRsAnnotation on our Node records the pod CIDRs we last applied (and
+// advertise via Tailscale), comma-separated. After a restart it tells us which
+// advertised prefixes are ours to withdraw if the Node's pod CIDRs changed
+// while we were down.
+const PodCIDRsAnnotation = "tailscale-cni.lstoll.github.io/pod-cidrs"
+
+// cacheSyncTimeout bounds how long Run waits for the egress SNAT and
+// NetworkPolicy caches before the first reconcile. Their syncs fail, and are
+// retried, until the caches are ready.
+const cacheSyncTimeout = time.Minute
+
+// Retry backoff for failed work items: doubles from retryBaseDelay up to retryMaxDelay.
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 5 * time.Minute
 )
 
 // Reconciler is called when the desired state has changed and the controller
-// should apply configuration (CNI, Tailscale, masq).
-type Reconciler func(ctx context.Context, ourPodCIDR string) error
+// should apply configuration (CNI, Tailscale, masq). ourPodCIDRs holds one CIDR
+// per address family assigned to this node (see NodePodCIDRs). previousPodCIDRs
+// are the CIDRs last applied successfully or, on the first run, those recorded
+// on the Node (PodCIDRsAnnotation) or by the allocator, so the reconciler can
+// withdraw any that are no longer assigned. A returned error causes a retry
+// with backoff.
+type Reconciler func(ctx context.Context, ourPodCIDRs, previousPodCIDRs []string) error
 
 // OtherRoutesReconciler is called when any node is added/updated/deleted so the
 // caller can update system routes to other nodes' pod CIDRs (e.g. via Tailscale).
-// It receives the node informer store to list all nodes.
+// It receives the node informer store to list all nodes. A returned error
+// causes a retry with backoff.
 type OtherRoutesReconciler func(ctx context.Context, store cache.Store) error
 
 // Controller watches nodes and triggers reconciliation when our node's pod
 // CIDR changes. It caches the last applied pod CIDR so we only act on real changes.
 // If OtherRoutesReconciler is set, it is also run on any node add/update/delete.
 type Controller struct {
-	clientset   kubernetes.Interface
-	nodeName    string
+	clientset    kubernetes.Interface
+	nodeName     string
+	log          *slog.Logger // with our node
 	resyncPeriod time.Duration
-	store       cache.Store // set in Run() so reconcile can list nodes
+	store        cache.Store // set in Run() so reconcile can list nodes
+	queue        workqueue.TypedRateLimitingInterface[string]
+	broadcaster  record.EventBroadcaster
+	recorder     record.EventRecorder
 
 	reconcile            Reconciler
 	otherRoutesReconcile OtherRoutesReconciler
+	allocatorConfig      *AllocatorConfig
+	allocator            *allocator // nil unless WithAllocator is set
+	approvalCheck        RouteApprovalChecker
+	approvalRecheck      time.Duration
+	clusterConfig        *clusterConfigWatch // nil unless WithClusterConfig is set
+	egress               *egressWatch        // nil unless WithEgressSNAT is set
+	netpol               *netpolWatch        // nil unless WithNetworkPolicy is set
+	updateNonMasq        func(ctx context.Context) error
 
-	mu              sync.Mutex
-	lastAppliedCIDR string // last pod CIDR we successfully reconciled for
+	mu               sync.Mutex
+	lastAppliedCIDRs []string // last pod CIDRs we successfully reconciled for
+	forceReconcile   bool     // set by Resync: reconcile even if pod CIDRs are unchanged
+	unapproved       []string // pod CIDRs not approved at the last approval check
+	approvalKnown    bool     // an approval check has completed
+	approvalErr      error    // error from the last approval check
+	reconcileErr     error    // error from the last reconcile
+	policyErr        error    // why NetworkPolicy isn't enforced (WithNetworkPolicy); nil once it is
+	cluster          clusterConfigState
 }
 
 // Option configures the controller.
@@ -56,6 +131,20 @@ func WithOtherRoutesReconciler(fn OtherRoutesReconciler) Option {
 	return func(c *Controller) { c.otherRoutesReconcile = fn }
 }
 
+// WithNonMasqueradeUpdater sets fn to update the non-masquerade CIDRs of our
+// node's nftables table in place when UpdateNonMasquerade is called. If it
+// fails, our node is reconciled instead.
+func WithNonMasqueradeUpdater(fn func(ctx context.Context) error) Option {
+	return func(c *Controller) { c.updateNonMasq = fn }
+}
+
+// WithAllocator enables the built-in pod CIDR allocator: when our node has no
+// spec.podCIDR, a subnet is carved out of cfg.ClusterCIDRs and patched onto
+// the Node, and subnets of deleted nodes are reclaimed.
+func WithAllocator(cfg AllocatorConfig) Option {
+	return func(c *Controller) { c.allocatorConfig = &cfg }
+}
+
 // New returns a controller that watches nodes and calls reconcile when our
 // node's pod CIDR differs from the cached last-applied value.
 func New(config *rest.Config, nodeName string, reconcile Reconciler, opts ...Option) (*Controller, error) {
@@ -63,20 +152,55 @@ func New(config *rest.Config, nodeName string, reconcile Reconciler, opts ...Opt
 	if err != nil {
 		return nil, err
 	}
+	c, err := newController(clientset, nodeName, reconcile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.clusterConfig != nil {
+		if c.clusterConfig.client, err = dynamic.NewForConfig(config); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func newController(clientset kubernetes.Interface, nodeName string, reconcile Reconciler, opts ...Option) (*Controller, error) {
 	c := &Controller{
 		clientset: clientset,
 		nodeName:  nodeName,
+		log:       logger().With(logging.Node(nodeName)),
 		reconcile: reconcile,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedMaxOfRateLimiter(
+				workqueue.NewTypedItemExponentialFailureRateLimiter[string](retryBaseDelay, retryMaxDelay),
+				&workqueue.TypedBucketRateLimiter[string]{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+			),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "tailscale-cni"},
+		),
 	}
+	c.broadcaster, c.recorder = newRecorder(nodeName)
 	for _, o := range opts {
 		o(c)
 	}
+	if c.netpol != nil {
+		c.policyErr = errNetworkPolicyNotSynced
+	}
+	if c.allocatorConfig != nil {
+		var err error
+		c.allocator, err = newAllocator(clientset, *c.allocatorConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
 // Run starts the node informer and blocks until ctx is done. It triggers
 // reconciliation on node add/update when our node's pod CIDR is set or changed.
 func (c *Controller) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	defer c.startEvents()()
+
 	factory := informers.NewSharedInformerFactory(c.clientset, c.resyncPeriod)
 	nodeInformer := factory.Core().V1().Nodes().Informer()
 
@@ -84,118 +208,424 @@ func (c *Controller) Run(ctx context.Context) {
 	_, err := nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			c.enqueueNode(obj)
-			c.runOtherRoutesReconcile(ctx, c.store)
+			c.queue.Add(otherRoutesKey)
 		},
-		UpdateFunc: func(_, newObj interface{}) {
-			c.enqueueNodeUpdate(nil, newObj)
-			c.runOtherRoutesReconcile(ctx, c.store)
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.enqueueNode(newObj)
+			if podCIDRsChanged(oldObj, newObj) {
+				c.queue.Add(otherRoutesKey)
+			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			c.enqueueNode(obj)
-			c.runOtherRoutesReconcile(ctx, c.store)
+			c.enqueueRelease(obj)
+			c.queue.Add(otherRoutesKey)
+			if c.clusterConfig != nil {
+				c.queue.Add(clusterStatusKey) // prune the deleted node's entry
+			}
 		},
 	})
 	if err != nil {
-		log.Printf("controller: failed to add event handler: %v", err)
+		c.log.Error("failed to add event handler", logging.Err(err))
 		return
 	}
 
 	factory.Start(ctx.Done())
 
-	log.Print("controller: waiting for node cache sync")
+	c.log.Info("waiting for node cache sync")
 	if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.HasSynced) {
-		log.Print("controller: cache sync failed")
+		c.log.Error("node cache sync failed")
 		return
 	}
-	log.Print("controller: node cache synced")
+	c.log.Info("node cache synced")
+
+	if c.clusterConfig != nil {
+		c.startClusterConfigInformer(ctx)
+		// Apply the cluster settings before the first reconcile so we don't
+		// set the node up with the local config only to redo it.
+		if err := c.syncClusterConfig(ctx); err != nil {
+			c.log.Error("sync failed", "key", clusterConfigKey, logging.Err(err))
+		}
+	}
+
+	if c.allocator != nil {
+		if err := c.allocator.sweep(ctx, c.listNodes()); err != nil {
+			c.log.Error("allocator sweep failed", logging.Err(err))
+		}
+	}
 
 	// Run an immediate reconcile from cache (in case we missed events before sync)
 	obj, exists, _ := c.store.GetByKey(c.nodeName)
 	if exists {
-		if n, ok := obj.(*corev1.Node); ok && n.Spec.PodCIDR != "" {
-			log.Printf("controller: this node %q has pod CIDR %s", c.nodeName, n.Spec.PodCIDR)
+		if n, ok := obj.(*corev1.Node); ok {
+			if cidrs := NodePodCIDRs(n); len(cidrs) > 0 {
+				c.log.Info("found our pod CIDRs", logging.CIDRs(cidrs))
+			}
 		}
 	}
-	c.maybeReconcile(ctx)
-	c.runOtherRoutesReconcile(ctx, c.store)
+	// Apply egress SNAT and NetworkPolicy before the first reconcile too, so
+	// it sets the table up with them rather than briefly without. Their
+	// informers share the node informer's factory, so there is one
+	// Namespace watch for both.
+	var synced []cache.InformerSynced
+	if c.egress != nil {
+		if err := c.startEgressInformers(ctx, factory); err != nil {
+			c.log.Error("failed to start egress SNAT informers", logging.Err(err))
+		} else {
+			synced = append(synced, c.egress.synced)
+		}
+	}
+	if c.netpol != nil {
+		if err := c.startNetworkPolicyInformers(factory); err != nil {
+			c.log.Error("failed to start NetworkPolicy informers", logging.Err(err))
+		} else {
+			synced = append(synced, c.netpol.synced)
+		}
+	}
+	if len(synced) > 0 {
+		factory.Start(ctx.Done())
+		syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+		if !cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+			c.log.Warn("namespace, pod and NetworkPolicy caches not synced; will keep retrying", "timeout", cacheSyncTimeout)
+		}
+		cancel()
+	}
+	if c.egress != nil {
+		if err := c.syncEgressSNAT(ctx); err != nil {
+			c.log.Error("sync failed", "key", egressKey, logging.Err(err))
+			c.queue.AddRateLimited(egressKey)
+		}
+	}
+	if c.netpol != nil {
+		if err := c.syncNetworkPolicy(ctx); err != nil {
+			c.log.Error("sync failed", "key", networkPolicyKey, logging.Err(err))
+			c.queue.AddRateLimited(networkPolicyKey)
+		}
+	}
+	c.queue.Add(selfKey)
+	c.queue.Add(otherRoutesKey)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for c.processNextItem(ctx) {
+		}
+	}()
 
 	<-ctx.Done()
-	log.Print("controller: stopping")
+	c.log.Info("stopping")
+	c.queue.ShutDown()
+	wg.Wait()
 }
 
-func (c *Controller) enqueueNode(obj interface{}) {
-	node, ok := obj.(*corev1.Node)
-	if !ok {
+// Resync queues a reconcile of our node (even if its pod CIDRs are unchanged)
+// and of routes to other nodes. Use it when state outside Kubernetes that the
+// reconcilers depend on has changed, e.g. tailscaled prefs or addresses.
+func (c *Controller) Resync() {
+	c.mu.Lock()
+	c.forceReconcile = true
+	c.mu.Unlock()
+	c.queue.Add(selfKey)
+	c.queue.Add(otherRoutesKey)
+	c.queue.Add(approvalKey)
+}
+
+// UpdateNonMasquerade queues updating the non-masquerade CIDRs in place (see
+// WithNonMasqueradeUpdater). It runs on the same worker as reconciles, so it
+// never races the table being set up. Without an updater it is a Resync.
+func (c *Controller) UpdateNonMasquerade() {
+	if c.updateNonMasq == nil {
+		c.Resync()
 		return
 	}
-	if node.Name == c.nodeName {
-		c.maybeReconcileFromNode(context.Background(), node)
+	c.queue.Add(nonMasqKey)
+}
+
+// ResyncOtherRoutes queues a reconcile of routes to other nodes only. Use it
+// when host routes drifted from what we installed, e.g. someone deleted one.
+func (c *Controller) ResyncOtherRoutes() {
+	c.queue.Add(otherRoutesKey)
+}
+
+// processNextItem handles one work queue key. It returns false once the queue
+// has been shut down.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key); err != nil {
+		if ctx.Err() != nil {
+			return true
+		}
+		c.log.Error("sync failed", "key", key, "retry", c.queue.NumRequeues(key)+1, logging.Err(err))
+		c.queue.AddRateLimited(key)
+		return true
 	}
+	c.queue.Forget(key)
+	return true
 }
 
-func (c *Controller) enqueueNodeUpdate(_, newObj interface{}) {
-	node, ok := newObj.(*corev1.Node)
-	if !ok {
+func (c *Controller) sync(ctx context.Context, key string) error {
+	switch {
+	case key == selfKey:
+		return c.maybeReconcile(ctx)
+	case key == approvalKey:
+		return c.checkRouteApproval(ctx)
+	case key == networkKey:
+		return c.updateNetworkCondition(ctx)
+	case key == clusterConfigKey:
+		return c.syncClusterConfig(ctx)
+	case key == clusterStatusKey:
+		return c.updateClusterConfigStatus(ctx)
+	case key == egressKey:
+		return c.syncEgressSNAT(ctx)
+	case key == networkPolicyKey:
+		return c.syncNetworkPolicy(ctx)
+	case key == nonMasqKey:
+		if err := c.updateNonMasq(ctx); err != nil {
+			c.log.Warn("failed to update non-masquerade CIDRs in place; reconciling", logging.Err(err))
+			c.Resync()
+		}
+		return nil
+	case key == otherRoutesKey:
+		if c.otherRoutesReconcile == nil {
+			return nil
+		}
+		err := instrument(metrics.ReconcilerOtherRoutes, func() error {
+			return c.otherRoutesReconcile(ctx, c.store)
+		})
+		if err != nil {
+			c.eventf(corev1.EventTypeWarning, eventReason(err, ReasonRoutesFailed), "Updating routes to other nodes failed: %v", err)
+		}
+		return err
+	case strings.HasPrefix(key, releaseKeyPrefix):
+		return c.allocator.release(ctx, strings.TrimPrefix(key, releaseKeyPrefix))
+	}
+	return fmt.Errorf("unknown work queue key %q", key)
+}
+
+// instrument runs one reconciler, recording its duration and outcome.
+func instrument(reconciler string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	metrics.ReconcileDuration.WithLabelValues(reconciler).Observe(time.Since(start).Seconds())
+	metrics.ReconcileTotal.WithLabelValues(reconciler).Inc()
+	if err != nil {
+		metrics.ReconcileErrors.WithLabelValues(reconciler).Inc()
+	}
+	return err
+}
+
+func (c *Controller) enqueueNode(obj interface{}) {
+	if node := nodeFromObj(obj); node != nil && node.Name == c.nodeName {
+		c.queue.Add(selfKey)
+		if c.clusterConfig != nil {
+			c.queue.Add(clusterConfigKey) // our labels may match other overrides
+		}
+	}
+}
+
+// enqueueRelease queues reclaiming a deleted node's allocated pod CIDRs.
+func (c *Controller) enqueueRelease(obj interface{}) {
+	if c.allocator == nil {
 		return
 	}
-	if node.Name == c.nodeName {
-		c.maybeReconcileFromNode(context.Background(), node)
+	if node := nodeFromObj(obj); node != nil {
+		c.queue.Add(releaseKeyPrefix + node.Name)
 	}
 }
 
-func (c *Controller) maybeReconcile(ctx context.Context) {
+func (c *Controller) maybeReconcile(ctx context.Context) error {
 	obj, exists, err := c.store.GetByKey(c.nodeName)
 	if err != nil {
-		log.Printf("controller: get node from cache: %v", err)
-		return
+		return fmt.Errorf("get node from cache: %w", err)
 	}
 	if !exists {
-		return
+		return nil
 	}
 	node, ok := obj.(*corev1.Node)
 	if !ok {
-		return
+		return nil
 	}
-	c.maybeReconcileFromNode(ctx, node)
+	return c.maybeReconcileFromNode(ctx, node)
 }
 
-func (c *Controller) maybeReconcileFromNode(ctx context.Context, node *corev1.Node) {
-	podCIDR := node.Spec.PodCIDR
+func (c *Controller) maybeReconcileFromNode(ctx context.Context, node *corev1.Node) error {
+	podCIDRs := NodePodCIDRs(node)
 
 	c.mu.Lock()
-	last := c.lastAppliedCIDR
+	last := c.lastAppliedCIDRs
+	force := c.forceReconcile
+	clusterGen := c.cluster.generation
 	c.mu.Unlock()
 
-	if podCIDR == "" {
-		if last != "" {
-			log.Printf("controller: node %q lost pod CIDR (was %s), skipping reconcile", c.nodeName, last)
+	if len(podCIDRs) == 0 && c.allocator != nil {
+		// Once patched, the node update event brings us back here with CIDRs set.
+		return c.allocator.ensure(ctx, node, c.listNodes())
+	}
+	if len(podCIDRs) == 0 {
+		if len(last) > 0 {
+			c.log.Warn("node lost its pod CIDRs; skipping reconcile", slog.Any("previous", last))
 		} else {
-			log.Printf("controller: node %q has no spec.podCIDR yet; cannot write CNI config", c.nodeName)
+			c.log.Warn("node has no spec.podCIDR yet; cannot write CNI config")
 		}
-		return
+		return nil
 	}
 
-	if podCIDR == last {
-		return
+	if slices.Equal(podCIDRs, last) && !force {
+		return c.recordPodCIDRs(ctx, node, podCIDRs)
+	}
+	previous := last
+	if len(previous) == 0 {
+		previous = c.recordedPodCIDRs(ctx, node)
 	}
 
-	log.Printf("controller: pod CIDR changed %q -> %q, reconciling", last, podCIDR)
-	if err := c.reconcile(ctx, podCIDR); err != nil {
-		log.Printf("controller: reconcile failed: %v", err)
-		return
+	if force && slices.Equal(podCIDRs, last) {
+		c.log.Info("resync requested, reconciling", logging.CIDRs(podCIDRs))
+	} else {
+		c.log.Info("pod CIDRs changed, reconciling", logging.CIDRs(podCIDRs), slog.Any("previous", last))
+	}
+	// Clear the flag before reconciling so a Resync that arrives while we run
+	// isn't lost; on failure the rate-limited retry re-runs unconditionally.
+	c.mu.Lock()
+	c.forceReconcile = false
+	c.mu.Unlock()
+	if err := instrument(metrics.ReconcilerNode, func() error {
+		return c.reconcile(ctx, podCIDRs, previous)
+	}); err != nil {
+		c.mu.Lock()
+		c.forceReconcile = true
+		c.reconcileErr = err
+		c.mu.Unlock()
+		c.queue.Add(networkKey)
+		c.queueClusterStatus()
+		c.eventf(corev1.EventTypeWarning, conditionReason(err), "Setting up pod CIDRs %s failed: %v", strings.Join(podCIDRs, ", "), err)
+		return fmt.Errorf("reconcile: %w", err)
 	}
 
 	c.mu.Lock()
-	c.lastAppliedCIDR = podCIDR
+	prevErr := c.reconcileErr
+	c.lastAppliedCIDRs = podCIDRs
+	c.reconcileErr = nil
+	c.cluster.appliedGen = clusterGen
 	c.mu.Unlock()
-	log.Printf("controller: reconciled pod CIDR %q", podCIDR)
+	c.queue.Add(networkKey)
+	c.queueClusterStatus()
+	if prevErr != nil {
+		c.eventf(corev1.EventTypeNormal, recoveredReason(prevErr), "Pod CIDRs %s set up after earlier failure: %v", strings.Join(podCIDRs, ", "), prevErr)
+	}
+	if len(last) > 0 && !slices.Equal(podCIDRs, last) {
+		c.eventf(corev1.EventTypeNormal, ReasonPodCIDRChanged, "Pod CIDRs changed from %s to %s", strings.Join(last, ", "), strings.Join(podCIDRs, ", "))
+	}
+	metrics.SetPodCIDRs(podCIDRs)
+	c.log.Info("reconciled", logging.CIDRs(podCIDRs))
+	c.queue.Add(approvalKey)
+	return c.recordPodCIDRs(ctx, node, podCIDRs)
 }
 
-func (c *Controller) runOtherRoutesReconcile(ctx context.Context, store cache.Store) {
-	if c.otherRoutesReconcile == nil {
-		return
+// recordedPodCIDRs returns the pod CIDRs recorded for node before we started:
+// on the Node (PodCIDRsAnnotation) and, with the allocator, in its ConfigMap.
+func (c *Controller) recordedPodCIDRs(ctx context.Context, node *corev1.Node) []string {
+	var cidrs []string
+	if v := node.Annotations[PodCIDRsAnnotation]; v != "" {
+		cidrs = strings.Split(v, ",")
+	}
+	if c.allocator != nil {
+		assigned, err := c.allocator.assigned(ctx, node.Name)
+		if err != nil {
+			c.log.Warn("failed to read the allocator's pod CIDRs for our node", logging.Err(err))
+		}
+		for _, cidr := range assigned {
+			if !slices.Contains(cidrs, cidr) {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+	return cidrs
+}
+
+// recordPodCIDRs records cidrs on node (PodCIDRsAnnotation) unless they are
+// already there.
+func (c *Controller) recordPodCIDRs(ctx context.Context, node *corev1.Node, cidrs []string) error {
+	v := strings.Join(cidrs, ",")
+	if node.Annotations[PodCIDRsAnnotation] == v {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{PodCIDRsAnnotation: v},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("record pod CIDRs on node: %w", err)
+	}
+	return nil
+}
+
+// queueClusterStatus queues reporting our rollout state, if we watch a
+// TailscaleCNIConfig.
+func (c *Controller) queueClusterStatus() {
+	if c.clusterConfig != nil {
+		c.queue.Add(clusterStatusKey)
+	}
+}
+
+func (c *Controller) listNodes() []*corev1.Node {
+	var nodes []*corev1.Node
+	for _, obj := range c.store.List() {
+		if n, ok := obj.(*corev1.Node); ok {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// nodeFromObj returns the Node in an informer event object, unwrapping
+// tombstones from missed deletes. It returns nil for anything else.
+func nodeFromObj(obj interface{}) *corev1.Node {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	node, _ := obj.(*corev1.Node)
+	return node
+}
+
+// podCIDRsChanged reports whether an update changed a node's pod CIDRs. Periodic
+// resyncs (same resourceVersion) count as changed so routes are re-checked.
+func podCIDRsChanged(oldObj, newObj interface{}) bool {
+	oldNode, newNode := nodeFromObj(oldObj), nodeFromObj(newObj)
+	if oldNode == nil || newNode == nil {
+		return true
+	}
+	if oldNode.ResourceVersion == newNode.ResourceVersion {
+		return true
+	}
+	return !slices.Equal(NodePodCIDRs(oldNode), NodePodCIDRs(newNode))
+}
+
+// AppliedPodCIDRs returns the pod CIDRs this controller last applied
+// successfully, i.e. the prefixes it currently owns. Used for teardown on exit.
+func (c *Controller) AppliedPodCIDRs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.lastAppliedCIDRs)
+}
+
+// NodePodCIDRs returns the pod CIDRs assigned to node: spec.podCIDRs when set
+// (one per family on dual-stack clusters), otherwise the legacy spec.podCIDR.
+func NodePodCIDRs(node *corev1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return slices.Clone(node.Spec.PodCIDRs)
 	}
-	if err := c.otherRoutesReconcile(ctx, store); err != nil {
-		log.Printf("controller: other-routes reconcile failed: %v", err)
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
 	}
+	return nil
 }
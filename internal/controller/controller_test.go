@@ -0,0 +1,456 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFailedReconcileIsRetried(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24"},
+	}
+
+	var calls int
+	c, err := newController(fake.NewSimpleClientset(node), "self", func(ctx context.Context, cidrs, previous []string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("tailscaled not running")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := c.store.Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	c.queue.Add(selfKey)
+	c.processNextItem(ctx)
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+	if got := c.queue.NumRequeues(selfKey); got != 1 {
+		t.Fatalf("requeues = %d, want 1", got)
+	}
+	if len(c.AppliedPodCIDRs()) != 0 {
+		t.Fatal("failed reconcile must not record applied CIDRs")
+	}
+
+	// The NetworkUnavailable update queued by the failure comes first; the
+	// rate-limited retry arrives after it without any new Node event.
+	c.processNextItem(ctx)
+	c.processNextItem(ctx)
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+	if got := c.queue.NumRequeues(selfKey); got != 0 {
+		t.Errorf("requeues = %d after success, want 0", got)
+	}
+	if got := c.AppliedPodCIDRs(); len(got) != 1 || got[0] != "10.99.1.0/24" {
+		t.Errorf("applied = %v", got)
+	}
+	c.queue.ShutDown()
+}
+
+func TestPreviousPodCIDRsRecordedOnNode(t *testing.T) {
+	ctx := context.Background()
+	// Our pod CIDR changed while we were down.
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self", Annotations: map[string]string{PodCIDRsAnnotation: "10.99.0.0/24"}},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24"},
+	}
+	clientset := fake.NewSimpleClientset(node)
+	var previous []string
+	c, err := newController(clientset, "self", func(ctx context.Context, cidrs, prev []string) error {
+		previous = prev
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := c.store.Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.sync(ctx, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(previous) != 1 || previous[0] != "10.99.0.0/24" {
+		t.Errorf("previous = %v, want the recorded 10.99.0.0/24", previous)
+	}
+	got, err := clientset.CoreV1().Nodes().Get(ctx, "self", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Annotations[PodCIDRsAnnotation]; v != "10.99.1.0/24" {
+		t.Errorf("recorded pod CIDRs = %q, want 10.99.1.0/24", v)
+	}
+}
+
+func TestPodCIDRsChanged(t *testing.T) {
+	mk := func(rv string, cidrs ...string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "n", ResourceVersion: rv},
+			Spec:       corev1.NodeSpec{PodCIDRs: cidrs},
+		}
+	}
+	if podCIDRsChanged(mk("1", "10.99.1.0/24"), mk("2", "10.99.1.0/24")) {
+		t.Error("status-only update should not count as a pod CIDR change")
+	}
+	if !podCIDRsChanged(mk("1"), mk("2", "10.99.1.0/24")) {
+		t.Error("assigning a pod CIDR is a change")
+	}
+	if !podCIDRsChanged(mk("1", "10.99.1.0/24"), mk("1", "10.99.1.0/24")) {
+		t.Error("resync (same resourceVersion) should count as a change")
+	}
+}
+
+func TestResyncForcesReconcile(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24"},
+	}
+	var calls int
+	c, err := newController(fake.NewSimpleClientset(node), "self", func(ctx context.Context, cidrs, previous []string) error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := c.store.Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	c.queue.Add(selfKey)
+	c.processNextItem(ctx)
+	c.queue.Add(selfKey)
+	c.processNextItem(ctx)
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1 (unchanged CIDRs must not reconcile)", calls)
+	}
+
+	c.Resync()
+	for c.queue.Len() > 0 {
+		c.processNextItem(ctx)
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2 after Resync", calls)
+	}
+}
+
+func TestUpdateNonMasquerade(t *testing.T) {
+	ctx := context.Background()
+	updateErr := errors.New("no such table")
+	var updates int
+	c, err := newController(fake.NewSimpleClientset(), "self", nil, WithNonMasqueradeUpdater(func(ctx context.Context) error {
+		updates++
+		return updateErr
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+
+	// A failed update falls back to reconciling our node.
+	c.UpdateNonMasquerade()
+	c.processNextItem(ctx)
+	if updates != 1 || !c.forceReconcile || c.queue.Len() == 0 {
+		t.Errorf("after a failed update: updates %d, forceReconcile %v, queued %d", updates, c.forceReconcile, c.queue.Len())
+	}
+	for c.queue.Len() > 0 {
+		key, _ := c.queue.Get()
+		c.queue.Done(key)
+	}
+	c.forceReconcile = false
+
+	updateErr = nil
+	c.UpdateNonMasquerade()
+	c.processNextItem(ctx)
+	if updates != 2 || c.forceReconcile || c.queue.Len() != 0 {
+		t.Errorf("after an update: updates %d, forceReconcile %v, queued %d", updates, c.forceReconcile, c.queue.Len())
+	}
+}
+
+func TestRouteApprovalCondition(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}}
+	clientset := fake.NewSimpleClientset(node)
+
+	unapproved := []string{"10.99.1.0/24"}
+	c, err := newController(clientset, "self", nil, WithRouteApprovalChecker(func(ctx context.Context, cidrs []string) ([]string, error) {
+		return unapproved, nil
+	}, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	c.lastAppliedCIDRs = []string{"10.99.1.0/24"}
+
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := routesApprovedStatus(t, clientset); got != corev1.ConditionFalse {
+		t.Errorf("condition = %q, want False", got)
+	}
+
+	unapproved = nil
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := routesApprovedStatus(t, clientset); got != corev1.ConditionTrue {
+		t.Errorf("condition = %q, want True", got)
+	}
+}
+
+func routesApprovedStatus(t *testing.T, clientset *fake.Clientset) corev1.ConditionStatus {
+	t.Helper()
+	n, err := clientset.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cond := range n.Status.Conditions {
+		if cond.Type == ConditionRoutesApproved {
+			return cond.Status
+		}
+	}
+	return ""
+}
+
+func TestNetworkUnavailableCondition(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24", PodCIDRs: []string{"10.99.1.0/24"}},
+	}
+	clientset := fake.NewSimpleClientset(node)
+
+	reconcileErr := NewConditionError(ReasonMasqSetupFailed, errors.New("nftables: permission denied"))
+	var unapproved []string
+	var checkErr error
+	c, err := newController(clientset, "self", func(ctx context.Context, ours, previous []string) error {
+		return reconcileErr
+	}, WithRouteApprovalChecker(func(ctx context.Context, cidrs []string) ([]string, error) {
+		return unapproved, checkErr
+	}, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	if err := c.maybeReconcileFromNode(ctx, node); err == nil {
+		t.Fatal("expected reconcile error")
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionTrue || got.Reason != ReasonMasqSetupFailed {
+		t.Errorf("after failure: condition = %s/%s, want True/%s", got.Status, got.Reason, ReasonMasqSetupFailed)
+	}
+
+	// Success alone isn't enough while route approval is unknown or pending.
+	reconcileErr = nil
+	unapproved = []string{"10.99.1.0/24"}
+	if err := c.maybeReconcileFromNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionTrue || got.Reason != ReasonRoutesNotApproved {
+		t.Errorf("while unapproved: condition = %s/%s, want True/%s", got.Status, got.Reason, ReasonRoutesNotApproved)
+	}
+
+	unapproved = nil
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionFalse || got.Reason != ReasonCNIReady {
+		t.Errorf("when ready: condition = %s/%s, want False/%s", got.Status, got.Reason, ReasonCNIReady)
+	}
+
+	// tailscaled goes away after we were ready: the recheck queued when the
+	// IPN bus watch drops turns it back to True without a reconcile.
+	checkErr = errors.New("dial unix /var/run/tailscale/tailscaled.sock: connect: no such file or directory")
+	c.RecheckNetwork()
+	for c.queue.Len() > 0 {
+		c.processNextItem(ctx)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionTrue || got.Reason != ReasonTailscaleUnavailable {
+		t.Errorf("tailscaled unreachable: condition = %s/%s, want True/%s", got.Status, got.Reason, ReasonTailscaleUnavailable)
+	}
+
+	// It comes back, then the tailnet admin revokes our route.
+	checkErr = nil
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionFalse {
+		t.Errorf("tailscaled back: condition = %s/%s, want False", got.Status, got.Reason)
+	}
+	unapproved = []string{"10.99.1.0/24"}
+	if err := c.checkRouteApproval(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionTrue || got.Reason != ReasonRoutesNotApproved {
+		t.Errorf("route revoked: condition = %s/%s, want True/%s", got.Status, got.Reason, ReasonRoutesNotApproved)
+	}
+}
+
+func TestNetworkPolicyNotEnforced(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24", PodCIDRs: []string{"10.99.1.0/24"}},
+	}
+	clientset := fake.NewSimpleClientset(node)
+
+	var applied *netpol.Policy
+	c, err := newController(clientset, "self", func(ctx context.Context, ours, previous []string) error {
+		return nil
+	}, WithNetworkPolicy(func(ctx context.Context, policy *netpol.Policy) error {
+		applied = policy
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	synced := false
+	c.netpol.policies = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	c.netpol.namespaces = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	c.netpol.pods = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	c.netpol.synced = func() bool { return synced }
+
+	if err := c.maybeReconcileFromNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. no RBAC to list NetworkPolicies: nothing is applied, not even an
+	// empty policy, and the node isn't reported ready.
+	if err := c.syncNetworkPolicy(ctx); err == nil {
+		t.Error("want an error before the caches sync")
+	}
+	if applied != nil {
+		t.Errorf("applied %+v before the caches synced", applied)
+	}
+	if err := c.NetworkPolicyErr(); err == nil {
+		t.Error("NetworkPolicyErr = nil before the caches synced")
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionTrue || got.Reason != ReasonNetworkPolicyNotEnforced {
+		t.Errorf("not synced: condition = %s/%s, want True/%s", got.Status, got.Reason, ReasonNetworkPolicyNotEnforced)
+	}
+
+	synced = true
+	if err := c.syncNetworkPolicy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if applied == nil {
+		t.Error("policy not applied once the caches synced")
+	}
+	if err := c.NetworkPolicyErr(); err != nil {
+		t.Errorf("NetworkPolicyErr = %v once applied", err)
+	}
+	if err := c.updateNetworkCondition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := networkUnavailable(t, clientset); got.Status != corev1.ConditionFalse {
+		t.Errorf("applied: condition = %s/%s, want False", got.Status, got.Reason)
+	}
+}
+
+func networkUnavailable(t *testing.T, clientset *fake.Clientset) corev1.NodeCondition {
+	t.Helper()
+	n, err := clientset.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cond := range n.Status.Conditions {
+		if cond.Type == corev1.NodeNetworkUnavailable {
+			return cond
+		}
+	}
+	return corev1.NodeCondition{}
+}
+
+func TestReconcileEvents(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.99.1.0/24"},
+	}
+	reconcileErr := NewConditionError(ReasonMasqSetupFailed, errors.New("nftables: permission denied"))
+	c, err := newController(fake.NewSimpleClientset(node), "self", func(ctx context.Context, ours, previous []string) error {
+		return reconcileErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.queue.ShutDown()
+	c.store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	_ = c.maybeReconcileFromNode(ctx, node)
+	reconcileErr = nil
+	if err := c.maybeReconcileFromNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	changed := node.DeepCopy()
+	changed.Spec.PodCIDR = "10.99.2.0/24"
+	if err := c.maybeReconcileFromNode(ctx, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"Warning " + ReasonMasqSetupFailed,
+		"Normal " + ReasonMasqSetupRecovered,
+		"Normal " + ReasonPodCIDRChanged + " Pod CIDRs changed from 10.99.1.0/24 to 10.99.2.0/24",
+	} {
+		select {
+		case got := <-recorder.Events:
+			if !strings.HasPrefix(got, want) {
+				t.Errorf("event = %q, want prefix %q", got, want)
+			}
+		default:
+			t.Fatalf("missing event %q", want)
+		}
+	}
+}
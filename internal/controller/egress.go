@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EgressSNATAnnotation on a Namespace gives its pods a fixed egress address:
+// traffic they send off the node other than via the bridge or Tailscale is
+// SNAT'd to it rather than masqueraded to the outgoing interface's address.
+// The value is an IPv4 address, an IPv6 address, or one of each separated by
+// a comma for dual-stack pods. The address must route back to every node
+// (e.g. a floating IP), since any node may run the namespace's pods.
+const EgressSNATAnnotation = "tailscale-cni.lstoll.github.io/egress-snat"
+
+// EgressSNAT is a fixed egress address and the IPs of this node's pods that
+// use it, all of the address's family.
+type EgressSNAT struct {
+	Addr   string
+	PodIPs []string
+}
+
+// EgressSNATReconciler applies the egress SNAT rules for this node's pods,
+// sorted by address. It is called when they change; a returned error causes
+// a retry with backoff.
+type EgressSNATReconciler func(ctx context.Context, rules []EgressSNAT) error
+
+// WithEgressSNAT watches Namespaces and this node's Pods and calls reconcile
+// with the egress SNAT rules from EgressSNATAnnotation.
+func WithEgressSNAT(reconcile EgressSNATReconciler) Option {
+	return func(c *Controller) { c.egress = &egressWatch{reconcile: reconcile} }
+}
+
+type egressWatch struct {
+	reconcile  EgressSNATReconciler
+	namespaces cache.Store // set in Run
+	pods       cache.Store // this node's pods; set in Run
+	synced     func() bool // the caches above have synced; set in Run
+	applied    []EgressSNAT
+	ok         bool             // applied is in effect
+	invalid    map[string]error // invalid annotations by namespace, as last logged
+}
+
+// startEgressInformers adds the Namespace informer to factory, which the
+// caller starts, and starts an informer for this node's Pods.
+func (c *Controller) startEgressInformers(ctx context.Context, factory informers.SharedInformerFactory) error {
+	w := c.egress
+	podFactory := informers.NewSharedInformerFactoryWithOptions(c.clientset, c.resyncPeriod, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = "spec.nodeName=" + c.nodeName
+	}))
+	nsInformer := factory.Core().V1().Namespaces().Informer()
+	podInformer := podFactory.Core().V1().Pods().Informer()
+	enqueue := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.queue.Add(egressKey) },
+		UpdateFunc: func(_, _ interface{}) { c.queue.Add(egressKey) },
+		DeleteFunc: func(interface{}) { c.queue.Add(egressKey) },
+	}
+	for _, inf := range []cache.SharedIndexInformer{nsInformer, podInformer} {
+		if _, err := inf.AddEventHandler(enqueue); err != nil {
+			return err
+		}
+	}
+	podFactory.Start(ctx.Done())
+	w.namespaces, w.pods = nsInformer.GetStore(), podInformer.GetStore()
+	w.synced = func() bool { return nsInformer.HasSynced() && podInformer.HasSynced() }
+	return nil
+}
+
+// syncEgressSNAT applies the egress SNAT rules if they changed since they
+// were last applied. Until the caches have synced it fails, so it is retried.
+func (c *Controller) syncEgressSNAT(ctx context.Context) error {
+	w := c.egress
+	if w.synced == nil || !w.synced() {
+		return fmt.Errorf("namespace and pod caches not synced")
+	}
+	var namespaces []*corev1.Namespace
+	for _, obj := range w.namespaces.List() {
+		if ns, ok := obj.(*corev1.Namespace); ok {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	var pods []*corev1.Pod
+	for _, obj := range w.pods.List() {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	rules, invalid := egressSNATs(namespaces, pods)
+	for ns, err := range invalid {
+		if prev := w.invalid[ns]; prev == nil || prev.Error() != err.Error() {
+			c.log.Warn("ignoring invalid egress SNAT annotation", "namespace", ns, "annotation", EgressSNATAnnotation, logging.Err(err))
+		}
+	}
+	w.invalid = invalid
+
+	if w.ok && reflect.DeepEqual(rules, w.applied) {
+		return nil
+	}
+	w.ok = false
+	if err := instrument(metrics.ReconcilerEgressSNAT, func() error {
+		return w.reconcile(ctx, rules)
+	}); err != nil {
+		return fmt.Errorf("egress SNAT: %w", err)
+	}
+	w.applied, w.ok = rules, true
+	c.log.Debug("applied egress SNAT", "addresses", len(rules))
+	return nil
+}
+
+// egressSNATs returns the egress SNAT rules for pods, from the annotations
+// on namespaces, and the error for each namespace whose annotation is
+// invalid. Pods on the host network or that have finished are left out;
+// their IPs aren't (or may no longer be) theirs.
+func egressSNATs(namespaces []*corev1.Namespace, pods []*corev1.Pod) ([]EgressSNAT, map[string]error) {
+	addrs := make(map[string][]netip.Addr) // by namespace
+	invalid := make(map[string]error)
+	for _, ns := range namespaces {
+		v, ok := ns.Annotations[EgressSNATAnnotation]
+		if !ok {
+			continue
+		}
+		a, err := parseEgressSNAT(v)
+		if err != nil {
+			invalid[ns.Name] = err
+			continue
+		}
+		addrs[ns.Name] = a
+	}
+
+	podIPs := make(map[netip.Addr][]string)
+	for _, a := range addrs {
+		for _, addr := range a {
+			podIPs[addr] = nil
+		}
+	}
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, ip := range pod.Status.PodIPs {
+			podIP, err := netip.ParseAddr(ip.IP)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs[pod.Namespace] {
+				if addr.Is4() == podIP.Is4() {
+					podIPs[addr] = append(podIPs[addr], podIP.String())
+				}
+			}
+		}
+	}
+
+	rules := make([]EgressSNAT, 0, len(podIPs))
+	for addr, ips := range podIPs {
+		slices.Sort(ips)
+		rules = append(rules, EgressSNAT{Addr: addr.String(), PodIPs: slices.Compact(ips)})
+	}
+	slices.SortFunc(rules, func(a, b EgressSNAT) int {
+		return netip.MustParseAddr(a.Addr).Compare(netip.MustParseAddr(b.Addr))
+	})
+	return rules, invalid
+}
+
+// parseEgressSNAT parses an EgressSNATAnnotation value: at most one address
+// per family.
+func parseEgressSNAT(v string) ([]netip.Addr, error) {
+	var out []netip.Addr
+	for _, s := range strings.Split(v, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		if slices.ContainsFunc(out, func(a netip.Addr) bool { return a.Is4() == addr.Is4() }) {
+			return nil, fmt.Errorf("%q: more than one address of a family", v)
+		}
+		out = append(out, addr)
+	}
+	return out, nil
+}
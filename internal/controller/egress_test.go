@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEgressSNATs(t *testing.T) {
+	ns := func(name, annotation string) *corev1.Namespace {
+		n := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if annotation != "" {
+			n.Annotations = map[string]string{EgressSNATAnnotation: annotation}
+		}
+		return n
+	}
+	pod := func(namespace string, phase corev1.PodPhase, ips ...string) *corev1.Pod {
+		p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}, Status: corev1.PodStatus{Phase: phase}}
+		for _, ip := range ips {
+			p.Status.PodIPs = append(p.Status.PodIPs, corev1.PodIP{IP: ip})
+		}
+		return p
+	}
+	hostNetwork := pod("partners", corev1.PodRunning, "192.168.1.10")
+	hostNetwork.Spec.HostNetwork = true
+
+	rules, invalid := egressSNATs(
+		[]*corev1.Namespace{
+			ns("default", ""),
+			ns("partners", "203.0.113.10, 2001:db8::10"),
+			ns("billing", "203.0.113.10"),
+			ns("reports", "198.51.100.7"),
+			ns("broken", "203.0.113.10,203.0.113.11"),
+		},
+		[]*corev1.Pod{
+			pod("default", corev1.PodRunning, "10.99.1.2"),
+			pod("partners", corev1.PodRunning, "10.99.1.4", "fd00:99:0:1::4"),
+			pod("billing", corev1.PodPending, "10.99.1.3"),
+			pod("billing", corev1.PodSucceeded, "10.99.1.9"),
+			pod("broken", corev1.PodRunning, "10.99.1.5"),
+			hostNetwork,
+		},
+	)
+	want := []EgressSNAT{
+		{Addr: "198.51.100.7"}, // no pods here yet
+		{Addr: "203.0.113.10", PodIPs: []string{"10.99.1.3", "10.99.1.4"}},
+		{Addr: "2001:db8::10", PodIPs: []string{"fd00:99:0:1::4"}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %+v, want %+v", rules, want)
+	}
+	if len(invalid) != 1 || invalid["broken"] == nil {
+		t.Errorf("invalid = %v, want just broken", invalid)
+	}
+}
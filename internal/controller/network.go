@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Reasons for the NetworkUnavailable Node condition, also used for the Warning
+// events recorded when a reconcile fails. ReasonRoutesNotApproved is shared
+// with ConditionRoutesApproved.
+const (
+	ReasonCNIReady                 = "TailscaleCNIReady"
+	ReasonTailscaleUnavailable     = "TailscaleUnavailable"
+	ReasonAdvertiseFailed          = "AdvertiseFailed"
+	ReasonCNIConfigFailed          = "CNIConfigFailed"
+	ReasonMasqSetupFailed          = "MasqSetupFailed"
+	ReasonReconcileFailed          = "ReconcileFailed"
+	ReasonNetworkPolicyNotEnforced = "NetworkPolicyNotEnforced"
+)
+
+// ConditionError is returned by a Reconciler or OtherRoutesReconciler to say
+// which step failed. Reason becomes the reason of the Warning event recorded on
+// the Node and, for a Reconciler, of the NetworkUnavailable condition.
+// Errors of any other type get a generic reason.
+type ConditionError struct {
+	Reason string
+	Err    error
+}
+
+// NewConditionError wraps err with a condition and event reason.
+func NewConditionError(reason string, err error) error {
+	return &ConditionError{Reason: reason, Err: err}
+}
+
+func (e *ConditionError) Error() string { return e.Err.Error() }
+
+func (e *ConditionError) Unwrap() error { return e.Err }
+
+// conditionReason returns the reason carried by a Reconciler error.
+func conditionReason(err error) string {
+	return eventReason(err, ReasonReconcileFailed)
+}
+
+// eventReason returns the reason carried by err, or fallback.
+func eventReason(err error, fallback string) string {
+	var ce *ConditionError
+	if errors.As(err, &ce) {
+		return ce.Reason
+	}
+	return fallback
+}
+
+// recoveredReason is the reason of the Normal event recorded when a reconcile
+// succeeds after failing with err.
+func recoveredReason(err error) string {
+	if conditionReason(err) == ReasonMasqSetupFailed {
+		return ReasonMasqSetupRecovered
+	}
+	return ReasonRecovered
+}
+
+// updateNetworkCondition sets NetworkUnavailable from the outcome of the last
+// reconcile and route approval check: False only once our pod CIDRs are
+// applied, (with a RouteApprovalChecker) approved and (with WithNetworkPolicy)
+// policed, True with the failing step as reason otherwise. Until the first
+// outcome is known it leaves the condition alone.
+func (c *Controller) updateNetworkCondition(ctx context.Context) error {
+	c.mu.Lock()
+	applied := c.lastAppliedCIDRs
+	reconcileErr, approvalErr := c.reconcileErr, c.approvalErr
+	unapproved, approvalKnown := c.unapproved, c.approvalKnown
+	policyErr := c.policyErr
+	c.mu.Unlock()
+
+	cond := corev1.NodeCondition{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue}
+	switch {
+	case reconcileErr != nil:
+		cond.Reason = conditionReason(reconcileErr)
+		cond.Message = fmt.Sprintf("Tailscale CNI setup failed: %v", reconcileErr)
+	case len(applied) == 0:
+		return nil
+	case c.approvalCheck != nil && approvalErr != nil:
+		cond.Reason = ReasonTailscaleUnavailable
+		cond.Message = fmt.Sprintf("Cannot check route approval with tailscaled: %v", approvalErr)
+	case c.approvalCheck != nil && !approvalKnown:
+		return nil
+	case len(unapproved) > 0:
+		cond.Reason = ReasonRoutesNotApproved
+		cond.Message = fmt.Sprintf("Pod CIDRs %s are not approved in the tailnet", strings.Join(unapproved, ", "))
+	case policyErr != nil:
+		cond.Reason = ReasonNetworkPolicyNotEnforced
+		cond.Message = fmt.Sprintf("NetworkPolicy is not enforced: %v", policyErr)
+	default:
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = ReasonCNIReady
+		cond.Message = fmt.Sprintf("Tailscale CNI is routing pod CIDRs %s", strings.Join(applied, ", "))
+	}
+	return c.setNodeCondition(ctx, cond)
+}
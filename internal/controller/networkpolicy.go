@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NetworkPolicyReconciler enforces the NetworkPolicy of this node's pods. It
+// is called when the compiled policy changes; a returned error causes a retry
+// with backoff.
+type NetworkPolicyReconciler func(ctx context.Context, policy *netpol.Policy) error
+
+// WithNetworkPolicy watches NetworkPolicies, Namespaces and Pods and calls
+// reconcile with the policy for this node's pods (see netpol.Compile).
+func WithNetworkPolicy(reconcile NetworkPolicyReconciler) Option {
+	return func(c *Controller) { c.netpol = &netpolWatch{reconcile: reconcile} }
+}
+
+type netpolWatch struct {
+	reconcile  NetworkPolicyReconciler
+	policies   cache.Store // set in Run
+	namespaces cache.Store // set in Run
+	pods       cache.Store // every node's pods, as peers; set in Run
+	synced     func() bool // the caches above have synced; set in Run
+	applied    *netpol.Policy
+	invalid    []string // errors compiling the policies, as last logged
+}
+
+// errNetworkPolicyNotSynced is why NetworkPolicy isn't enforced while the
+// NetworkPolicy, Namespace and Pod caches haven't synced (e.g. because of
+// missing RBAC).
+var errNetworkPolicyNotSynced = errors.New("NetworkPolicy, Namespace and Pod caches not synced")
+
+// startNetworkPolicyInformers adds the NetworkPolicy, Namespace and Pod
+// informers to factory, which the caller starts.
+func (c *Controller) startNetworkPolicyInformers(factory informers.SharedInformerFactory) error {
+	w := c.netpol
+	policyInformer := factory.Networking().V1().NetworkPolicies().Informer()
+	nsInformer := factory.Core().V1().Namespaces().Informer()
+	podInformer := factory.Core().V1().Pods().Informer()
+	enqueue := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.queue.Add(networkPolicyKey) },
+		UpdateFunc: func(_, _ interface{}) { c.queue.Add(networkPolicyKey) },
+		DeleteFunc: func(interface{}) { c.queue.Add(networkPolicyKey) },
+	}
+	for _, inf := range []cache.SharedIndexInformer{policyInformer, nsInformer, podInformer} {
+		if _, err := inf.AddEventHandler(enqueue); err != nil {
+			return err
+		}
+	}
+	w.policies, w.namespaces, w.pods = policyInformer.GetStore(), nsInformer.GetStore(), podInformer.GetStore()
+	w.synced = func() bool {
+		return policyInformer.HasSynced() && nsInformer.HasSynced() && podInformer.HasSynced()
+	}
+	return nil
+}
+
+// syncNetworkPolicy applies the compiled NetworkPolicy if it changed since it
+// was last applied. Until the caches have synced it fails, so it is retried,
+// rather than apply a policy compiled from partial state.
+func (c *Controller) syncNetworkPolicy(ctx context.Context) error {
+	w := c.netpol
+	if w.synced == nil || !w.synced() {
+		c.setNetworkPolicyErr(errNetworkPolicyNotSynced)
+		return errNetworkPolicyNotSynced
+	}
+	var policies []*networkingv1.NetworkPolicy
+	for _, obj := range w.policies.List() {
+		if p, ok := obj.(*networkingv1.NetworkPolicy); ok {
+			policies = append(policies, p)
+		}
+	}
+	var namespaces []*corev1.Namespace
+	for _, obj := range w.namespaces.List() {
+		if ns, ok := obj.(*corev1.Namespace); ok {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	var pods []*corev1.Pod
+	for _, obj := range w.pods.List() {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	policy, errs := netpol.Compile(c.nodeName, policies, namespaces, pods)
+	invalid := make([]string, 0, len(errs))
+	for _, err := range errs {
+		invalid = append(invalid, err.Error())
+	}
+	if !reflect.DeepEqual(invalid, w.invalid) {
+		for _, err := range errs {
+			c.log.Warn("NetworkPolicy allows less than it says", logging.Err(err))
+		}
+	}
+	w.invalid = invalid
+
+	if w.applied != nil && reflect.DeepEqual(policy, w.applied) {
+		return nil
+	}
+	w.applied = nil
+	if err := instrument(metrics.ReconcilerNetworkPolicy, func() error {
+		return w.reconcile(ctx, policy)
+	}); err != nil {
+		err = fmt.Errorf("network policy: %w", err)
+		c.setNetworkPolicyErr(err)
+		return err
+	}
+	w.applied = policy
+	c.setNetworkPolicyErr(nil)
+	c.log.Debug("applied network policy", "isolatedIngress", len(policy.Ingress), "isolatedEgress", len(policy.Egress))
+	return nil
+}
+
+// setNetworkPolicyErr records why NetworkPolicy isn't enforced, or nil once
+// it is, and updates NetworkUnavailable if that changed.
+func (c *Controller) setNetworkPolicyErr(err error) {
+	c.mu.Lock()
+	prev := c.policyErr
+	c.policyErr = err
+	c.mu.Unlock()
+	if (prev == nil) != (err == nil) || (prev != nil && prev.Error() != err.Error()) {
+		c.queue.Add(networkKey)
+	}
+}
+
+// NetworkPolicyErr reports why NetworkPolicy isn't enforced for our node's
+// pods, e.g. the caches haven't synced or the nftables update failed. It is
+// nil once it is, and without WithNetworkPolicy.
+func (c *Controller) NetworkPolicyErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policyErr
+}
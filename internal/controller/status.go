@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// ConditionRoutesApproved is the Node condition reporting whether the tailnet
+// has approved the pod CIDRs this node advertises.
+const ConditionRoutesApproved corev1.NodeConditionType = "TailscaleRoutesApproved"
+
+// Event reasons attached to our Node. Reconcile failures use the
+// NetworkUnavailable reasons (see network.go).
+const (
+	ReasonRoutesApproved     = "RoutesApproved"
+	ReasonRoutesNotApproved  = "RoutesNotApproved"
+	ReasonPodCIDRChanged     = "PodCIDRChanged"
+	ReasonMasqSetupRecovered = "MasqSetupRecovered"
+	ReasonRecovered          = "ReconcileRecovered"
+	ReasonRoutesFailed       = "RoutesFailed"
+	ReasonGatewayUnreachable = "GatewayUnreachable"
+)
+
+// newRecorder returns an event broadcaster and a recorder that attributes
+// events to tailscale-cni on nodeName. The broadcaster is started in Run.
+func newRecorder(nodeName string) (record.EventBroadcaster, record.EventRecorder) {
+	b := record.NewBroadcaster()
+	return b, b.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "tailscale-cni", Host: nodeName})
+}
+
+// startEvents sends recorded events to the API server until the returned
+// function is called.
+func (c *Controller) startEvents() func() {
+	w := c.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.clientset.CoreV1().Events("")})
+	return w.Stop
+}
+
+// nodeRef references our Node for events. Like kubelet, we use the node name
+// as UID so `kubectl describe node` finds them.
+func (c *Controller) nodeRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{Kind: "Node", Name: c.nodeName, UID: types.UID(c.nodeName)}
+}
+
+// eventf records an event on our Node.
+func (c *Controller) eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	c.recorder.Eventf(c.nodeRef(), eventType, reason, messageFmt, args...)
+}
+
+// setNodeCondition patches cond onto our Node's status. It is a no-op if the
+// cached Node already has the same status, reason and message.
+// LastTransitionTime is only moved when the status changes.
+func (c *Controller) setNodeCondition(ctx context.Context, cond corev1.NodeCondition) error {
+	now := metav1.NewTime(time.Now())
+	cond.LastHeartbeatTime = now
+	cond.LastTransitionTime = now
+	if existing := c.cachedNodeCondition(cond.Type); existing != nil {
+		if existing.Status == cond.Status && existing.Reason == cond.Reason && existing.Message == cond.Message {
+			return nil
+		}
+		if existing.Status == cond.Status {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+	patch, err := json.Marshal(map[string]any{
+		"status": map[string]any{
+			"conditions": []corev1.NodeCondition{cond},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// Strategic merge: conditions merge by type, so other conditions are kept.
+	if _, err := c.clientset.CoreV1().Nodes().PatchStatus(ctx, c.nodeName, patch); err != nil {
+		return fmt.Errorf("patch node %q condition %s: %w", c.nodeName, cond.Type, err)
+	}
+	c.log.Info("set node condition", "type", cond.Type, "status", cond.Status, "reason", cond.Reason)
+	return nil
+}
+
+func (c *Controller) cachedNodeCondition(t corev1.NodeConditionType) *corev1.NodeCondition {
+	if c.store == nil {
+		return nil
+	}
+	obj, exists, err := c.store.GetByKey(c.nodeName)
+	if err != nil || !exists {
+		return nil
+	}
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return nil
+	}
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == t {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDedupEntries bounds the warnings remembered; beyond it, those logged more
+// than the window ago are forgotten.
+const maxDedupEntries = 1024
+
+// dedupHandler drops a warning or error that repeats one logged less than
+// window ago (same level, message and attributes) and counts it instead. The
+// next time it is logged the count is added as "repeated". Lower levels are
+// passed through.
+type dedupHandler struct {
+	next   slog.Handler
+	window time.Duration
+	now    func() time.Time
+	prefix string // from WithAttrs and WithGroup; part of the key
+	state  *dedupState
+}
+
+type dedupState struct {
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	logged   time.Time
+	repeated int
+}
+
+func newDedupHandler(next slog.Handler, window time.Duration, now func() time.Time) *dedupHandler {
+	return &dedupHandler{next: next, window: window, now: now, state: &dedupState{seen: map[string]*dedupEntry{}}}
+}
+
+func (h *dedupHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+	key := h.key(r)
+	now := h.now()
+
+	h.state.mu.Lock()
+	e := h.state.seen[key]
+	if e != nil && now.Sub(e.logged) < h.window {
+		e.repeated++
+		h.state.mu.Unlock()
+		return nil
+	}
+	repeated := 0
+	if e != nil {
+		repeated = e.repeated
+	}
+	if len(h.state.seen) >= maxDedupEntries {
+		for k, e := range h.state.seen {
+			if now.Sub(e.logged) >= h.window {
+				delete(h.state.seen, k)
+			}
+		}
+	}
+	h.state.seen[key] = &dedupEntry{logged: now}
+	h.state.mu.Unlock()
+
+	if repeated > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("repeated", repeated))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *dedupHandler) key(r slog.Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %q%s", r.Level, r.Message, h.prefix)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	return b.String()
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+	}
+	c.prefix = b.String()
+	return &c
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.prefix = h.prefix + " " + name + "."
+	return &c
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestDedupHandler(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Unix(0, 0)
+	h := newDedupHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}), time.Minute, func() time.Time { return now })
+	log := slog.New(h).With(Node("n1"))
+
+	log.Warn("no pod CIDR yet")
+	log.Warn("no pod CIDR yet")
+	log.Info("reconciled")
+	log.Info("reconciled")
+	log.Warn("no pod CIDR yet", Err(errors.New("other")))
+	slog.New(h).With(Node("n2")).Warn("no pod CIDR yet")
+	now = now.Add(30 * time.Second)
+	log.Warn("no pod CIDR yet")
+	now = now.Add(31 * time.Second)
+	log.Warn("no pod CIDR yet")
+
+	want := `level=WARN msg="no pod CIDR yet" node=n1
+level=INFO msg=reconciled node=n1
+level=INFO msg=reconciled node=n1
+level=WARN msg="no pod CIDR yet" node=n1 err=other
+level=WARN msg="no pod CIDR yet" node=n2
+level=WARN msg="no pod CIDR yet" node=n1 repeated=2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
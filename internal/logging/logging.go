@@ -0,0 +1,93 @@
+// Package logging sets up tailscale-cni's structured logs (log/slog) and
+// defines the attributes shared across packages, so the same thing is always
+// logged under the same key: node, cidr (cidrs for a list), via, iface and err.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// dedupWindow is how long a repeated warning is suppressed for.
+const dedupWindow = 5 * time.Minute
+
+// level is the minimum level logged; SetLevel changes it at runtime.
+var level slog.LevelVar
+
+// ParseLevel parses debug, info, warn or error (case-insensitive, with an
+// optional offset such as "debug-4").
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, err
+	}
+	return l, nil
+}
+
+// Setup makes a logger writing to w in format (FormatText or FormatJSON) at
+// lvl and above the default for log/slog, the log package and client-go's
+// klog. Repeated warnings and errors are deduplicated.
+func Setup(w io.Writer, lvl, format string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+	var h slog.Handler
+	switch format {
+	case FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	l := slog.New(newDedupHandler(h, dedupWindow, time.Now))
+	slog.SetDefault(l)
+	klog.SetSlogLogger(l.With("component", "client-go"))
+	return nil
+}
+
+// SetLevel changes the minimum level logged.
+func SetLevel(lvl string) error {
+	l, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Component returns the default logger for a component (package). It is
+// looked up on each call so it picks up the logger Setup installs.
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
+
+// Node is the name of a Kubernetes Node.
+func Node(name string) slog.Attr { return slog.String("node", name) }
+
+// CIDR is a pod CIDR or other prefix.
+func CIDR[P string | netip.Prefix](cidr P) slog.Attr { return slog.Any("cidr", cidr) }
+
+// CIDRs is a list of pod CIDRs or other prefixes.
+func CIDRs[P string | netip.Prefix](cidrs []P) slog.Attr { return slog.Any("cidrs", cidrs) }
+
+// Via is the gateway of a route.
+func Via[A string | netip.Addr](via A) slog.Attr { return slog.Any("via", via) }
+
+// Iface is a network interface name.
+func Iface(name string) slog.Attr { return slog.String("iface", name) }
+
+// Err is an error.
+func Err(err error) slog.Attr { return slog.Any("err", err) }
@@ -0,0 +1,39 @@
+package masq
+
+import "github.com/lstoll/tailscale-cni/internal/netpol"
+
+// Config is what Setup puts in the tailscale-cni table.
+type Config struct {
+	// PodCIDRs are this node's pod CIDRs, one per family.
+	PodCIDRs []string
+	// Masquerade masquerades pod egress. Without it BridgeName,
+	// NonMasqueradeCIDRs and EgressSNAT have no effect.
+	Masquerade bool
+	// BridgeName and TailscaleInterface are the interfaces pod traffic
+	// leaves by without being masqueraded.
+	BridgeName         string
+	TailscaleInterface string
+	// NonMasqueradeCIDRs are destinations pod traffic is never masqueraded
+	// to.
+	NonMasqueradeCIDRs []string
+	// EgressSNAT source-NATs egress from some pods to a fixed address
+	// instead of masquerading it.
+	EgressSNAT []SNAT
+	// NetworkPolicy, if not nil, is enforced on the forward hook: traffic to
+	// and from the isolated pods it lists is dropped unless it allows it.
+	NetworkPolicy *netpol.Policy
+	// ClampMSS lowers the MSS option of TCP SYNs between PodCIDRs and
+	// TailscaleInterface to MSS, or if that's 0 to what fits in the
+	// interface's MTU, so connections across Tailscale don't depend on path
+	// MTU discovery. If MSS is 0 and the MTU can't be read, nothing is
+	// clamped.
+	ClampMSS bool
+	MSS      int
+}
+
+// SNAT rewrites the source address of egress traffic from Sources (pod IPs)
+// to To. Sources of the other family than To are left to masquerading.
+type SNAT struct {
+	To      string
+	Sources []string
+}
@@ -0,0 +1,141 @@
+//go:build linux
+
+package masq
+
+import (
+	"net"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// TCP MSS clamping is a chain on the forward hook at mangle priority, ahead
+// of NetworkPolicy's filter chain. Pods have the bridge's MTU (1500 by
+// default) while tailscale0 is usually 1280, and ICMP "packet too big" doesn't
+// reliably make it back across the bridge, so without it large segments (e.g.
+// a TLS server's certificates) stall. Clamping SYNs both ways makes each end
+// send segments that fit:
+//
+//	chain mss {
+//		type filter hook forward priority -150;
+//		meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1240
+//		meta nfproto ipv4 ip daddr 10.99.1.0/24 iifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1240
+//	}
+//
+// The kernel only ever lowers the MSS, so a peer that asks for less keeps it.
+// The value is fixed rather than `rt mtu`, which would clamp SYNs towards pods
+// to the bridge's MTU and which the nftables library can't read back.
+const (
+	mssChainName = "mss"
+
+	tcpOptMaxseg = 2 // TCPOPT_MAXSEG
+	tcpFlagSYN   = 0x02
+	tcpFlagRST   = 0x04
+)
+
+// interfaceMTU returns the MTU of the named interface; a variable for tests.
+var interfaceMTU = func(name string) (int, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.MTU, nil
+}
+
+// mssTable adds the chain clamping the MSS of TCP connections between the pod
+// CIDRs and the Tailscale interface to t. Without a configured MSS it needs
+// the interface's MTU; if that can't be read (e.g. tailscaled hasn't created
+// the interface yet) it logs a warning and leaves the chain out rather than
+// fail masquerading and NetworkPolicy with it.
+func mssTable(t *Table, c Config) error {
+	podCIDRs, err := parsePodCIDRs(c.PodCIDRs)
+	if err != nil {
+		return err
+	}
+	mtu, ok := clampMTU(c)
+	if !ok {
+		return nil
+	}
+
+	chain := Chain{
+		Name:     mssChainName,
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityMangle,
+	}
+	// Two rules per pod CIDR, leaving by and arriving from Tailscale:
+	// meta nfproto <family> <family> <saddr|daddr> podCIDR <oifname|iifname> tailscaleInterface <syn> tcp option maxseg size set <mss>
+	for _, prefix := range podCIDRs {
+		mss := c.MSS
+		if mss == 0 {
+			// Less the IP and TCP headers
+			mss = mtu - 40
+			if prefix.Addr().Is6() {
+				mss = mtu - 60
+			}
+		}
+		for _, in := range []bool{false, true} {
+			exprs := matchPrefix(prefix, in)
+			exprs = append(exprs, matchIfname(c.TailscaleInterface, in)...)
+			exprs = append(exprs, setMSS(uint16(mss))...)
+			chain.Rules = append(chain.Rules, Rule{Exprs: exprs})
+		}
+	}
+	t.Chains = append(t.Chains, chain)
+	return nil
+}
+
+// clampMTU returns the MTU to derive the MSS from when c doesn't set one, and
+// whether mssTable adds the chain.
+func clampMTU(c Config) (int, bool) {
+	if c.MSS != 0 {
+		return 0, true
+	}
+	mtu, err := interfaceMTU(c.TailscaleInterface)
+	if err != nil {
+		logger().Warn("not clamping MSS; can't read the Tailscale interface's MTU", logging.Iface(c.TailscaleInterface), logging.Err(err))
+		return 0, false
+	}
+	return mtu, true
+}
+
+// matchIfname returns expressions matching packets leaving by (or, if in,
+// arriving from) the named interface.
+func matchIfname(name string, in bool) []expr.Any {
+	key := expr.MetaKeyOIFNAME
+	if in {
+		key = expr.MetaKeyIIFNAME
+	}
+	return []expr.Any{
+		// Load oifname/iifname into reg 2
+		&expr.Meta{Key: key, Register: 2},
+		// cmp reg 2 eq name
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: padIfname(name)},
+	}
+}
+
+// setMSS returns expressions lowering the MSS option of TCP SYNs to mss.
+func setMSS(mss uint16) []expr.Any {
+	return []expr.Any{
+		// Load the L4 protocol into reg 1 and require TCP
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		// Load the TCP flags into reg 1 and require SYN without RST
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            1,
+			Mask:           []byte{tcpFlagSYN | tcpFlagRST},
+			Xor:            []byte{0},
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{tcpFlagSYN}},
+		// Load mss into reg 1 and write it to the MSS option, if any
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(mss)},
+		&expr.Exthdr{SourceRegister: 1, Op: expr.ExthdrOpTcpopt, Type: tcpOptMaxseg, Offset: 2, Len: 2},
+	}
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package masq
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+)
+
+func TestMSSTable(t *testing.T) {
+	orig := interfaceMTU
+	t.Cleanup(func() { interfaceMTU = orig })
+	interfaceMTU = func(name string) (int, error) {
+		if name != "tailscale0" {
+			return 0, errors.New("no such interface")
+		}
+		return 1280, nil
+	}
+
+	dualStack := []string{"10.99.1.0/24", "fd00:99:0:1::/64"}
+	got := renderTable(mustDesiredTable(t, Config{PodCIDRs: dualStack, ClampMSS: true}))
+	want := `table inet tailscale-cni {
+	chain mss {
+		type filter hook forward priority -150;
+		meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1240
+		meta nfproto ipv4 ip daddr 10.99.1.0/24 iifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1240
+		meta nfproto ipv6 ip6 saddr fd00:99:0:1::/64 oifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1220
+		meta nfproto ipv6 ip6 daddr fd00:99:0:1::/64 iifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1220
+	}
+}
+`
+	if got != want {
+		t.Errorf("desiredTable =\n%s\nwant\n%s", got, want)
+	}
+
+	// A configured MSS doesn't need the interface.
+	fixed := Config{PodCIDRs: dualStack, BridgeName: "cni0", TailscaleInterface: "ts1", ClampMSS: true, MSS: 1200}
+	if got := renderTable(mustDesiredTable(t, fixed)); strings.Count(got, "size set 1200") != 4 {
+		t.Errorf("desiredTable with MSS 1200 =\n%s", got)
+	}
+
+	// Without the interface, the defaults Setup gets (masquerading,
+	// NetworkPolicy and clamping to the MTU) still set up the rest, and
+	// Check doesn't want the MSS chain.
+	defaults := Config{
+		PodCIDRs:           dualStack,
+		Masquerade:         true,
+		BridgeName:         "cni0",
+		TailscaleInterface: "ts1",
+		NetworkPolicy:      &netpol.Policy{},
+		ClampMSS:           true,
+	}
+	table, err := desiredTable(defaults)
+	if err != nil {
+		t.Fatalf("desiredTable without the interface's MTU: %v", err)
+	}
+	var chains []string
+	for _, c := range table.Chains {
+		chains = append(chains, c.Name)
+	}
+	if want := []string{chainName, policyChainName}; !slices.Equal(chains, want) {
+		t.Errorf("chains without the interface's MTU = %v, want %v", chains, want)
+	}
+	if got, want := wantChains(defaults), []string{chainName, policyChainName}; !slices.Equal(got, want) {
+		t.Errorf("wantChains without the interface's MTU = %v, want %v", got, want)
+	}
+	defaults.TailscaleInterface = "tailscale0"
+	if got, want := wantChains(defaults), []string{chainName, policyChainName, mssChainName}; !slices.Equal(got, want) {
+		t.Errorf("wantChains = %v, want %v", got, want)
+	}
+
+	// The MTU changing only replaces the rules.
+	current := inKernel(mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: dualStack[:1], ClampMSS: true}))
+	d := diff(current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: dualStack[:1], ClampMSS: true, MSS: 1100}))
+	wantChanges := []string{
+		"delete rule mss handle 4",
+		"delete rule mss handle 5",
+		`add rule mss: meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1100`,
+		`add rule mss: meta nfproto ipv4 ip daddr 10.99.1.0/24 iifname "tailscale0" meta l4proto tcp tcp flags & (syn|rst) == syn tcp option maxseg size set 1100`,
+	}
+	if got := d.changes(); !slices.Equal(got, wantChanges) {
+		t.Errorf("changes:\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(wantChanges, "\n  "))
+	}
+}
@@ -3,15 +3,25 @@
 // Package masq configures nftables to masquerade traffic from the pod bridge
 // that leaves the node via the host's default route (e.g. to the internet).
 // Standard CNI behavior: we do not masq traffic that stays on the bridge (cni0)
-// or goes out Tailscale (pod-to-pod across nodes).
+// or goes out Tailscale (pod-to-pod across nodes). The same table optionally
+// enforces NetworkPolicy for the node's pods (see policyTable) and clamps the
+// TCP MSS of traffic via Tailscale (see mssTable).
 package masq
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/netip"
+	"slices"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -20,130 +30,236 @@ const (
 	ifnameSize = 16 // IFNAMSIZ on Linux
 )
 
-// Setup reconciles the tailscale-cni nftables table to the desired state: a
-// single NAT chain that masquerades traffic from podCIDR leaving via any
-// interface other than the bridge (bridgeName) or Tailscale (tailscaleInterface).
-// Traffic to the internet via the host's default route gets SNAT'd; pod-to-pod
-// and pod-to-tailscale do not. Ingress to pods is not filtered here; use
-// Tailscale ACLs to control who can reach your cluster's pod CIDRs.
+func logger() *slog.Logger { return logging.Component("masq") }
+
+// Setup reconciles the tailscale-cni nftables table to the desired state.
+// With c.Masquerade, a NAT chain masquerades traffic from any of c.PodCIDRs
+// leaving via any interface other than the bridge or Tailscale. Traffic to the
+// internet via the host's default route gets SNAT'd; pod-to-pod and
+// pod-to-tailscale do not, nor does traffic to any of c.NonMasqueradeCIDRs
+// (e.g. an on-prem LAN that should see pod IPs). With c.NetworkPolicy, a
+// filter chain on the forward hook drops what the policy doesn't allow to and
+// from isolated pods, whether it arrives via Tailscale or the bridge. Without
+// it pods are reachable by anything that can route to them; use Tailscale
+// ACLs to control who in the tailnet can. With c.ClampMSS, TCP SYNs between
+// c.PodCIDRs and Tailscale get their MSS lowered to fit its MTU.
+//
+// The table is in the inet family so one table covers both IPv4 and IPv6 pod
+// CIDRs on dual-stack nodes; each rule matches on nfproto before the address.
 //
-// Reconcile semantics: we always delete the table (if it exists) then recreate
-// it from scratch. That guarantees no stale chains, rules, or sets remain from
-// previous runs or from removed features.
-func Setup(podCIDR, bridgeName, tailscaleInterface string) error {
+// The non-masquerade CIDRs are kept in interval sets, which
+// SetNonMasqueradeCIDRs updates in place. Pods whose egress is SNAT'd to a
+// fixed address (c.EgressSNAT) are kept in a set per address, so pods coming
+// and going only change set elements.
+//
+// Reconcile semantics: we read back the table and change only what differs
+// from the desired state (see diff), in one atomic batch, so NAT is never
+// missing for traffic in flight. Chains, rules and sets we don't want, e.g.
+// from older releases, are removed in the same batch.
+func Setup(c Config) error {
+	err := setup(c)
+	if err != nil {
+		metrics.MasqSetupFailures.Inc()
+		return err
+	}
+	args := []any{"table", tableName, logging.CIDRs(c.PodCIDRs), logging.Iface(c.TailscaleInterface), "masquerade", c.Masquerade, slog.Any("nonMasqueradeCIDRs", c.NonMasqueradeCIDRs), "egressSNAT", len(c.EgressSNAT)}
+	if p := c.NetworkPolicy; p != nil {
+		args = append(args, "isolatedIngress", len(p.Ingress), "isolatedEgress", len(p.Egress))
+	}
+	if c.ClampMSS {
+		args = append(args, "mss", c.MSS)
+	}
+	logger().Debug("set up nftables table", args...)
+	return nil
+}
+
+func setup(c Config) error {
+	desired, err := desiredTable(c)
+	if err != nil {
+		return err
+	}
+
 	conn, err := nftables.New()
 	if err != nil {
 		return fmt.Errorf("nftables conn: %w", err)
 	}
-
-	prefix, err := netip.ParsePrefix(podCIDR)
+	actual, err := readTable(conn)
 	if err != nil {
-		return fmt.Errorf("pod CIDR: %w", err)
+		return err
+	}
+	d := diff(actual, desired)
+	// Older releases used an ip-family table of the same name; remove that
+	// too so it doesn't double-NAT.
+	legacy, err := legacyTables(conn)
+	if err != nil {
+		return err
+	}
+	if d.empty() && len(legacy) == 0 {
+		return nil
 	}
-	if !prefix.Addr().Is4() {
-		return fmt.Errorf("pod CIDR must be IPv4")
+
+	for _, t := range legacy {
+		conn.DelTable(t)
+	}
+	if err := d.apply(conn); err != nil {
+		return err
 	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("update table %s: %w", tableName, err)
+	}
+	changes := d.changes()
+	for range legacy {
+		changes = append(changes, "delete table ip "+tableName)
+	}
+	logger().Info("updated nftables table", "table", tableName, "changes", len(changes))
+	logger().Debug("nftables table changes", "table", tableName, "changes", changes)
+	return nil
+}
 
-	// Remove existing table (and all chains/rules in it). Ignore error from Flush:
-	// table may not exist yet (first run) or kernel may return ENOENT; either way
-	// the create phase below will apply the desired state.
-	conn.DelTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: tableName})
-	_ = conn.Flush()
+// Check reports an error unless the tailscale-cni table has the chains Setup
+// adds for c (the masq chain, the NetworkPolicy chain and the MSS chain), e.g.
+// because someone flushed the ruleset after Setup.
+func Check(c Config) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables conn: %w", err)
+	}
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("list chains: %w", err)
+	}
+	for _, name := range wantChains(c) {
+		if !slices.ContainsFunc(chains, func(c *nftables.Chain) bool { return c.Table.Name == tableName && c.Name == name }) {
+			return fmt.Errorf("nftables chain inet %s %s not found", tableName, name)
+		}
+	}
+	return nil
+}
 
-	// Create table, chain, and rule from desired state only.
-	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: tableName}
-	conn.AddTable(table)
+// wantChains returns the chains Setup adds for c. The MSS chain is left out
+// when there is nothing to clamp to (see mssTable).
+func wantChains(c Config) []string {
+	var want []string
+	if c.Masquerade {
+		want = append(want, chainName)
+	}
+	if c.NetworkPolicy != nil {
+		want = append(want, policyChainName)
+	}
+	if c.ClampMSS {
+		if _, ok := clampMTU(c); ok {
+			want = append(want, mssChainName)
+		}
+	}
+	return want
+}
 
-	chain := &nftables.Chain{
-		Name:     chainName,
-		Table:    table,
-		Type:     nftables.ChainTypeNAT,
-		Hooknum:  nftables.ChainHookPostrouting,
-		Priority: nftables.ChainPriorityRef(99), // before NATSource (100)
+// Teardown removes the tailscale-cni nftables table, and the ip-family table
+// of older releases. It is not an error if the tables do not exist.
+func Teardown() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
 	}
-	conn.AddChain(chain)
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("list tables: %w", err)
+	}
+	tables = slices.DeleteFunc(tables, func(t *nftables.Table) bool { return t.Name != tableName })
+	legacy, err := legacyTables(conn)
+	if err != nil {
+		return err
+	}
+	tables = append(tables, legacy...)
+	if len(tables) == 0 {
+		return nil
+	}
+	for _, t := range tables {
+		conn.DelTable(t)
+	}
+	if err := conn.Flush(); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return err
+	}
+	logger().Info("removed nftables table", "table", tableName, "legacy", len(legacy))
+	return nil
+}
 
-	// Mask for prefix (e.g. /24 -> 255.255.255.0).
-	bits := prefix.Bits()
-	if bits < 0 || bits > 32 {
-		return fmt.Errorf("invalid prefix bits: %d", bits)
+// legacyTables returns the ip-family tailscale-cni table of older releases,
+// if it is still there.
+func legacyTables(conn *nftables.Conn) ([]*nftables.Table, error) {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
 	}
-	mask := netmask4(bits)
-	network := prefix.Masked().Addr().AsSlice()
+	return slices.DeleteFunc(tables, func(t *nftables.Table) bool { return t.Name != tableName }), nil
+}
 
-	// Rule: ip saddr in podCIDR, oifname != bridgeName, oifname != tailscaleInterface -> masquerade
-	exprs := []expr.Any{
-		// Load ip saddr (offset 12, 4 bytes) into reg 1
-		&expr.Payload{
-			DestRegister: 1,
-			Base:         expr.PayloadBaseNetworkHeader,
-			Offset:       12,
-			Len:          4,
-		},
+// matchPrefix returns expressions matching packets of prefix's family whose
+// source (or, if dst, destination) address is inside prefix.
+func matchPrefix(prefix netip.Prefix, dst bool) []expr.Any {
+	size := uint32(prefix.Addr().BitLen() / 8)
+	return append(loadAddr(prefix.Addr().Is6(), dst),
 		// Mask reg 1 with prefix mask
 		&expr.Bitwise{
 			SourceRegister: 1,
 			DestRegister:   1,
-			Len:            4,
-			Mask:           mask,
-			Xor:            []byte{0, 0, 0, 0},
+			Len:            size,
+			Mask:           net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			Xor:            make([]byte, size),
 		},
 		// cmp reg 1 eq network
 		&expr.Cmp{
 			Op:       expr.CmpOpEq,
 			Register: 1,
-			Data:     network,
-		},
-		// Load oifname into reg 2
-		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 2},
-		// cmp reg 2 neq bridgeName (padded to 16 bytes)
-		&expr.Cmp{
-			Op:       expr.CmpOpNeq,
-			Register: 2,
-			Data:     padIfname(bridgeName),
-		},
-		// Load oifname into reg 2 again
-		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 2},
-		// cmp reg 2 neq tailscaleInterface
-		&expr.Cmp{
-			Op:       expr.CmpOpNeq,
-			Register: 2,
-			Data:     padIfname(tailscaleInterface),
+			Data:     prefix.Addr().AsSlice(),
 		},
-		&expr.Masq{},
-	}
-
-	conn.AddRule(&nftables.Rule{
-		Table: table,
-		Chain: chain,
-		Exprs: exprs,
-	})
-
-	return conn.Flush()
+	)
 }
 
-// Teardown removes the tailscale-cni nftables table.
-func Teardown() error {
-	conn, err := nftables.New()
-	if err != nil {
-		return err
-	}
-	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: tableName}
-	conn.DelTable(table)
-	return conn.Flush()
+// matchSet returns expressions matching packets whose source (or, if dst,
+// destination) address is in set, an address set of one family.
+func matchSet(set *nftables.Set, dst bool) []expr.Any {
+	return append(loadAddr(set.KeyType == nftables.TypeIP6Addr, dst),
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	)
 }
 
-func netmask4(bits int) []byte {
-	var m [4]byte
-	for i := 0; i < 4 && bits > 0; i++ {
-		n := 8
-		if bits < 8 {
-			n = bits
+// loadAddr returns expressions that load the source (or, if dst,
+// destination) address of IPv4 (or, if v6, IPv6) packets into reg 1. In an
+// inet table both families share the chain, so we check nfproto before
+// loading the address from the network header.
+func loadAddr(v6, dst bool) []expr.Any {
+	nfproto := byte(unix.NFPROTO_IPV4)
+	offset, size := uint32(12), uint32(4) // ip saddr
+	if dst {
+		offset = 16 // ip daddr
+	}
+	if v6 {
+		nfproto = unix.NFPROTO_IPV6
+		offset, size = 8, 16 // ip6 saddr
+		if dst {
+			offset = 24 // ip6 daddr
 		}
-		m[i] = ^(0xff >> n)
-		bits -= 8
 	}
-	return m[:]
+	return []expr.Any{
+		// Load nfproto into reg 1 and require the family
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{nfproto},
+		},
+		// Load saddr/daddr into reg 1
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          size,
+		},
+	}
 }
 
 func padIfname(name string) []byte {
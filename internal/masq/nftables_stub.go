@@ -5,11 +5,26 @@ package masq
 import "fmt"
 
 // Setup is only implemented on Linux (uses nftables).
-func Setup(podCIDR, bridgeName, tailscaleInterface string) error {
+func Setup(c Config) error {
 	return fmt.Errorf("masq: nftables only supported on Linux")
 }
 
+// Check is only implemented on Linux.
+func Check(c Config) error {
+	return fmt.Errorf("masq: nftables only supported on Linux")
+}
+
+// Ruleset is only implemented on Linux.
+func Ruleset() (string, error) {
+	return "", fmt.Errorf("masq: nftables only supported on Linux")
+}
+
 // Teardown is only implemented on Linux.
 func Teardown() error {
 	return nil
 }
+
+// SetNonMasqueradeCIDRs is only implemented on Linux.
+func SetNonMasqueradeCIDRs(cidrs []string) error {
+	return fmt.Errorf("masq: nftables only supported on Linux")
+}
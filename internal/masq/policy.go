@@ -0,0 +1,199 @@
+//go:build linux
+
+package masq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// NetworkPolicy is enforced by a filter chain on the forward hook, which sees
+// pod traffic routed via Tailscale or the host and, with br_netfilter, pod to
+// pod traffic on the bridge. Traffic from and to an isolated pod goes through
+// a chain of its own, found by pod IP in a verdict map per direction and
+// family:
+//
+//	chain forward {
+//		type filter hook forward priority 0;
+//		ct state established,related accept
+//		meta nfproto ipv4 ip saddr vmap @egress4
+//		meta nfproto ipv6 ip6 saddr vmap @egress6
+//		meta nfproto ipv4 ip daddr vmap @ingress4
+//		meta nfproto ipv6 ip6 daddr vmap @ingress6
+//	}
+//	chain ingress.shop.web {
+//		meta nfproto ipv4 ip saddr @ingress.shop.web.0.4 meta l4proto tcp th dport 8080 return
+//		counter drop
+//	}
+//
+// A pod's chain returns for traffic a policy allows, so it goes on to the
+// other direction's check, and drops the rest. Allowed peers are kept in
+// interval sets, so pods coming and going mostly only change set and map
+// elements.
+const (
+	policyChainName = "forward"
+	ingressMap      = "ingress" // + 4 or 6; also the prefix of pod chains
+	egressMap       = "egress"
+
+	// maxPodChainName leaves room for the peer set suffix within
+	// NFT_CHAIN_MAXNAMELEN and NFT_SET_MAXNAMELEN (256 with the NUL).
+	maxPodChainName = 240
+)
+
+// policyTable adds the forward chain, the chains of the pods p isolates and
+// the sets and maps they use to t.
+func policyTable(t *Table, p *netpol.Policy) {
+	forward := Chain{
+		Name:     policyChainName,
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Rules:    []Rule{{Exprs: ctEstablished()}},
+	}
+	var podChains []Chain
+	for _, dir := range []struct {
+		name string
+		pods []netpol.Pod
+	}{{egressMap, p.Egress}, {ingressMap, p.Ingress}} {
+		// Egress is looked up by source address, ingress by destination;
+		// in the pod's chain the peer is the other end.
+		ingress := dir.name == ingressMap
+		jumps4, jumps6 := make(map[netip.Addr]string), make(map[netip.Addr]string)
+		for _, pod := range dir.pods {
+			chain := podChain(t, podChainName(dir.name, pod), pod, !ingress)
+			podChains = append(podChains, chain)
+			for _, ip := range pod.IPs {
+				if ip.Is4() {
+					jumps4[ip] = chain.Name
+				} else {
+					jumps6[ip] = chain.Name
+				}
+			}
+		}
+		for _, m := range []Set{newVerdictMap(dir.name+"4", false, jumps4), newVerdictMap(dir.name+"6", true, jumps6)} {
+			t.Sets = append(t.Sets, m)
+			forward.Rules = append(forward.Rules, Rule{
+				Exprs: append(loadAddr(m.KeyType == nftables.TypeIP6Addr, ingress),
+					// Jump to the chain the address maps to, if any
+					&expr.Lookup{SourceRegister: 1, SetName: m.Name, IsDestRegSet: true},
+				),
+			})
+		}
+	}
+	t.Chains = append(t.Chains, forward)
+	t.Chains = append(t.Chains, podChains...)
+}
+
+// podChain returns the chain named name for one direction of pod, adding the
+// peer sets it uses to t. Peers are matched by destination (dst) for egress
+// and by source for ingress:
+// [<family> <saddr|daddr> @<name>.<allow>.<4|6>] [meta l4proto <proto> [th dport <port>[-<end>]]] return
+// ...
+// counter drop
+func podChain(t *Table, name string, pod netpol.Pod, dst bool) Chain {
+	chain := Chain{Name: name}
+	for i, allow := range pod.Allow {
+		peers := [][]expr.Any{nil} // any peer
+		if allow.Peers != nil {
+			peers = nil
+			var v4, v6 []netip.Prefix
+			for _, p := range allow.Peers {
+				if p.Addr().Is4() {
+					v4 = append(v4, p)
+				} else {
+					v6 = append(v6, p)
+				}
+			}
+			for _, family := range []struct {
+				suffix   int
+				v6       bool
+				prefixes []netip.Prefix
+			}{{4, false, v4}, {6, true, v6}} {
+				if len(family.prefixes) == 0 {
+					continue
+				}
+				set := newSet(fmt.Sprintf("%s.%d.%d", name, i, family.suffix), family.v6, true, family.prefixes)
+				t.Sets = append(t.Sets, set)
+				peers = append(peers, matchSet(set.nft(nil), dst))
+			}
+		}
+		ports := [][]expr.Any{nil} // any port
+		if allow.Ports != nil {
+			ports = nil
+			for _, p := range allow.Ports {
+				ports = append(ports, matchPort(p))
+			}
+		}
+		for _, peer := range peers {
+			for _, port := range ports {
+				chain.Rules = append(chain.Rules, Rule{
+					Exprs: slices.Concat(peer, port, []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}),
+				})
+			}
+		}
+	}
+	chain.Rules = append(chain.Rules, Rule{Exprs: []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}}})
+	return chain
+}
+
+// podChainName returns the name of the chain for pod in a direction:
+// <dir>.<namespace>.<pod>, or with a hash of the pod's name if that's too
+// long. Namespaces can't contain dots, so names can't collide.
+func podChainName(dir string, pod netpol.Pod) string {
+	name := dir + "." + pod.Namespace + "." + pod.Name
+	if len(name) > maxPodChainName {
+		sum := sha256.Sum256([]byte(pod.Name))
+		name = dir + "." + pod.Namespace + "." + hex.EncodeToString(sum[:8])
+	}
+	return name
+}
+
+// ctEstablished returns expressions accepting packets of connections already
+// allowed: ct state established,related accept.
+func ctEstablished() []expr.Any {
+	return []expr.Any{
+		// Load ct state into reg 1 and mask it with the states
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            make([]byte, 4),
+		},
+		// cmp reg 1 neq 0
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+// matchPort returns expressions matching packets of p's protocol and, unless
+// p is every port, destination port range.
+func matchPort(p netpol.Port) []expr.Any {
+	exprs := []expr.Any{
+		// Load the L4 protocol into reg 1 and require p's
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(p.Protocol)}},
+	}
+	if p.Port == 0 {
+		return exprs
+	}
+	// Load the destination port into reg 1
+	exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2})
+	if p.EndPort <= p.Port {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(p.Port)})
+	}
+	return append(exprs,
+		&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(p.Port)},
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(p.EndPort)},
+	)
+}
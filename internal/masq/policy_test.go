@@ -0,0 +1,146 @@
+//go:build linux
+
+package masq
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lstoll/tailscale-cni/internal/netpol"
+)
+
+func testPolicy() *netpol.Policy {
+	web := []netip.Addr{netip.MustParseAddr("10.99.1.2"), netip.MustParseAddr("fd00:99:0:1::2")}
+	return &netpol.Policy{
+		Ingress: []netpol.Pod{
+			{Namespace: "shop", Name: "db", IPs: []netip.Addr{netip.MustParseAddr("10.99.1.3")}, Allow: []netpol.Allow{
+				{Peers: []netip.Prefix{netip.MustParsePrefix("10.99.1.2/32"), netip.MustParsePrefix("fd00:99:0:1::2/128")}},
+			}},
+			{Namespace: "shop", Name: "web", IPs: web, Allow: []netpol.Allow{
+				{Ports: []netpol.Port{{Protocol: netpol.TCP, Port: 8080}}},
+				{Peers: []netip.Prefix{netip.MustParsePrefix("10.99.2.0/24")}, Ports: []netpol.Port{{Protocol: netpol.UDP, Port: 9000, EndPort: 9100}, {Protocol: netpol.SCTP}}},
+			}},
+		},
+		Egress: []netpol.Pod{
+			{Namespace: "shop", Name: "web", IPs: web},
+		},
+	}
+}
+
+func TestPolicyTable(t *testing.T) {
+	got := renderTable(mustDesiredTable(t, Config{PodCIDRs: []string{"10.99.1.0/24"}, NetworkPolicy: testPolicy()}))
+	want := `table inet tailscale-cni {
+	map egress4 {
+		type ipv4_addr : verdict;
+		elements = { 10.99.1.2 : jump egress.shop.web }
+	}
+	map egress6 {
+		type ipv6_addr : verdict;
+		elements = { fd00:99:0:1::2 : jump egress.shop.web }
+	}
+	set ingress.shop.db.0.4 {
+		type ipv4_addr; flags interval;
+		elements = { 10.99.1.2/32 }
+	}
+	set ingress.shop.db.0.6 {
+		type ipv6_addr; flags interval;
+		elements = { fd00:99:0:1::2/128 }
+	}
+	set ingress.shop.web.1.4 {
+		type ipv4_addr; flags interval;
+		elements = { 10.99.2.0/24 }
+	}
+	map ingress4 {
+		type ipv4_addr : verdict;
+		elements = { 10.99.1.2 : jump ingress.shop.web, 10.99.1.3 : jump ingress.shop.db }
+	}
+	map ingress6 {
+		type ipv6_addr : verdict;
+		elements = { fd00:99:0:1::2 : jump ingress.shop.web }
+	}
+	chain forward {
+		type filter hook forward priority 0;
+		ct state established,related accept
+		meta nfproto ipv4 ip saddr vmap @egress4
+		meta nfproto ipv6 ip6 saddr vmap @egress6
+		meta nfproto ipv4 ip daddr vmap @ingress4
+		meta nfproto ipv6 ip6 daddr vmap @ingress6
+	}
+	chain egress.shop.web {
+		counter drop
+	}
+	chain ingress.shop.db {
+		meta nfproto ipv4 ip saddr @ingress.shop.db.0.4 return
+		meta nfproto ipv6 ip6 saddr @ingress.shop.db.0.6 return
+		counter drop
+	}
+	chain ingress.shop.web {
+		meta l4proto tcp th dport 8080 return
+		meta nfproto ipv4 ip saddr @ingress.shop.web.1.4 meta l4proto udp th dport >= 9000 th dport <= 9100 return
+		meta nfproto ipv4 ip saddr @ingress.shop.web.1.4 meta l4proto sctp return
+		counter drop
+	}
+}
+`
+	if got != want {
+		t.Errorf("desiredTable =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPolicyDiff(t *testing.T) {
+	pods := []string{"10.99.1.0/24"}
+	current := inKernel(mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods, NetworkPolicy: testPolicy()}))
+
+	newPod := testPolicy()
+	newPod.Ingress = append(newPod.Ingress, netpol.Pod{Namespace: "shop", Name: "worker", IPs: []netip.Addr{netip.MustParseAddr("10.99.1.4")}})
+	peerMoved := testPolicy()
+	peerMoved.Ingress[0].Allow[0].Peers[0] = netip.MustParsePrefix("10.99.1.5/32")
+
+	for _, tt := range []struct {
+		name    string
+		desired Config
+		want    []string
+	}{
+		{"unchanged", Config{Masquerade: true, PodCIDRs: pods, NetworkPolicy: testPolicy()}, nil},
+		{"pod isolated", Config{Masquerade: true, PodCIDRs: pods, NetworkPolicy: newPod}, []string{
+			"add chain ingress.shop.worker",
+			"update map ingress4",
+			"add rule ingress.shop.worker: counter drop",
+		}},
+		{"peer changed", Config{Masquerade: true, PodCIDRs: pods, NetworkPolicy: peerMoved}, []string{
+			"update set ingress.shop.db.0.4",
+		}},
+		{"policy disabled", Config{Masquerade: true, PodCIDRs: pods}, []string{
+			"delete chain forward",
+			"delete chain egress.shop.web",
+			"delete chain ingress.shop.db",
+			"delete chain ingress.shop.web",
+			"delete map egress4",
+			"delete map egress6",
+			"delete set ingress.shop.db.0.4",
+			"delete set ingress.shop.db.0.6",
+			"delete set ingress.shop.web.1.4",
+			"delete map ingress4",
+			"delete map ingress6",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diff(current, mustDesiredTable(t, tt.desired))
+			if got := d.changes(); !slices.Equal(got, tt.want) {
+				t.Errorf("changes:\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+		})
+	}
+}
+
+func TestPodChainName(t *testing.T) {
+	if got := podChainName("ingress", netpol.Pod{Namespace: "shop", Name: "web-7d9f"}); got != "ingress.shop.web-7d9f" {
+		t.Errorf("podChainName = %q", got)
+	}
+	long := podChainName("ingress", netpol.Pod{Namespace: "shop", Name: strings.Repeat("a", 253)})
+	if len(long) > maxPodChainName || !strings.HasPrefix(long, "ingress.shop.") {
+		t.Errorf("podChainName of a long name = %q", long)
+	}
+}
@@ -0,0 +1,335 @@
+//go:build linux
+
+package masq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Ruleset renders the tailscale-cni table in nft-like syntax, for
+// `tailscale-cni status`. It understands the expressions this package
+// generates; anything else is shown by type.
+func Ruleset() (string, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return "", fmt.Errorf("nftables conn: %w", err)
+	}
+	t, err := readTable(conn)
+	if err != nil {
+		return "", err
+	}
+	if t == nil {
+		return "", fmt.Errorf("table inet %s not found", tableName)
+	}
+	return renderTable(t), nil
+}
+
+// renderTable formats t's sets and their elements, then its chains and their
+// rules.
+func renderTable(t *Table) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", tableName)
+	for _, s := range t.Sets {
+		fmt.Fprintf(&b, "\t%s %s {\n\t\ttype %s", s.kind(), s.Name, s.KeyType.Name)
+		if s.Map {
+			b.WriteString(" : verdict")
+		}
+		b.WriteString(";")
+		if s.Interval {
+			b.WriteString(" flags interval;")
+		}
+		b.WriteString("\n")
+		if len(s.Prefixes) > 0 {
+			fmt.Fprintf(&b, "\t\telements = { %s }\n", renderElements(&s))
+		}
+		b.WriteString("\t}\n")
+	}
+	for _, c := range t.Chains {
+		fmt.Fprintf(&b, "\tchain %s {\n", c.Name)
+		if c.Hook != nil {
+			prio := 0
+			if c.Priority != nil {
+				prio = int(int32(*c.Priority))
+			}
+			fmt.Fprintf(&b, "\t\ttype %s hook %s priority %d;\n", c.Type, hookName(*c.Hook), prio)
+		}
+		for _, r := range c.Rules {
+			fmt.Fprintf(&b, "\t\t%s\n", r)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// renderElements formats a set's elements; interval sets as prefixes.
+func renderElements(s *Set) string {
+	out := make([]string, 0, len(s.Prefixes))
+	for i, p := range s.Prefixes {
+		switch {
+		case s.Interval:
+			out = append(out, p.String())
+		case s.Map:
+			out = append(out, fmt.Sprintf("%s : jump %s", p.Addr(), s.Jumps[i]))
+		default:
+			out = append(out, p.Addr().String())
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func hookName(h nftables.ChainHook) string {
+	switch h {
+	case unix.NF_INET_PRE_ROUTING:
+		return "prerouting"
+	case unix.NF_INET_LOCAL_IN:
+		return "input"
+	case unix.NF_INET_FORWARD:
+		return "forward"
+	case unix.NF_INET_LOCAL_OUT:
+		return "output"
+	case unix.NF_INET_POST_ROUTING:
+		return "postrouting"
+	}
+	return fmt.Sprintf("%d", h)
+}
+
+// operand is what a register holds while rendering: a named packet field,
+// optionally masked (a prefix match), or an immediate value.
+type operand struct {
+	name string
+	mask []byte
+}
+
+// renderRule formats one rule's expressions, e.g.
+// `meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname != "cni0" masquerade`.
+func renderRule(exprs []expr.Any) string {
+	regs := make(map[uint32]operand)
+	var out []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			regs[e.Register] = operand{name: metaName(e.Key)}
+		case *expr.Ct:
+			regs[e.Register] = operand{name: ctName(e.Key)}
+		case *expr.Payload:
+			regs[e.DestRegister] = operand{name: payloadName(e.Base, e.Offset, e.Len)}
+		case *expr.Bitwise:
+			op := regs[e.SourceRegister]
+			op.mask = e.Mask
+			regs[e.DestRegister] = op
+		case *expr.Immediate:
+			regs[e.Register] = operand{name: formatValue("", e.Data, nil)}
+		case *expr.Cmp:
+			op := regs[e.Register]
+			switch {
+			case op.name == "ct state" && op.mask != nil && e.Op == expr.CmpOpNeq:
+				// ct state masked with the states, != 0
+				out = append(out, "ct state "+ctStates(op.mask))
+			case op.name == "tcp flags" && op.mask != nil && len(e.Data) == 1:
+				out = append(out, fmt.Sprintf("tcp flags & (%s) %s%s", tcpFlags(op.mask[0]), cmpOpSymbol(e.Op), tcpFlags(e.Data[0])))
+			default:
+				out = append(out, strings.TrimSpace(fmt.Sprintf("%s %s%s", op.name, cmpOp(e.Op), formatValue(op.name, e.Data, op.mask))))
+			}
+		case *expr.Lookup:
+			neg := ""
+			switch {
+			case e.IsDestRegSet:
+				neg = "vmap "
+			case e.Invert:
+				neg = "!= "
+			}
+			out = append(out, fmt.Sprintf("%s %s@%s", regs[e.SourceRegister].name, neg, e.SetName))
+		case *expr.Exthdr:
+			if e.Op == expr.ExthdrOpTcpopt && e.Type == tcpOptMaxseg && e.SourceRegister != 0 {
+				out = append(out, "tcp option maxseg size set "+regs[e.SourceRegister].name)
+			} else {
+				out = append(out, fmt.Sprintf("<%T>", e))
+			}
+		case *expr.Counter:
+			out = append(out, "counter")
+		case *expr.Masq:
+			out = append(out, "masquerade")
+		case *expr.NAT:
+			kind := "snat"
+			if e.Type == expr.NATTypeDestNAT {
+				kind = "dnat"
+			}
+			out = append(out, fmt.Sprintf("%s to %s", kind, regs[e.RegAddrMin].name))
+		case *expr.Verdict:
+			out = append(out, verdictName(e))
+		default:
+			out = append(out, fmt.Sprintf("<%T>", e))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func metaName(k expr.MetaKey) string {
+	switch k {
+	case expr.MetaKeyNFPROTO:
+		return "meta nfproto"
+	case expr.MetaKeyL4PROTO:
+		return "meta l4proto"
+	case expr.MetaKeyIIFNAME:
+		return "iifname"
+	case expr.MetaKeyOIFNAME:
+		return "oifname"
+	case expr.MetaKeyMARK:
+		return "meta mark"
+	}
+	return fmt.Sprintf("meta %d", k)
+}
+
+func ctName(k expr.CtKey) string {
+	switch k {
+	case expr.CtKeySTATE:
+		return "ct state"
+	case expr.CtKeyMARK:
+		return "ct mark"
+	}
+	return fmt.Sprintf("ct %d", k)
+}
+
+// ctStates formats a ct state bitmask, e.g. "established,related".
+func ctStates(mask []byte) string {
+	if len(mask) != 4 {
+		return fmt.Sprintf("0x%x", mask)
+	}
+	bits := binaryutil.NativeEndian.Uint32(mask)
+	var out []string
+	for _, s := range []struct {
+		bit  uint32
+		name string
+	}{
+		{expr.CtStateBitINVALID, "invalid"},
+		{expr.CtStateBitESTABLISHED, "established"},
+		{expr.CtStateBitRELATED, "related"},
+		{expr.CtStateBitNEW, "new"},
+		{expr.CtStateBitUNTRACKED, "untracked"},
+	} {
+		if bits&s.bit != 0 {
+			out = append(out, s.name)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func payloadName(base expr.PayloadBase, offset, size uint32) string {
+	switch {
+	case base == expr.PayloadBaseNetworkHeader && offset == 12 && size == 4:
+		return "ip saddr"
+	case base == expr.PayloadBaseNetworkHeader && offset == 16 && size == 4:
+		return "ip daddr"
+	case base == expr.PayloadBaseNetworkHeader && offset == 8 && size == 16:
+		return "ip6 saddr"
+	case base == expr.PayloadBaseNetworkHeader && offset == 24 && size == 16:
+		return "ip6 daddr"
+	case base == expr.PayloadBaseTransportHeader && offset == 0 && size == 2:
+		return "th sport"
+	case base == expr.PayloadBaseTransportHeader && offset == 2 && size == 2:
+		return "th dport"
+	case base == expr.PayloadBaseTransportHeader && offset == 13 && size == 1:
+		return "tcp flags"
+	case base == expr.PayloadBaseNetworkHeader:
+		return fmt.Sprintf("@nh,%d,%d", offset*8, size*8)
+	case base == expr.PayloadBaseTransportHeader:
+		return fmt.Sprintf("@th,%d,%d", offset*8, size*8)
+	}
+	return fmt.Sprintf("@ll,%d,%d", offset*8, size*8)
+}
+
+// tcpFlags formats TCP flags, e.g. "syn|rst".
+func tcpFlags(b byte) string {
+	var out []string
+	for i, name := range []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"} {
+		if b&(1<<i) != 0 {
+			out = append(out, name)
+		}
+	}
+	return strings.Join(out, "|")
+}
+
+// cmpOpSymbol is cmpOp with == for equality, for after a mask.
+func cmpOpSymbol(op expr.CmpOp) string {
+	if op == expr.CmpOpEq {
+		return "== "
+	}
+	return cmpOp(op)
+}
+
+func cmpOp(op expr.CmpOp) string {
+	switch op {
+	case expr.CmpOpNeq:
+		return "!= "
+	case expr.CmpOpLt:
+		return "< "
+	case expr.CmpOpLte:
+		return "<= "
+	case expr.CmpOpGt:
+		return "> "
+	case expr.CmpOpGte:
+		return ">= "
+	}
+	return ""
+}
+
+// formatValue formats data compared against the field name, as a prefix if
+// the field was masked.
+func formatValue(name string, data, mask []byte) string {
+	switch {
+	case name == "meta nfproto" && len(data) == 1:
+		switch data[0] {
+		case unix.NFPROTO_IPV4:
+			return "ipv4"
+		case unix.NFPROTO_IPV6:
+			return "ipv6"
+		}
+	case name == "meta l4proto" && len(data) == 1:
+		switch data[0] {
+		case unix.IPPROTO_TCP:
+			return "tcp"
+		case unix.IPPROTO_UDP:
+			return "udp"
+		case unix.IPPROTO_SCTP:
+			return "sctp"
+		}
+	case name == "iifname" || name == "oifname":
+		return fmt.Sprintf("%q", strings.TrimRight(string(data), "\x00"))
+	case len(data) == 4 || len(data) == 16:
+		addr, _ := netip.AddrFromSlice(data)
+		if mask != nil {
+			bits, _ := net.IPMask(mask).Size()
+			return netip.PrefixFrom(addr, bits).String()
+		}
+		return addr.String()
+	case len(data) == 2:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint16(data))
+	}
+	return fmt.Sprintf("0x%x", data)
+}
+
+func verdictName(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictJump:
+		return "jump " + v.Chain
+	case expr.VerdictGoto:
+		return "goto " + v.Chain
+	}
+	return fmt.Sprintf("verdict %d", v.Kind)
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package masq
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestRenderRule(t *testing.T) {
+	for _, tt := range []struct {
+		prefix string
+		want   string
+	}{
+		{"10.99.1.0/24", `meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname != "cni0" masquerade`},
+		{"fd00:99::/64", `meta nfproto ipv6 ip6 saddr fd00:99::/64 oifname != "cni0" masquerade`},
+	} {
+		exprs := append(matchPrefix(netip.MustParsePrefix(tt.prefix), false),
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 2},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 2, Data: padIfname("cni0")},
+			&expr.Masq{},
+		)
+		if got := renderRule(exprs); got != tt.want {
+			t.Errorf("renderRule(%s) =\n  %s\nwant\n  %s", tt.prefix, got, tt.want)
+		}
+	}
+
+	exprs := append(matchPrefix(netip.MustParsePrefix("fd00:10::/48"), true), &expr.Verdict{Kind: expr.VerdictReturn})
+	if got, want := renderRule(exprs), "meta nfproto ipv6 ip6 daddr fd00:10::/48 return"; got != want {
+		t.Errorf("renderRule(non-masquerade) = %s, want %s", got, want)
+	}
+
+	_, set6 := nonMasqSets(nil)
+	exprs = append(matchSet(set6, true), &expr.Verdict{Kind: expr.VerdictReturn})
+	if got, want := renderRule(exprs), "meta nfproto ipv6 ip6 daddr @nonmasq6 return"; got != want {
+		t.Errorf("renderRule(set) = %s, want %s", got, want)
+	}
+}
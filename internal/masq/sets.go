@@ -0,0 +1,235 @@
+//go:build linux
+
+package masq
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// Interval sets of destinations that are never masqueraded, one per family
+// since a set has a single key type. Setup creates them (possibly empty) and
+// SetNonMasqueradeCIDRs replaces their elements in place.
+const (
+	nonMasqSet4 = "nonmasq4"
+	nonMasqSet6 = "nonmasq6"
+)
+
+func nonMasqSets(table *nftables.Table) (v4, v6 *nftables.Set) {
+	return &nftables.Set{Table: table, Name: nonMasqSet4, KeyType: nftables.TypeIPAddr, Interval: true},
+		&nftables.Set{Table: table, Name: nonMasqSet6, KeyType: nftables.TypeIP6Addr, Interval: true}
+}
+
+// SetNonMasqueradeCIDRs replaces the non-masquerade destinations in the
+// table Setup created, in one transaction, without touching anything else.
+// Don't call it concurrently with Setup, which may be replacing the sets.
+func SetNonMasqueradeCIDRs(cidrs []string) error {
+	v4, v6, err := parseNonMasq(cidrs)
+	if err != nil {
+		return err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables conn: %w", err)
+	}
+	set4, set6 := nonMasqSets(&nftables.Table{Family: nftables.TableFamilyINet, Name: tableName})
+	conn.FlushSet(set4)
+	conn.FlushSet(set6)
+	if err := conn.SetAddElements(set4, intervalElements(v4)); err != nil {
+		return err
+	}
+	if err := conn.SetAddElements(set6, intervalElements(v6)); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("update non-masquerade sets: %w", err)
+	}
+	logger().Info("updated non-masquerade CIDRs", "table", tableName, "nonMasqueradeCIDRs", cidrs)
+	return nil
+}
+
+// parseNonMasq parses non-masquerade CIDRs and splits them by family.
+func parseNonMasq(cidrs []string) (v4, v6 []netip.Prefix, err error) {
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("non-masquerade CIDR: %w", err)
+		}
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix.Masked())
+		} else {
+			v6 = append(v6, prefix.Masked())
+		}
+	}
+	return v4, v6, nil
+}
+
+// snatRule is a parsed SNAT: the pods (as full-length prefixes, of to's
+// family) whose egress is SNAT'd to to.
+type snatRule struct {
+	to      netip.Addr
+	sources []netip.Prefix
+}
+
+// parseSNAT parses SNAT rules, merging those to the same address, in order of
+// address. Sources of the other family are dropped: they're masqueraded.
+func parseSNAT(snats []SNAT) ([]snatRule, error) {
+	byAddr := make(map[netip.Addr]*snatRule)
+	for _, s := range snats {
+		to, err := netip.ParseAddr(s.To)
+		if err != nil {
+			return nil, fmt.Errorf("egress SNAT address: %w", err)
+		}
+		to = to.Unmap()
+		r := byAddr[to]
+		if r == nil {
+			r = &snatRule{to: to}
+			byAddr[to] = r
+		}
+		for _, src := range s.Sources {
+			addr, err := netip.ParseAddr(src)
+			if err != nil {
+				return nil, fmt.Errorf("egress SNAT source: %w", err)
+			}
+			if addr = addr.Unmap(); addr.Is4() == to.Is4() {
+				r.sources = append(r.sources, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	out := make([]snatRule, 0, len(byAddr))
+	for _, r := range byAddr {
+		out = append(out, *r)
+	}
+	slices.SortFunc(out, func(a, b snatRule) int { return a.to.Compare(b.to) })
+	return out, nil
+}
+
+// snatSetName returns the name of the set of pods SNAT'd to addr, e.g.
+// snat_203_0_113_10.
+func snatSetName(addr netip.Addr) string {
+	return "snat_" + strings.NewReplacer(".", "_", ":", "_").Replace(addr.String())
+}
+
+// addrRange is an inclusive range of addresses.
+type addrRange struct{ first, last netip.Addr }
+
+// mergeRanges returns prefixes (all of one family) as sorted ranges, with
+// overlapping and adjacent ones merged: the kernel rejects overlapping
+// intervals.
+func mergeRanges(prefixes []netip.Prefix) []addrRange {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		ranges = append(ranges, addrRange{p.Masked().Addr(), lastAddr(p)})
+	}
+	slices.SortFunc(ranges, func(a, b addrRange) int { return a.first.Compare(b.first) })
+	var out []addrRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 {
+			prev := &out[n-1]
+			if next := prev.last.Next(); !next.IsValid() || r.first.Compare(next) <= 0 {
+				prev.last = maxAddr(prev.last, r.last)
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// intervalElements returns the elements of an interval set holding prefixes:
+// for each merged range its first address, then the address after its last
+// flagged as an interval end (left out when the range runs to the end of the
+// address space). Like nft, the set starts with an interval end at the zero
+// address unless a range starts there.
+func intervalElements(prefixes []netip.Prefix) []nftables.SetElement {
+	ranges := mergeRanges(prefixes)
+	var elems []nftables.SetElement
+	if len(ranges) > 0 && !ranges[0].first.IsUnspecified() {
+		zero := netip.IPv4Unspecified()
+		if ranges[0].first.Is6() {
+			zero = netip.IPv6Unspecified()
+		}
+		elems = append(elems, nftables.SetElement{Key: zero.AsSlice(), IntervalEnd: true})
+	}
+	for _, r := range ranges {
+		elems = append(elems, nftables.SetElement{Key: r.first.AsSlice()})
+		if end := r.last.Next(); end.IsValid() {
+			elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return elems
+}
+
+// elementRanges is the inverse of intervalElements, for elements read back
+// from the kernel (in any order).
+func elementRanges(elems []nftables.SetElement) []addrRange {
+	type point struct {
+		addr netip.Addr
+		end  bool
+	}
+	points := make([]point, 0, len(elems))
+	for _, e := range elems {
+		if addr, ok := netip.AddrFromSlice(e.Key); ok {
+			points = append(points, point{addr, e.IntervalEnd})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int { return a.addr.Compare(b.addr) })
+	var out []addrRange
+	for i, p := range points {
+		if p.end {
+			continue
+		}
+		r := addrRange{first: p.addr, last: allOnes(p.addr)}
+		if i+1 < len(points) {
+			r.last = points[i+1].addr.Prev()
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// prefixes returns the fewest prefixes covering r exactly.
+func (r addrRange) prefixes() []netip.Prefix {
+	var out []netip.Prefix
+	for first := r.first; first.IsValid() && first.Compare(r.last) <= 0; {
+		bits := first.BitLen()
+		// Widen while the prefix starts at first and ends within r.
+		for bits > 0 {
+			p := netip.PrefixFrom(first, bits-1).Masked()
+			if p.Addr() != first || lastAddr(p).Compare(r.last) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(first, bits)
+		out = append(out, p)
+		first = lastAddr(p).Next()
+	}
+	return out
+}
+
+// lastAddr returns the last address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// allOnes returns the last address of addr's family.
+func allOnes(addr netip.Addr) netip.Addr {
+	return lastAddr(netip.PrefixFrom(addr, 0))
+}
+
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) >= 0 {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package masq
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestIntervalElements(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		prefixes []string
+		elems    []string // "!" marks an interval end
+		want     []string // read back as prefixes
+	}{
+		{"empty", nil, nil, nil},
+		{"one", []string{"192.168.0.0/16"}, []string{"!0.0.0.0", "192.168.0.0", "!192.169.0.0"}, []string{"192.168.0.0/16"}},
+		{"overlapping and adjacent merged", []string{"10.2.0.0/16", "10.1.0.0/16", "10.1.5.0/24", "172.16.0.0/12"},
+			[]string{"!0.0.0.0", "10.1.0.0", "!10.3.0.0", "172.16.0.0", "!172.32.0.0"},
+			[]string{"10.1.0.0/16", "10.2.0.0/16", "172.16.0.0/12"}},
+		{"from zero to the end", []string{"0.0.0.0/0"}, []string{"0.0.0.0"}, []string{"0.0.0.0/0"}},
+		{"up to the end", []string{"255.255.255.0/24"}, []string{"!0.0.0.0", "255.255.255.0"}, []string{"255.255.255.0/24"}},
+		{"ipv6", []string{"fd00:10::/48"}, []string{"!::", "fd00:10::", "!fd00:10:1::"}, []string{"fd00:10::/48"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var prefixes []netip.Prefix
+			for _, p := range tt.prefixes {
+				prefixes = append(prefixes, netip.MustParsePrefix(p))
+			}
+			elems := intervalElements(prefixes)
+			var got []string
+			for _, e := range elems {
+				addr, _ := netip.AddrFromSlice(e.Key)
+				s := addr.String()
+				if e.IntervalEnd {
+					s = "!" + s
+				}
+				got = append(got, s)
+			}
+			if !slices.Equal(got, tt.elems) {
+				t.Errorf("elements = %v, want %v", got, tt.elems)
+			}
+
+			// The kernel returns elements in its own order.
+			slices.Reverse(elems)
+			var back []string
+			for _, r := range elementRanges(elems) {
+				for _, p := range r.prefixes() {
+					back = append(back, p.String())
+				}
+			}
+			if !slices.Equal(back, tt.want) {
+				t.Errorf("read back = %v, want %v", back, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,631 @@
+//go:build linux
+
+package masq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Table is the contents of the tailscale-cni table: either the desired state
+// (desiredTable) or what is in the kernel (readTable). Setup applies the
+// difference between the two (diff) rather than recreating the table, so
+// traffic in flight never sees it missing.
+type Table struct {
+	Sets   []Set
+	Chains []Chain
+}
+
+// Set is a named address set. Interval sets hold prefixes; others hold
+// single addresses, as full-length prefixes. Prefixes are kept normalized
+// (sorted, and merged for interval sets) so sets compare with slices.Equal.
+//
+// A Map is a verdict map from addresses to the chains in Jumps, one per
+// prefix.
+type Set struct {
+	Name     string
+	KeyType  nftables.SetDatatype
+	Interval bool
+	Map      bool
+	Prefixes []netip.Prefix
+	Jumps    []string
+}
+
+// Chain is a chain and its rules in order. Base chains have a Hook.
+type Chain struct {
+	Name     string
+	Type     nftables.ChainType
+	Hook     *nftables.ChainHook
+	Priority *nftables.ChainPriority
+	Rules    []Rule
+}
+
+// Rule is one rule's expressions. Rules read from the kernel have a Handle.
+// Two rules are the same if they render the same (see renderRule).
+type Rule struct {
+	Exprs  []expr.Any
+	Handle uint64
+}
+
+func (r Rule) String() string { return renderRule(r.Exprs) }
+
+// newSet returns an address set holding prefixes, normalized.
+func newSet(name string, v6, interval bool, prefixes []netip.Prefix) Set {
+	s := Set{Name: name, KeyType: nftables.TypeIPAddr, Interval: interval}
+	if v6 {
+		s.KeyType = nftables.TypeIP6Addr
+	}
+	if !interval {
+		for _, p := range prefixes {
+			s.Prefixes = append(s.Prefixes, netip.PrefixFrom(p.Addr(), p.Addr().BitLen()))
+		}
+		slices.SortFunc(s.Prefixes, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+		s.Prefixes = slices.Compact(s.Prefixes)
+		return s
+	}
+	for _, r := range mergeRanges(prefixes) {
+		s.Prefixes = append(s.Prefixes, r.prefixes()...)
+	}
+	return s
+}
+
+// newVerdictMap returns a verdict map jumping from each address in jumps to
+// its chain, sorted by address.
+func newVerdictMap(name string, v6 bool, jumps map[netip.Addr]string) Set {
+	s := newSet(name, v6, false, nil)
+	s.Map = true
+	for _, addr := range slices.SortedFunc(maps.Keys(jumps), netip.Addr.Compare) {
+		s.Prefixes = append(s.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		s.Jumps = append(s.Jumps, jumps[addr])
+	}
+	return s
+}
+
+// kind is "map" or "set", for logs and rendering.
+func (s *Set) kind() string {
+	if s.Map {
+		return "map"
+	}
+	return "set"
+}
+
+// elements returns the set's kernel elements.
+func (s *Set) elements() []nftables.SetElement {
+	if s.Interval {
+		return intervalElements(s.Prefixes)
+	}
+	elems := make([]nftables.SetElement, 0, len(s.Prefixes))
+	for i, p := range s.Prefixes {
+		elem := nftables.SetElement{Key: p.Addr().AsSlice()}
+		if s.Map {
+			elem.VerdictData = &expr.Verdict{Kind: expr.VerdictJump, Chain: s.Jumps[i]}
+		}
+		elems = append(elems, elem)
+	}
+	return elems
+}
+
+// nft returns the set for the nftables API.
+func (s *Set) nft(table *nftables.Table) *nftables.Set {
+	set := &nftables.Set{Table: table, Name: s.Name, KeyType: s.KeyType, Interval: s.Interval}
+	if s.Map {
+		set.IsMap, set.DataType = true, nftables.TypeVerdict
+	}
+	return set
+}
+
+// sameDefinition reports whether a set of s's definition can simply have its
+// elements replaced to become o.
+func (s *Set) sameDefinition(o *Set) bool {
+	return s.KeyType.Name == o.KeyType.Name && s.Interval == o.Interval && s.Map == o.Map
+}
+
+// nft returns the chain for the nftables API.
+func (c *Chain) nft(table *nftables.Table) *nftables.Chain {
+	return &nftables.Chain{Name: c.Name, Table: table, Type: c.Type, Hooknum: c.Hook, Priority: c.Priority}
+}
+
+// sameDefinition reports whether c and o differ at most in their rules.
+func (c *Chain) sameDefinition(o *Chain) bool {
+	return c.Type == o.Type && equalPtr(c.Hook, o.Hook) && equalPtr(c.Priority, o.Priority)
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+// desiredTable returns the table Setup wants for c; see Setup for what it
+// does.
+func desiredTable(c Config) (*Table, error) {
+	t := &Table{}
+	if c.Masquerade {
+		if err := masqTable(t, c); err != nil {
+			return nil, err
+		}
+	}
+	if c.NetworkPolicy != nil {
+		policyTable(t, c.NetworkPolicy)
+	}
+	if c.ClampMSS {
+		if err := mssTable(t, c); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parsePodCIDRs parses the pod CIDRs, of which there must be at least one.
+func parsePodCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no pod CIDRs")
+	}
+	podCIDRs := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("pod CIDR: %w", err)
+		}
+		podCIDRs = append(podCIDRs, prefix.Masked())
+	}
+	return podCIDRs, nil
+}
+
+// masqTable adds the masq chain and the sets it uses to t.
+func masqTable(t *Table, c Config) error {
+	podCIDRs, err := parsePodCIDRs(c.PodCIDRs)
+	if err != nil {
+		return err
+	}
+	nonMasq4, nonMasq6, err := parseNonMasq(c.NonMasqueradeCIDRs)
+	if err != nil {
+		return err
+	}
+	snats, err := parseSNAT(c.EgressSNAT)
+	if err != nil {
+		return err
+	}
+
+	nonMasq := []Set{
+		newSet(nonMasqSet4, false, true, nonMasq4),
+		newSet(nonMasqSet6, true, true, nonMasq6),
+	}
+	t.Sets = append(t.Sets, nonMasq...)
+	chain := Chain{
+		Name:     chainName,
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityRef(99), // before NATSource (100)
+	}
+
+	// Non-masquerade destinations first, from a set per family so they can
+	// be changed without touching the rules:
+	// meta nfproto <family> <family> daddr @nonmasq<4|6> return
+	for _, set := range nonMasq {
+		chain.Rules = append(chain.Rules, Rule{
+			Exprs: append(matchSet(set.nft(nil), true), &expr.Verdict{Kind: expr.VerdictReturn}),
+		})
+	}
+
+	// Then pods with a fixed egress address, from a set per address so pods
+	// can come and go without touching the rules:
+	// meta nfproto <family> <family> saddr @snat_<addr> oifname != bridgeName oifname != tailscaleInterface snat to <addr>
+	for _, snat := range snats {
+		set := newSet(snatSetName(snat.to), snat.to.Is6(), false, snat.sources)
+		t.Sets = append(t.Sets, set)
+		nfproto := uint32(unix.NFPROTO_IPV4)
+		if snat.to.Is6() {
+			nfproto = unix.NFPROTO_IPV6
+		}
+		exprs := matchSet(set.nft(nil), false)
+		exprs = append(exprs, notOifnames(c.BridgeName, c.TailscaleInterface)...)
+		exprs = append(exprs,
+			// Load the address into reg 1 and SNAT to it
+			&expr.Immediate{Register: 1, Data: snat.to.AsSlice()},
+			&expr.NAT{Type: expr.NATTypeSourceNAT, Family: nfproto, RegAddrMin: 1},
+		)
+		chain.Rules = append(chain.Rules, Rule{Exprs: exprs})
+	}
+
+	// One rule per pod CIDR:
+	// meta nfproto <family> <family> saddr podCIDR oifname != bridgeName oifname != tailscaleInterface masquerade
+	for _, prefix := range podCIDRs {
+		exprs := matchPrefix(prefix, false)
+		exprs = append(exprs, notOifnames(c.BridgeName, c.TailscaleInterface)...)
+		exprs = append(exprs, &expr.Masq{})
+		chain.Rules = append(chain.Rules, Rule{Exprs: exprs})
+	}
+
+	t.Chains = append(t.Chains, chain)
+	return nil
+}
+
+// notOifnames returns expressions matching packets leaving by an interface
+// other than the bridge or Tailscale.
+func notOifnames(bridgeName, tailscaleInterface string) []expr.Any {
+	return []expr.Any{
+		// Load oifname into reg 2
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 2},
+		// cmp reg 2 neq bridgeName (padded to 16 bytes)
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 2,
+			Data:     padIfname(bridgeName),
+		},
+		// Load oifname into reg 2 again
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 2},
+		// cmp reg 2 neq tailscaleInterface
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 2,
+			Data:     padIfname(tailscaleInterface),
+		},
+	}
+}
+
+// readTable reads the tailscale-cni table from the kernel; nil if there is
+// none.
+func readTable(conn *nftables.Conn) (*Table, error) {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+	i := slices.IndexFunc(tables, func(t *nftables.Table) bool { return t.Name == tableName })
+	if i < 0 {
+		return nil, nil
+	}
+	table := tables[i]
+
+	var t Table
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return nil, fmt.Errorf("list sets: %w", err)
+	}
+	for _, s := range sets {
+		elems, err := conn.GetSetElements(s)
+		if err != nil {
+			return nil, fmt.Errorf("list elements of set %s: %w", s.Name, err)
+		}
+		set := Set{Name: s.Name, KeyType: s.KeyType, Interval: s.Interval}
+		switch {
+		case s.IsMap:
+			jumps := make(map[netip.Addr]string)
+			for _, e := range elems {
+				addr, ok := netip.AddrFromSlice(e.Key)
+				chain, err := jumpChain(e.Val)
+				if ok && err == nil {
+					jumps[addr] = chain
+				}
+			}
+			// The key type reads back as the data type; mapKeyTypes below
+			// restores it.
+			set = newVerdictMap(s.Name, false, jumps)
+			set.KeyType = s.KeyType
+		case s.Interval:
+			for _, r := range elementRanges(elems) {
+				set.Prefixes = append(set.Prefixes, r.prefixes()...)
+			}
+		default:
+			var prefixes []netip.Prefix
+			for _, e := range elems {
+				if addr, ok := netip.AddrFromSlice(e.Key); ok {
+					prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				}
+			}
+			set = newSet(s.Name, s.KeyType == nftables.TypeIP6Addr, false, prefixes)
+			set.KeyType = s.KeyType
+		}
+		t.Sets = append(t.Sets, set)
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("list chains: %w", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name != tableName {
+			continue
+		}
+		rules, err := conn.GetRules(table, c)
+		if err != nil {
+			return nil, fmt.Errorf("list rules of chain %s: %w", c.Name, err)
+		}
+		chain := Chain{Name: c.Name, Type: c.Type, Hook: c.Hooknum, Priority: c.Priority}
+		for _, r := range rules {
+			chain.Rules = append(chain.Rules, Rule{Exprs: r.Exprs, Handle: r.Handle})
+		}
+		t.Chains = append(t.Chains, chain)
+	}
+	mapKeyTypes(&t)
+	return &t, nil
+}
+
+// jumpChain returns the chain a verdict map element's data jumps to.
+func jumpChain(data []byte) (string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	var code int32
+	var chain string
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_VERDICT_CODE:
+			code = int32(ad.Uint32())
+		case unix.NFTA_VERDICT_CHAIN:
+			chain = ad.String()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return "", err
+	}
+	if code != unix.NFT_JUMP {
+		return "", fmt.Errorf("verdict %d is not a jump", code)
+	}
+	return chain, nil
+}
+
+// mapKeyTypes sets the key type of t's verdict maps, which the nftables
+// library reads back as their data type, from the size of the address the
+// rules look up in them.
+func mapKeyTypes(t *Table) {
+	for _, c := range t.Chains {
+		for _, r := range c.Rules {
+			var size uint32
+			for _, e := range r.Exprs {
+				switch e := e.(type) {
+				case *expr.Payload:
+					size = e.Len
+				case *expr.Lookup:
+					if s := findSet(t, e.SetName); s != nil && s.Map {
+						s.KeyType = nftables.TypeIPAddr
+						if size == 16 {
+							s.KeyType = nftables.TypeIP6Addr
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// delta is what it takes to turn the table in the kernel into the desired
+// one. apply sends it as a single batch, which the kernel commits atomically.
+type delta struct {
+	// rebuild deletes the table first and creates everything: the table is
+	// missing, or a set or chain changed definition (only across upgrades).
+	rebuild   bool
+	exists    bool  // the table is in the kernel (deleted first on rebuild)
+	addSets   []Set // with their elements
+	setElems  []Set // existing sets whose elements are replaced
+	delSets   []Set
+	addChains []Chain // added empty; their rules are in addRules
+	delChains []Chain // flushed and deleted
+	delRules  []ruleRef
+	addRules  []ruleAdd
+}
+
+type ruleRef struct {
+	chain  string
+	handle uint64
+}
+
+// ruleAdd adds a rule to chain before the rule with handle before, or at the
+// end if before is 0.
+type ruleAdd struct {
+	chain  string
+	before uint64
+	rule   Rule
+}
+
+func (d *delta) empty() bool {
+	return !d.rebuild && len(d.addSets)+len(d.setElems)+len(d.delSets)+len(d.addChains)+len(d.delChains)+len(d.delRules)+len(d.addRules) == 0
+}
+
+// diff returns the delta from actual (nil if the table doesn't exist) to
+// desired. Rules are matched by how they render: rules in both are kept, in
+// place, and new ones are inserted before the next kept rule. A kept rule
+// out of order is deleted and added again at its new position.
+func diff(actual, desired *Table) delta {
+	var d delta
+	if actual != nil {
+		d.exists = true
+		for _, s := range desired.Sets {
+			if a := findSet(actual, s.Name); a != nil && !a.sameDefinition(&s) {
+				d.rebuild = true
+			}
+		}
+		for _, c := range desired.Chains {
+			if a := findChain(actual, c.Name); a != nil && !a.sameDefinition(&c) {
+				d.rebuild = true
+			}
+		}
+	}
+	if actual == nil || d.rebuild {
+		d.rebuild = true
+		actual = &Table{}
+	}
+
+	for _, s := range desired.Sets {
+		switch a := findSet(actual, s.Name); {
+		case a == nil:
+			d.addSets = append(d.addSets, s)
+		case !slices.Equal(a.Prefixes, s.Prefixes) || !slices.Equal(a.Jumps, s.Jumps):
+			d.setElems = append(d.setElems, s)
+		}
+	}
+	for _, s := range actual.Sets {
+		if findSet(desired, s.Name) == nil {
+			d.delSets = append(d.delSets, s)
+		}
+	}
+
+	for _, c := range desired.Chains {
+		a := findChain(actual, c.Name)
+		if a == nil {
+			d.addChains = append(d.addChains, Chain{Name: c.Name, Type: c.Type, Hook: c.Hook, Priority: c.Priority})
+			a = &Chain{Name: c.Name}
+		}
+		del, add := diffRules(c.Name, a.Rules, c.Rules)
+		d.delRules = append(d.delRules, del...)
+		d.addRules = append(d.addRules, add...)
+	}
+	for _, c := range actual.Chains {
+		if findChain(desired, c.Name) == nil {
+			d.delChains = append(d.delChains, c)
+		}
+	}
+	return d
+}
+
+// diffRules returns the rules to delete from and add to a chain with actual
+// rules so it has the desired ones. Each actual rule is kept if it matches a
+// desired rule later than the last one kept.
+func diffRules(chain string, actual, desired []Rule) (del []ruleRef, add []ruleAdd) {
+	unused := make(map[string][]int) // desired indexes by rule
+	for i, r := range desired {
+		unused[r.String()] = append(unused[r.String()], i)
+	}
+	kept := make([]uint64, len(desired)) // handle kept at each desired index
+	last := -1
+	for _, r := range actual {
+		key := r.String()
+		idxs := unused[key]
+		j := slices.IndexFunc(idxs, func(i int) bool { return i > last })
+		if j < 0 {
+			del = append(del, ruleRef{chain, r.Handle})
+			continue
+		}
+		last = idxs[j]
+		kept[last] = r.Handle
+		unused[key] = idxs[j+1:]
+	}
+	for i, r := range desired {
+		if kept[i] != 0 {
+			continue
+		}
+		var before uint64
+		for _, h := range kept[i+1:] {
+			if h != 0 {
+				before = h
+				break
+			}
+		}
+		add = append(add, ruleAdd{chain, before, r})
+	}
+	return del, add
+}
+
+func findSet(t *Table, name string) *Set {
+	i := slices.IndexFunc(t.Sets, func(s Set) bool { return s.Name == name })
+	if i < 0 {
+		return nil
+	}
+	return &t.Sets[i]
+}
+
+func findChain(t *Table, name string) *Chain {
+	i := slices.IndexFunc(t.Chains, func(c Chain) bool { return c.Name == name })
+	if i < 0 {
+		return nil
+	}
+	return &t.Chains[i]
+}
+
+// apply queues d on conn, to be sent by the caller's Flush. Chains are added
+// before the verdict maps that jump to them, sets before the rules that use
+// them, and rules and map elements are removed before the sets and chains
+// they refer to.
+func (d *delta) apply(conn *nftables.Conn) error {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: tableName}
+	if d.rebuild {
+		if d.exists {
+			conn.DelTable(table)
+		}
+		conn.AddTable(table)
+	}
+	for _, c := range d.addChains {
+		conn.AddChain(c.nft(table))
+	}
+	for _, s := range d.addSets {
+		if err := conn.AddSet(s.nft(table), s.elements()); err != nil {
+			return fmt.Errorf("add set %s: %w", s.Name, err)
+		}
+	}
+	for _, s := range d.setElems {
+		set := s.nft(table)
+		conn.FlushSet(set)
+		if err := conn.SetAddElements(set, s.elements()); err != nil {
+			return fmt.Errorf("add elements to set %s: %w", s.Name, err)
+		}
+	}
+	for _, r := range d.delRules {
+		if err := conn.DelRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: r.chain, Table: table}, Handle: r.handle}); err != nil {
+			return fmt.Errorf("delete rule %d from chain %s: %w", r.handle, r.chain, err)
+		}
+	}
+	for _, r := range d.addRules {
+		rule := &nftables.Rule{Table: table, Chain: &nftables.Chain{Name: r.chain, Table: table}, Exprs: r.rule.Exprs}
+		if r.before != 0 {
+			rule.Position = r.before
+			conn.InsertRule(rule)
+		} else {
+			conn.AddRule(rule)
+		}
+	}
+	for _, c := range d.delChains {
+		conn.FlushChain(c.nft(table))
+	}
+	for _, s := range d.delSets {
+		conn.FlushSet(s.nft(table))
+	}
+	for _, c := range d.delChains {
+		conn.DelChain(c.nft(table))
+	}
+	for _, s := range d.delSets {
+		conn.DelSet(s.nft(table))
+	}
+	return nil
+}
+
+// changes describes d, one line per change, for logs and tests.
+func (d *delta) changes() []string {
+	var out []string
+	if d.rebuild {
+		out = append(out, "create table")
+	}
+	for _, c := range d.addChains {
+		out = append(out, "add chain "+c.Name)
+	}
+	for _, s := range d.addSets {
+		out = append(out, "add "+s.kind()+" "+s.Name)
+	}
+	for _, s := range d.setElems {
+		out = append(out, "update "+s.kind()+" "+s.Name)
+	}
+	for _, r := range d.delRules {
+		out = append(out, fmt.Sprintf("delete rule %s handle %d", r.chain, r.handle))
+	}
+	for _, r := range d.addRules {
+		pos := ""
+		if r.before != 0 {
+			pos = fmt.Sprintf(" before %d", r.before)
+		}
+		out = append(out, fmt.Sprintf("add rule %s%s: %s", r.chain, pos, r.rule))
+	}
+	for _, c := range d.delChains {
+		out = append(out, "delete chain "+c.Name)
+	}
+	for _, s := range d.delSets {
+		out = append(out, "delete "+s.kind()+" "+s.Name)
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+//go:build linux
+
+package masq
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func mustDesiredTable(t *testing.T, c Config) *Table {
+	t.Helper()
+	if c.BridgeName == "" {
+		c.BridgeName, c.TailscaleInterface = "cni0", "tailscale0"
+	}
+	table, err := desiredTable(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestDesiredTable(t *testing.T) {
+	got := renderTable(mustDesiredTable(t, Config{
+		Masquerade:         true,
+		PodCIDRs:           []string{"10.99.1.0/24", "fd00:99:0:1::/64"},
+		NonMasqueradeCIDRs: []string{"192.168.1.0/24", "192.168.0.0/24"},
+		EgressSNAT: []SNAT{
+			{To: "203.0.113.10", Sources: []string{"10.99.1.7", "10.99.1.5", "fd00:99:0:1::5"}},
+			{To: "2001:db8::10", Sources: []string{"fd00:99:0:1::5"}},
+			{To: "203.0.113.10", Sources: []string{"10.99.1.9"}},
+		},
+	}))
+	want := `table inet tailscale-cni {
+	set nonmasq4 {
+		type ipv4_addr; flags interval;
+		elements = { 192.168.0.0/23 }
+	}
+	set nonmasq6 {
+		type ipv6_addr; flags interval;
+	}
+	set snat_203_0_113_10 {
+		type ipv4_addr;
+		elements = { 10.99.1.5, 10.99.1.7, 10.99.1.9 }
+	}
+	set snat_2001_db8__10 {
+		type ipv6_addr;
+		elements = { fd00:99:0:1::5 }
+	}
+	chain masq {
+		type nat hook postrouting priority 99;
+		meta nfproto ipv4 ip daddr @nonmasq4 return
+		meta nfproto ipv6 ip6 daddr @nonmasq6 return
+		meta nfproto ipv4 ip saddr @snat_203_0_113_10 oifname != "cni0" oifname != "tailscale0" snat to 203.0.113.10
+		meta nfproto ipv6 ip6 saddr @snat_2001_db8__10 oifname != "cni0" oifname != "tailscale0" snat to 2001:db8::10
+		meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname != "cni0" oifname != "tailscale0" masquerade
+		meta nfproto ipv6 ip6 saddr fd00:99:0:1::/64 oifname != "cni0" oifname != "tailscale0" masquerade
+	}
+}
+`
+	if got != want {
+		t.Errorf("desiredTable =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// inKernel returns a copy of t as readTable would return it once applied,
+// with rule handles numbered from 1.
+func inKernel(t *Table) *Table {
+	out := &Table{Sets: slices.Clone(t.Sets)}
+	handle := uint64(0)
+	for _, c := range t.Chains {
+		c.Rules = slices.Clone(c.Rules)
+		for i := range c.Rules {
+			handle++
+			c.Rules[i].Handle = handle
+		}
+		out.Chains = append(out.Chains, c)
+	}
+	return out
+}
+
+func TestDiff(t *testing.T) {
+	pods := []string{"10.99.1.0/24", "fd00:99:0:1::/64"}
+	current := inKernel(mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods}))
+	snat := []SNAT{{To: "203.0.113.10", Sources: []string{"10.99.1.5"}}}
+	withSNAT := inKernel(mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods, EgressSNAT: snat}))
+
+	for _, tt := range []struct {
+		name    string
+		actual  *Table
+		desired *Table
+		want    []string
+	}{
+		{"unchanged", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods}), nil},
+		{"no table", nil, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods[:1]}), []string{
+			"create table",
+			"add chain masq",
+			"add set nonmasq4",
+			"add set nonmasq6",
+			"add rule masq: meta nfproto ipv4 ip daddr @nonmasq4 return",
+			"add rule masq: meta nfproto ipv6 ip6 daddr @nonmasq6 return",
+			`add rule masq: meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname != "cni0" oifname != "tailscale0" masquerade`,
+		}},
+		{"non-masquerade CIDRs", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods, NonMasqueradeCIDRs: []string{"192.168.0.0/16"}}), []string{
+			"update set nonmasq4",
+		}},
+		{"pod CIDR changed", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: []string{"10.99.2.0/24", "fd00:99:0:1::/64"}}), []string{
+			"delete rule masq handle 3",
+			`add rule masq before 4: meta nfproto ipv4 ip saddr 10.99.2.0/24 oifname != "cni0" oifname != "tailscale0" masquerade`,
+		}},
+		{"pod CIDR added", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: append(pods, "10.99.3.0/24")}), []string{
+			`add rule masq: meta nfproto ipv4 ip saddr 10.99.3.0/24 oifname != "cni0" oifname != "tailscale0" masquerade`,
+		}},
+		{"rules out of order", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: []string{pods[1], pods[0]}}), []string{
+			"delete rule masq handle 4",
+			`add rule masq before 3: meta nfproto ipv6 ip6 saddr fd00:99:0:1::/64 oifname != "cni0" oifname != "tailscale0" masquerade`,
+		}},
+		{"egress SNAT added", current, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods, EgressSNAT: snat}), []string{
+			"add set snat_203_0_113_10",
+			`add rule masq before 3: meta nfproto ipv4 ip saddr @snat_203_0_113_10 oifname != "cni0" oifname != "tailscale0" snat to 203.0.113.10`,
+		}},
+		{"egress SNAT pods changed", withSNAT, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods, EgressSNAT: []SNAT{{To: "203.0.113.10", Sources: []string{"10.99.1.5", "10.99.1.6"}}}}), []string{
+			"update set snat_203_0_113_10",
+		}},
+		{"egress SNAT removed", withSNAT, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods}), []string{
+			"delete rule masq handle 3",
+			"delete set snat_203_0_113_10",
+		}},
+		{"stale chain and set", &Table{
+			Sets:   append(slices.Clone(current.Sets), newSet("old", false, false, nil)),
+			Chains: append(slices.Clone(current.Chains), Chain{Name: "old", Rules: []Rule{{Handle: 10}}}),
+		}, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods}), []string{
+			"delete chain old",
+			"delete set old",
+		}},
+		{"chain definition changed", &Table{
+			Sets:   current.Sets,
+			Chains: []Chain{{Name: chainName, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}},
+		}, mustDesiredTable(t, Config{Masquerade: true, PodCIDRs: pods[:1]}), []string{
+			"create table",
+			"add chain masq",
+			"add set nonmasq4",
+			"add set nonmasq6",
+			"add rule masq: meta nfproto ipv4 ip daddr @nonmasq4 return",
+			"add rule masq: meta nfproto ipv6 ip6 daddr @nonmasq6 return",
+			`add rule masq: meta nfproto ipv4 ip saddr 10.99.1.0/24 oifname != "cni0" oifname != "tailscale0" masquerade`,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diff(tt.actual, tt.desired)
+			if got := d.changes(); !slices.Equal(got, tt.want) {
+				t.Errorf("changes:\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+			if d.empty() != (len(tt.want) == 0) {
+				t.Errorf("empty() = %v with %d changes", d.empty(), len(tt.want))
+			}
+		})
+	}
+}
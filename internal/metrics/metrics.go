@@ -0,0 +1,105 @@
+// Package metrics defines the Prometheus metrics exported by tailscale-cni.
+// Metrics are registered on Registry rather than the global default registry
+// so the exported set is exactly what is defined here (plus Go runtime stats).
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "tailscale_cni"
+
+// Registry holds every tailscale-cni metric.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Reconciler label values.
+const (
+	ReconcilerNode          = "node"           // controller.Reconciler: our node's CNI config, advertised routes and masq
+	ReconcilerOtherRoutes   = "other_routes"   // controller.OtherRoutesReconciler: routes to other nodes' pod CIDRs
+	ReconcilerEgressSNAT    = "egress_snat"    // controller.EgressSNATReconciler: fixed egress addresses of our node's pods
+	ReconcilerNetworkPolicy = "network_policy" // controller.NetworkPolicyReconciler: NetworkPolicy of our node's pods
+)
+
+// ReconcileTotal counts reconciler runs.
+var ReconcileTotal = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "reconcile_total",
+	Help:      "Number of reconciles run, by reconciler.",
+}, []string{"reconciler"})
+
+// ReconcileErrors counts reconciler runs that failed.
+var ReconcileErrors = factory.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "reconcile_errors_total",
+	Help:      "Number of reconciles that returned an error, by reconciler.",
+}, []string{"reconciler"})
+
+// ReconcileDuration observes how long reconciler runs take.
+var ReconcileDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "reconcile_duration_seconds",
+	Help:      "Time taken by reconciles, by reconciler.",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+}, []string{"reconciler"})
+
+// ManagedRoutes is the number of host routes routes.Manager has installed.
+var ManagedRoutes = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "managed_routes",
+	Help:      "Number of host routes to other nodes' pod CIDRs installed by tailscale-cni.",
+})
+
+// AdvertisedRoutes is the number of our pod CIDRs advertised via Tailscale.
+var AdvertisedRoutes = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "advertised_routes",
+	Help:      "Number of this node's pod CIDRs advertised via Tailscale.",
+})
+
+// ApprovedRoutes is the number of our advertised pod CIDRs approved in the tailnet.
+var ApprovedRoutes = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "approved_routes",
+	Help:      "Number of this node's advertised pod CIDRs approved in the tailnet.",
+})
+
+// UnapprovedRoutes is the number of our pod CIDRs advertised via Tailscale
+// but not (yet) approved in the tailnet.
+var UnapprovedRoutes = factory.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "unapproved_routes",
+	Help:      "Number of this node's pod CIDRs advertised via Tailscale but not approved in the tailnet.",
+})
+
+// MasqSetupFailures counts failed nftables masquerade setups.
+var MasqSetupFailures = factory.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "masq_setup_failures_total",
+	Help:      "Number of times setting up the nftables masquerade table failed.",
+})
+
+// PodCIDR is 1 for each pod CIDR currently applied on this node.
+var PodCIDR = factory.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "pod_cidr",
+	Help:      "Pod CIDRs applied on this node (always 1), labelled by cidr.",
+}, []string{"cidr"})
+
+// SetPodCIDRs replaces the PodCIDR series with one per cidr.
+func SetPodCIDRs(cidrs []string) {
+	PodCIDR.Reset()
+	for _, c := range cidrs {
+		PodCIDR.WithLabelValues(c).Set(1)
+	}
+}
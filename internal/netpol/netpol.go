@@ -0,0 +1,396 @@
+// Package netpol compiles Kubernetes NetworkPolicies into what each of this
+// node's pods may receive and send: for every pod a policy isolates, the
+// peers and ports it allows. The masq package turns the result into nftables
+// rules on the forward hook.
+//
+// Semantics follow the NetworkPolicy API: a pod is isolated in a direction
+// once any policy of that type selects it, and then only traffic some
+// selecting policy allows in that direction is let through. Replies to
+// allowed connections are always let through (conntrack). Pods on the host
+// network are neither isolated nor matched as peers.
+package netpol
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Protocol is an IP protocol number.
+type Protocol uint8
+
+// Protocols NetworkPolicy ports can name.
+const (
+	TCP  Protocol = 6
+	UDP  Protocol = 17
+	SCTP Protocol = 132
+)
+
+// Port is a destination port range of a protocol. Port 0 is every port.
+type Port struct {
+	Protocol Protocol
+	Port     uint16
+	EndPort  uint16 // 0: just Port
+}
+
+// Allow lets traffic from (ingress) or to (egress) any of Peers through to
+// any of Ports. Nil Peers or Ports mean any.
+type Allow struct {
+	Peers []netip.Prefix
+	Ports []Port
+}
+
+// Pod is a pod on this node isolated in one direction. Allow is empty when
+// nothing is allowed.
+type Pod struct {
+	Namespace string
+	Name      string
+	IPs       []netip.Addr
+	Allow     []Allow
+}
+
+// Policy is the compiled NetworkPolicy of a node's pods, sorted by namespace
+// and name.
+type Policy struct {
+	Ingress []Pod
+	Egress  []Pod
+}
+
+type direction int
+
+const (
+	ingress direction = iota
+	egress
+)
+
+// Compile returns the Policy for the pods on nodeName. pods are all pods in
+// the cluster, as any of them may be a peer. Parts of a policy that are
+// invalid (e.g. a bad selector or CIDR) allow nothing and are returned as
+// errors, so mistakes fail closed.
+func Compile(nodeName string, policies []*networkingv1.NetworkPolicy, namespaces []*corev1.Namespace, pods []*corev1.Pod) (*Policy, []error) {
+	c := &compiler{nsLabels: make(map[string]labels.Set), resolved: make(map[string]*resolved)}
+	for _, ns := range namespaces {
+		c.nsLabels[ns.Name] = ns.Labels
+	}
+	for _, pod := range pods {
+		if ips := podIPs(pod); len(ips) > 0 {
+			c.pods = append(c.pods, peerPod{pod, ips})
+		}
+	}
+	slices.SortFunc(c.pods, func(a, b peerPod) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	policies = slices.Clone(policies)
+	slices.SortFunc(policies, func(a, b *networkingv1.NetworkPolicy) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+
+	out := &Policy{}
+	for _, pod := range c.pods {
+		if pod.Spec.NodeName != nodeName {
+			continue
+		}
+		for _, dir := range []direction{ingress, egress} {
+			isolated := false
+			var allow []Allow
+			for _, p := range policies {
+				if p.Namespace != pod.Namespace || !hasType(p, dir) || !c.selects(p, pod.Pod) {
+					continue
+				}
+				isolated = true
+				allow = append(allow, c.allow(p, dir, pod)...)
+			}
+			if !isolated {
+				continue
+			}
+			compiled := Pod{Namespace: pod.Namespace, Name: pod.Name, IPs: pod.ips, Allow: allow}
+			if dir == ingress {
+				out.Ingress = append(out.Ingress, compiled)
+			} else {
+				out.Egress = append(out.Egress, compiled)
+			}
+		}
+	}
+	return out, c.errs
+}
+
+type peerPod struct {
+	*corev1.Pod
+	ips []netip.Addr
+}
+
+type compiler struct {
+	nsLabels map[string]labels.Set
+	pods     []peerPod // with IPs, not on the host network
+	resolved map[string]*resolved
+	errs     []error
+}
+
+func (c *compiler) errorf(p *networkingv1.NetworkPolicy, format string, args ...any) {
+	err := fmt.Errorf("NetworkPolicy %s/%s: %s", p.Namespace, p.Name, fmt.Sprintf(format, args...))
+	if !slices.ContainsFunc(c.errs, func(e error) bool { return e.Error() == err.Error() }) {
+		c.errs = append(c.errs, err)
+	}
+}
+
+// selects reports whether p's pod selector matches pod.
+func (c *compiler) selects(p *networkingv1.NetworkPolicy, pod *corev1.Pod) bool {
+	sel, err := metav1.LabelSelectorAsSelector(&p.Spec.PodSelector)
+	if err != nil {
+		// Isolate the namespace's pods rather than leave them open.
+		c.errorf(p, "spec.podSelector: %v", err)
+		return true
+	}
+	return sel.Matches(labels.Set(pod.Labels))
+}
+
+// allow returns what p's rules in dir allow for pod.
+func (c *compiler) allow(p *networkingv1.NetworkPolicy, dir direction, pod peerPod) []Allow {
+	type rule struct {
+		peers []networkingv1.NetworkPolicyPeer
+		ports []networkingv1.NetworkPolicyPort
+	}
+	var rules []rule
+	field := "spec.ingress"
+	if dir == ingress {
+		for _, r := range p.Spec.Ingress {
+			rules = append(rules, rule{r.From, r.Ports})
+		}
+	} else {
+		field = "spec.egress"
+		for _, r := range p.Spec.Egress {
+			rules = append(rules, rule{r.To, r.Ports})
+		}
+	}
+
+	var out []Allow
+	for i, r := range rules {
+		path := fmt.Sprintf("%s[%d]", field, i)
+		var peers *resolved
+		if len(r.peers) > 0 {
+			peers = c.resolve(p, path, r.peers)
+		}
+		// Named ports are the destination pod's, which for egress differ
+		// between peers.
+		var ports []Port
+		var named []namedPortRef
+		for j, np := range r.ports {
+			proto, err := protocol(np.Protocol)
+			if err != nil {
+				c.errorf(p, "%s.ports[%d]: %v", path, j, err)
+				continue
+			}
+			switch {
+			case np.Port == nil:
+				ports = append(ports, Port{Protocol: proto})
+			case np.Port.Type == intstr.String && dir == ingress:
+				if n, ok := namedPort(pod.Pod, np.Port.StrVal, proto); ok {
+					ports = append(ports, Port{Protocol: proto, Port: n})
+				}
+			case np.Port.Type == intstr.String:
+				named = append(named, namedPortRef{np.Port.StrVal, proto})
+			default:
+				port := Port{Protocol: proto, Port: uint16(np.Port.IntVal)}
+				if np.EndPort != nil {
+					port.EndPort = uint16(*np.EndPort)
+				}
+				ports = append(ports, port)
+			}
+		}
+
+		if len(r.ports) == 0 || len(ports) > 0 {
+			switch {
+			case peers == nil:
+				out = append(out, Allow{Ports: ports})
+			case len(peers.prefixes) > 0: // else no peer matches (yet)
+				out = append(out, Allow{Peers: peers.prefixes, Ports: ports})
+			}
+		}
+
+		peerPods := c.pods
+		if peers != nil {
+			peerPods = peers.pods
+		}
+		for _, ref := range named {
+			byPort := map[uint16][]peerPod{}
+			for _, peer := range peerPods {
+				if n, ok := namedPort(peer.Pod, ref.name, ref.proto); ok {
+					byPort[n] = append(byPort[n], peer)
+				}
+			}
+			for _, n := range slices.Sorted(maps.Keys(byPort)) {
+				out = append(out, Allow{Peers: prefixes(nil, byPort[n]), Ports: []Port{{Protocol: ref.proto, Port: n}}})
+			}
+		}
+	}
+	return out
+}
+
+type namedPortRef struct {
+	name  string
+	proto Protocol
+}
+
+// resolved is what a rule's peers select.
+type resolved struct {
+	pods     []peerPod
+	prefixes []netip.Prefix // ipBlocks and pods' IPs
+}
+
+// resolve returns what a rule's peers select, once per rule as it's the same
+// for every pod the policy selects.
+func (c *compiler) resolve(p *networkingv1.NetworkPolicy, path string, peers []networkingv1.NetworkPolicyPeer) *resolved {
+	key := p.Namespace + "/" + p.Name + " " + path
+	if r, ok := c.resolved[key]; ok {
+		return r
+	}
+	blocks, pods := c.peers(p, path, peers)
+	r := &resolved{pods: pods, prefixes: prefixes(blocks, pods)}
+	c.resolved[key] = r
+	return r
+}
+
+// peers returns the ipBlocks and pods selected by a rule's peers.
+func (c *compiler) peers(p *networkingv1.NetworkPolicy, path string, peers []networkingv1.NetworkPolicyPeer) ([]netip.Prefix, []peerPod) {
+	var blocks []netip.Prefix
+	var pods []peerPod
+	for i, peer := range peers {
+		path := fmt.Sprintf("%s.peers[%d]", path, i)
+		if peer.IPBlock != nil {
+			b, err := ipBlock(peer.IPBlock)
+			if err != nil {
+				c.errorf(p, "%s.ipBlock: %v", path, err)
+				continue
+			}
+			blocks = append(blocks, b...)
+			continue
+		}
+		podSel, nsSel := labels.Everything(), labels.Nothing()
+		var err error
+		if peer.PodSelector != nil {
+			if podSel, err = metav1.LabelSelectorAsSelector(peer.PodSelector); err != nil {
+				c.errorf(p, "%s.podSelector: %v", path, err)
+				continue
+			}
+		}
+		if peer.NamespaceSelector != nil {
+			if nsSel, err = metav1.LabelSelectorAsSelector(peer.NamespaceSelector); err != nil {
+				c.errorf(p, "%s.namespaceSelector: %v", path, err)
+				continue
+			}
+		}
+		for _, pod := range c.pods {
+			inNamespace := pod.Namespace == p.Namespace
+			if peer.NamespaceSelector != nil {
+				inNamespace = nsSel.Matches(c.nsLabels[pod.Namespace])
+			}
+			if inNamespace && podSel.Matches(labels.Set(pod.Labels)) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return blocks, pods
+}
+
+// hasType reports whether p applies in dir. Without policyTypes a policy is
+// an ingress policy, and also an egress one if it has egress rules.
+func hasType(p *networkingv1.NetworkPolicy, dir direction) bool {
+	want := networkingv1.PolicyTypeIngress
+	if dir == egress {
+		want = networkingv1.PolicyTypeEgress
+	}
+	if len(p.Spec.PolicyTypes) == 0 {
+		return dir == ingress || len(p.Spec.Egress) > 0
+	}
+	return slices.Contains(p.Spec.PolicyTypes, want)
+}
+
+// podIPs returns the IPs of a pod that can be isolated or be a peer: not on
+// the host network, and not finished (its IPs may be reused).
+func podIPs(pod *corev1.Pod) []netip.Addr {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+	var ips []netip.Addr
+	for _, ip := range pod.Status.PodIPs {
+		if addr, err := netip.ParseAddr(ip.IP); err == nil {
+			ips = append(ips, addr.Unmap())
+		}
+	}
+	return ips
+}
+
+// protocol returns the number of a NetworkPolicy or container port protocol,
+// TCP if unset.
+func protocol(p *corev1.Protocol) (Protocol, error) {
+	if p == nil {
+		return TCP, nil
+	}
+	switch *p {
+	case corev1.ProtocolTCP, "": // container ports default to TCP
+		return TCP, nil
+	case corev1.ProtocolUDP:
+		return UDP, nil
+	case corev1.ProtocolSCTP:
+		return SCTP, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %q", *p)
+}
+
+// namedPort resolves a named container port of pod.
+func namedPort(pod *corev1.Pod, name string, proto Protocol) (uint16, bool) {
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		for _, cp := range c.Ports {
+			if p, err := protocol(&cp.Protocol); err == nil && p == proto && cp.Name == name {
+				return uint16(cp.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ipBlock returns the prefixes covering b's CIDR except its exceptions.
+func ipBlock(b *networkingv1.IPBlock) ([]netip.Prefix, error) {
+	cidr, err := netip.ParsePrefix(b.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	var s netipx.IPSetBuilder
+	s.AddPrefix(cidr.Masked())
+	for _, e := range b.Except {
+		except, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, err
+		}
+		s.RemovePrefix(except.Masked())
+	}
+	set, err := s.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	return set.Prefixes(), nil
+}
+
+// prefixes returns blocks and the IPs of pods as the fewest sorted prefixes.
+func prefixes(blocks []netip.Prefix, pods []peerPod) []netip.Prefix {
+	var s netipx.IPSetBuilder
+	for _, b := range blocks {
+		s.AddPrefix(b)
+	}
+	for _, pod := range pods {
+		for _, ip := range pod.ips {
+			s.Add(ip)
+		}
+	}
+	set, _ := s.IPSet()
+	return set.Prefixes()
+}
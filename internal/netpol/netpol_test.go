@@ -0,0 +1,170 @@
+package netpol
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestCompile(t *testing.T) {
+	ns := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	pod := func(namespace, name, node string, labels map[string]string, ips ...string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+		for _, ip := range ips {
+			p.Status.PodIPs = append(p.Status.PodIPs, corev1.PodIP{IP: ip})
+		}
+		return p
+	}
+	selector := func(labels map[string]string) *metav1.LabelSelector {
+		return &metav1.LabelSelector{MatchLabels: labels}
+	}
+	port := func(p intstr.IntOrString) networkingv1.NetworkPolicyPort {
+		return networkingv1.NetworkPolicyPort{Port: &p}
+	}
+	udp := corev1.ProtocolUDP
+	endPort := int32(9100)
+
+	web := pod("shop", "web", "node-a", map[string]string{"app": "web"}, "10.99.1.2", "fd00:99:0:1::2")
+	web.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+	db := pod("shop", "db", "node-a", map[string]string{"app": "db"}, "10.99.1.3")
+	db.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "sql", ContainerPort: 5432}}}}
+	remoteDB := pod("shop", "db-replica", "node-b", map[string]string{"app": "db"}, "10.99.2.3")
+	remoteDB.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "sql", ContainerPort: 5433}}}}
+	monitor := pod("ops", "prometheus", "node-b", map[string]string{"app": "prometheus"}, "10.99.2.9")
+	hostNetwork := pod("shop", "agent", "node-a", map[string]string{"app": "web"}, "192.168.1.10")
+	hostNetwork.Spec.HostNetwork = true
+	done := pod("shop", "job", "node-a", map[string]string{"app": "db"}, "10.99.1.4")
+	done.Status.Phase = corev1.PodSucceeded
+
+	policies := []*networkingv1.NetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: *selector(map[string]string{"app": "web"}),
+				Ingress: []networkingv1.NetworkPolicyIngressRule{
+					{Ports: []networkingv1.NetworkPolicyPort{port(intstr.FromString("http"))}},
+					{
+						From:  []networkingv1.NetworkPolicyPeer{{NamespaceSelector: selector(map[string]string{"team": "ops"})}},
+						Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: ptr(intstr.FromInt32(9000)), EndPort: &endPort}},
+					},
+				},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					To:    []networkingv1.NetworkPolicyPeer{{PodSelector: selector(map[string]string{"app": "db"})}},
+					Ports: []networkingv1.NetworkPolicyPort{port(intstr.FromString("sql"))},
+				}, {
+					To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "203.0.113.0/24", Except: []string{"203.0.113.0/26", "203.0.113.128/26"}}}},
+				}},
+			},
+		},
+		{
+			// Isolates every pod in shop for ingress; allows nothing.
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "default-deny"},
+			Spec:       networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "db"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: *selector(map[string]string{"app": "db"}),
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{PodSelector: selector(map[string]string{"app": "web"})}},
+				}, {
+					// No such pods yet.
+					From: []networkingv1.NetworkPolicyPeer{{PodSelector: selector(map[string]string{"app": "backup"})}},
+				}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "broken"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: *selector(map[string]string{"app": "db"}),
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/33"}}},
+				}},
+			},
+		},
+		{
+			// Another namespace's pods aren't selected.
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ops", Name: "deny"},
+			Spec:       networkingv1.NetworkPolicySpec{},
+		},
+	}
+
+	got, errs := Compile("node-a", policies,
+		[]*corev1.Namespace{ns("shop", nil), ns("ops", map[string]string{"team": "ops"})},
+		[]*corev1.Pod{web, db, remoteDB, monitor, hostNetwork, done},
+	)
+	want := &Policy{
+		Ingress: []Pod{
+			{Namespace: "shop", Name: "db", IPs: addrs("10.99.1.3"), Allow: []Allow{
+				{Peers: mustPrefixes("10.99.1.2/32", "fd00:99:0:1::2/128")},
+			}},
+			{Namespace: "shop", Name: "web", IPs: addrs("10.99.1.2", "fd00:99:0:1::2"), Allow: []Allow{
+				{Ports: []Port{{Protocol: TCP, Port: 8080}}},
+				{Peers: mustPrefixes("10.99.2.9/32"), Ports: []Port{{Protocol: UDP, Port: 9000, EndPort: 9100}}},
+			}},
+		},
+		Egress: []Pod{
+			{Namespace: "shop", Name: "web", IPs: addrs("10.99.1.2", "fd00:99:0:1::2"), Allow: []Allow{
+				{Peers: mustPrefixes("10.99.1.3/32"), Ports: []Port{{Protocol: TCP, Port: 5432}}},
+				{Peers: mustPrefixes("10.99.2.3/32"), Ports: []Port{{Protocol: TCP, Port: 5433}}},
+				{Peers: mustPrefixes("203.0.113.64/26", "203.0.113.192/26")},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Compile =\n%+v\nwant\n%+v", got, want)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "NetworkPolicy shop/broken: spec.ingress[0].peers[0].ipBlock") {
+		t.Errorf("errors = %v, want just shop/broken's ipBlock", errs)
+	}
+}
+
+func TestHasType(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		spec            networkingv1.NetworkPolicySpec
+		ingress, egress bool
+	}{
+		{"default", networkingv1.NetworkPolicySpec{}, true, false},
+		{"egress rules", networkingv1.NetworkPolicySpec{Egress: []networkingv1.NetworkPolicyEgressRule{{}}}, true, true},
+		{"egress only", networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}}, false, true},
+	} {
+		p := &networkingv1.NetworkPolicy{Spec: tt.spec}
+		if got := hasType(p, ingress); got != tt.ingress {
+			t.Errorf("%s: ingress = %v, want %v", tt.name, got, tt.ingress)
+		}
+		if got := hasType(p, egress); got != tt.egress {
+			t.Errorf("%s: egress = %v, want %v", tt.name, got, tt.egress)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func addrs(s ...string) []netip.Addr {
+	var out []netip.Addr
+	for _, a := range s {
+		out = append(out, netip.MustParseAddr(a))
+	}
+	return out
+}
+
+func mustPrefixes(s ...string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range s {
+		out = append(out, netip.MustParsePrefix(p))
+	}
+	return out
+}
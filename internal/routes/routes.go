@@ -1,34 +1,121 @@
 // Package routes manages system routes for other nodes' pod CIDRs via their
-// Tailscale IP. On Linux it uses netlink; on other platforms it no-ops.
+// Tailscale IP, and the policy rules that send traffic to them when a
+// dedicated routing table is used. On Linux it uses netlink; on other
+// platforms it no-ops.
 package routes
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+	"github.com/lstoll/tailscale-cni/internal/metrics"
 )
 
+func logger() *slog.Logger { return logging.Component("routes") }
+
+// RouteProtocol is the rtm_protocol value set on every route and rule we add,
+// so ours can be told apart from the kernel's, Tailscale's and other daemons'
+// (e.g. `ip route show table all proto 212`).
+const RouteProtocol = 212
+
+// MainTable is the kernel's main routing table, used when no table is set.
+const MainTable = 254
+
+// Rule is a policy routing rule (`ip rule`) that looks up the manager's table
+// for matching traffic. Src and Dst are CIDRs; either may be empty to match
+// any address, but not both. Rules are comparable so they can key a set.
+type Rule struct {
+	Src      string
+	Dst      string
+	Priority int
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("priority %d", r.Priority)
+	if r.Src != "" {
+		s += " from " + r.Src
+	}
+	if r.Dst != "" {
+		s += " to " + r.Dst
+	}
+	return s
+}
+
 // Manager adds and removes routes so traffic to other nodes' pod CIDRs goes
 // via the Tailscale IP of that node.
 type Manager struct {
-	mu              sync.Mutex
-	routes          map[string]string // cidr -> viaIP (routes we've added)
-	tailscaleIface  string            // interface name for LinkIndex (e.g. tailscale0)
+	mu             sync.Mutex
+	routes         map[string]string // cidr -> viaIP (routes we've added)
+	rules          map[Rule]bool     // rules we've added
+	tailscaleIface string            // interface name for LinkIndex (e.g. tailscale0)
+	table          int               // routing table for routes and rules
+	onLink         bool              // add routes with the onlink flag
+	adopted        bool              // routes and rules left by a previous process have been adopted
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithOnLinkGateways adds routes with the onlink flag, so the gateway need not
+// be on a subnet of the output interface. Needed when gateways are peers'
+// Tailscale IPs rather than our own (tailscale0 only has our /32 and /128).
+// Requires a tailscaleIface.
+func WithOnLinkGateways() Option {
+	return func(m *Manager) { m.onLink = true }
+}
+
+// WithTable adds routes to routing table id instead of the main table, so
+// they don't compete with Tailscale's table 52 or other daemons' routes.
+// Traffic only reaches the table through rules installed with EnsureRules.
+// 0 means the main table.
+func WithTable(id int) Option {
+	return func(m *Manager) {
+		if id != 0 {
+			m.table = id
+		}
+	}
 }
 
 // NewManager returns a route manager. tailscaleIface is the Tailscale interface
 // name (e.g. "tailscale0"); routes are added with that interface so the kernel
 // can reach the gateway. Use "" to not set an output interface.
-func NewManager(tailscaleIface string) *Manager {
-	return &Manager{routes: make(map[string]string), tailscaleIface: tailscaleIface}
+func NewManager(tailscaleIface string, opts ...Option) *Manager {
+	m := &Manager{
+		routes:         make(map[string]string),
+		rules:          make(map[Rule]bool),
+		tailscaleIface: tailscaleIface,
+		table:          MainTable,
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	return m
 }
 
-// EnsureRoutes makes the system route table match desired: desired[cidr] = viaIP.
+// ErrGatewayUnreachable is returned (wrapped) by EnsureRoutes when some routes
+// were skipped because their gateway is not reachable yet (e.g. tailscale0 has
+// no address). All other routes were applied; callers should retry later.
+var ErrGatewayUnreachable = errors.New("gateway unreachable")
+
+// EnsureRoutes makes the system route table match desired: desired[cidr] = viaIP,
+// or "" for a route straight out the Tailscale interface with no gateway.
+// IPv4 and IPv6 CIDRs may be mixed; each viaIP must be of the same family as its cidr.
 // It adds missing routes and deletes routes we previously added that are no longer in desired.
+// The first call also deletes routes a previous process left behind (see adopt).
 func (m *Manager) EnsureRoutes(desired map[string]string) error {
+	defer m.reportRoutes()
+	if err := m.adopt(); err != nil {
+		return err
+	}
+	var skipped []string
 	m.mu.Lock()
 	current := make(map[string]string)
 	for cidr, via := range m.routes {
@@ -41,11 +128,14 @@ func (m *Manager) EnsureRoutes(desired map[string]string) error {
 		if cur, ok := current[cidr]; !ok || cur != via {
 			if err := m.addRoute(cidr, via); err != nil {
 				if isNetworkUnreachable(err) {
-					log.Printf("routes: skipping %s via %s (gateway unreachable; will retry)", cidr, via)
+					logger().Warn("skipping route, gateway unreachable; will retry", logging.CIDR(cidr), logging.Via(via), logging.Iface(m.tailscaleIface))
+					skipped = append(skipped, cidr)
+					delete(current, cidr)
 					continue
 				}
 				return fmt.Errorf("add route %s via %s: %w", cidr, via, err)
 			}
+			logger().Debug("added route", logging.CIDR(cidr), logging.Via(via), logging.Iface(m.tailscaleIface))
 			m.mu.Lock()
 			m.routes[cidr] = via
 			m.mu.Unlock()
@@ -58,21 +148,223 @@ func (m *Manager) EnsureRoutes(desired map[string]string) error {
 		if err := m.delRoute(cidr); err != nil {
 			return fmt.Errorf("del route %s: %w", cidr, err)
 		}
+		logger().Debug("deleted route", logging.CIDR(cidr))
 		m.mu.Lock()
 		delete(m.routes, cidr)
 		m.mu.Unlock()
 	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("skipped routes %v: %w", skipped, ErrGatewayUnreachable)
+	}
+	return nil
+}
+
+// adopt loads the routes and rules a previous process installed (identified by
+// RouteProtocol, our table and, for routes, the Tailscale interface) into the
+// manager's state, once. The next EnsureRoutes/EnsureRules then deletes the
+// ones that are no longer desired, e.g. for nodes removed while we were down,
+// and keeps the rest without touching them.
+func (m *Manager) adopt() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.adopted {
+		return nil
+	}
+	existing, err := listRoutes(m.tailscaleIface, m.table)
+	if err != nil {
+		return fmt.Errorf("list existing routes: %w", err)
+	}
+	rules, err := listRules(m.table)
+	if err != nil {
+		return fmt.Errorf("list existing rules: %w", err)
+	}
+	for cidr, via := range existing {
+		if _, ok := m.routes[cidr]; !ok {
+			m.routes[cidr] = via
+		}
+	}
+	for _, r := range rules {
+		m.rules[r] = true
+	}
+	if len(existing) > 0 || len(rules) > 0 {
+		logger().Info("adopted routes and rules from a previous run", "routes", len(existing), "rules", len(rules))
+	}
+	m.adopted = true
+	return nil
+}
+
+// Resubscribe backoff for Watch after a netlink subscription fails.
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// Watch subscribes to kernel route and link changes and calls onChange when
+// routes we installed are gone: one of them was deleted (e.g. `ip route del`
+// by an admin or another agent), or the Tailscale interface came back up or
+// was recreated, which flushes its routes. The affected routes are forgotten
+// first, so the next EnsureRoutes re-adds them. It resubscribes with backoff
+// after errors and blocks until ctx is done. On non-Linux it just waits.
+func (m *Manager) Watch(ctx context.Context, onChange func()) {
+	delay := watchRetryMin
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := watch(ctx, m.tailscaleIface, m.table, watchHandlers{
+			routeDeleted: func(cidr string) {
+				if m.forget(cidr) {
+					m.reportRoutes()
+					logger().Warn("route deleted externally; re-applying", logging.CIDR(cidr))
+					onChange()
+				}
+			},
+			linkUp: func() {
+				m.forgetAll()
+				m.reportRoutes()
+				logger().Info("interface is up; re-applying routes", logging.Iface(m.tailscaleIface))
+				onChange()
+			},
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > watchRetryMax {
+			delay = watchRetryMin
+		}
+		logger().Warn("netlink watch ended; retrying", "delay", delay, logging.Err(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, watchRetryMax)
+	}
+}
+
+// watchHandlers are called by the platform-specific watch.
+type watchHandlers struct {
+	routeDeleted func(cidr string) // one of our routes was deleted
+	linkUp       func()            // the Tailscale interface came (back) up
+}
+
+// forget drops cidr from the routes we've added, reporting whether it was there.
+func (m *Manager) forget(cidr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.routes[cidr]; !ok {
+		return false
+	}
+	delete(m.routes, cidr)
+	return true
+}
+
+// forgetAll drops every route we've added.
+func (m *Manager) forgetAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.routes)
+}
+
+// Installed lists the routes in the kernel this manager owns (tagged with
+// RouteProtocol, in its table, out its interface), whichever process added
+// them. It does not change the manager's state.
+func (m *Manager) Installed() (map[string]string, error) {
+	return listRoutes(m.tailscaleIface, m.table)
+}
+
+// Routes returns a copy of the routes we've added (cidr -> viaIP, or "").
+func (m *Manager) Routes() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.routes)
+}
+
+// reportRoutes publishes the number of routes we manage.
+func (m *Manager) reportRoutes() {
+	m.mu.Lock()
+	n := len(m.routes)
+	m.mu.Unlock()
+	metrics.ManagedRoutes.Set(float64(n))
+}
+
+// Table returns the routing table routes are added to.
+func (m *Manager) Table() int {
+	return m.table
+}
+
+// EnsureRules makes the policy rules pointing at our table match desired. It
+// adds missing rules and deletes rules we previously added that are no longer
+// in desired. Rules require a dedicated table (WithTable); with the main table
+// desired must be empty.
+func (m *Manager) EnsureRules(desired []Rule) error {
+	if len(desired) > 0 && m.table == MainTable {
+		return fmt.Errorf("policy rules need a dedicated routing table, not main")
+	}
+	if err := m.adopt(); err != nil {
+		return err
+	}
+	want := make(map[Rule]bool, len(desired))
+	for _, r := range desired {
+		if r.Src == "" && r.Dst == "" {
+			return fmt.Errorf("rule %s: need a source or destination", r)
+		}
+		want[r] = true
+	}
+	m.mu.Lock()
+	current := make(map[Rule]bool, len(m.rules))
+	for r := range m.rules {
+		current[r] = true
+	}
+	m.mu.Unlock()
+
+	for r := range want {
+		if current[r] {
+			continue
+		}
+		if err := addRule(r, m.table); err != nil {
+			return fmt.Errorf("add rule %s: %w", r, err)
+		}
+		m.mu.Lock()
+		m.rules[r] = true
+		m.mu.Unlock()
+	}
+	for r := range current {
+		if want[r] {
+			continue
+		}
+		if err := delRule(r, m.table); err != nil {
+			return fmt.Errorf("del rule %s: %w", r, err)
+		}
+		m.mu.Lock()
+		delete(m.rules, r)
+		m.mu.Unlock()
+	}
 	return nil
 }
 
+// RemoveAll deletes every rule and route this manager has added.
+func (m *Manager) RemoveAll() error {
+	return errors.Join(m.EnsureRules(nil), m.EnsureRoutes(nil))
+}
+
+// SetOnLinkGateways changes whether routes added from now on get the onlink
+// flag (see WithOnLinkGateways), e.g. when the routing mode is reconfigured.
+func (m *Manager) SetOnLinkGateways(onLink bool) {
+	m.mu.Lock()
+	m.onLink = onLink
+	m.mu.Unlock()
+}
+
 // addRoute adds a route for cidr via the given gateway (platform-specific).
 func (m *Manager) addRoute(cidr, via string) error {
-	return addRoute(cidr, via, m.tailscaleIface)
+	m.mu.Lock()
+	onLink := m.onLink
+	m.mu.Unlock()
+	return addRoute(cidr, via, m.tailscaleIface, m.table, onLink)
 }
 
-// delRoute removes the route for cidr (platform-specific).
+// delRoute removes our route for cidr (platform-specific).
 func (m *Manager) delRoute(cidr string) error {
-	return delRoute(cidr)
+	return delRoute(cidr, m.table)
 }
 
 // isNetworkUnreachable reports whether err is ENETUNREACH (gateway not reachable).
@@ -3,6 +3,7 @@
 package routes
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -10,58 +11,80 @@ import (
 	"syscall"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// Routes are added to the default (main) table; we omit Table so the kernel uses it.
-// The gateway is our own Tailscale IP (to force egress out tailscale0), which is on-link.
+// Routes are added to the manager's table (main unless WithTable is used) and
+// tagged with RouteProtocol; deletes match on both so we never remove a route
+// someone else installed for the same prefix.
+// In self routing mode routes have no gateway and just go out tailscale0 (the
+// kernel refuses our own address as an IPv6 gateway); in peer routing mode the
+// gateway is the serving peer's Tailscale IP, which needs the onlink flag.
+// IPv4 and IPv6 routes are handled the same way; netlink picks the family from Dst,
+// so a gateway must be a Tailscale address of the matching family.
 
-func addRoute(cidr, via, tailscaleIface string) error {
+// netlinkOps is the part of the netlink API routes and rules are managed with,
+// so tests can replace nl with a fake kernel.
+type netlinkOps interface {
+	LinkByName(name string) (netlink.Link, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleListFiltered(family int, filter *netlink.Rule, filterMask uint64) ([]netlink.Rule, error)
+}
+
+var nl netlinkOps = &netlink.Handle{}
+
+func addRoute(cidr, via, tailscaleIface string, table int, onLink bool) error {
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
 		return fmt.Errorf("parse cidr: %w", err)
 	}
-	gw, err := netip.ParseAddr(via)
-	if err != nil {
-		return fmt.Errorf("parse via: %w", err)
-	}
-	// netlink expects *net.IPNet and net.IP
-	ipNet := net.IPNet{
-		IP:   prefix.Addr().AsSlice(),
-		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
-	}
 	route := &netlink.Route{
-		Dst: &ipNet,
-		Gw:  gw.AsSlice(),
+		Dst:      ipNet(prefix),
+		Table:    table,
+		Protocol: netlink.RouteProtocol(RouteProtocol),
+	}
+	if via != "" {
+		gw, err := netip.ParseAddr(via)
+		if err != nil {
+			return fmt.Errorf("parse via: %w", err)
+		}
+		if prefix.Addr().Is4() != gw.Is4() {
+			return fmt.Errorf("gateway %s is not in the same address family as %s", via, cidr)
+		}
+		route.Gw = gw.AsSlice()
+	} else if tailscaleIface == "" {
+		return fmt.Errorf("route to %s needs a gateway or an interface", cidr)
 	}
 	if tailscaleIface != "" {
-		link, err := netlink.LinkByName(tailscaleIface)
+		link, err := nl.LinkByName(tailscaleIface)
 		if err != nil {
 			return fmt.Errorf("link %s: %w", tailscaleIface, err)
 		}
 		route.LinkIndex = link.Attrs().Index
-	}
-	err = netlink.RouteAdd(route)
-	if err != nil {
-		// EEXIST: route already exists
-		if errors.Is(err, syscall.EEXIST) {
-			return nil
+		if onLink && route.Gw != nil {
+			route.Flags = int(netlink.FLAG_ONLINK)
 		}
-		return err
 	}
-	return nil
+	// Replace rather than add, so a changed gateway or a leftover untagged
+	// route for the same prefix is taken over.
+	return nl.RouteReplace(route)
 }
 
-func delRoute(cidr string) error {
+func delRoute(cidr string, table int) error {
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
 		return fmt.Errorf("parse cidr: %w", err)
 	}
-	ipNet := &net.IPNet{
-		IP:   prefix.Addr().AsSlice(),
-		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	route := &netlink.Route{
+		Dst:      ipNet(prefix),
+		Table:    table,
+		Protocol: netlink.RouteProtocol(RouteProtocol),
 	}
-	route := &netlink.Route{Dst: ipNet}
-	err = netlink.RouteDel(route)
+	err = nl.RouteDel(route)
 	if err != nil {
 		// ESRCH or ENOENT: route already gone
 		if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) {
@@ -71,3 +94,223 @@ func delRoute(cidr string) error {
 	}
 	return nil
 }
+
+// listRoutes returns our routes (cidr -> via, "" for no gateway) in table:
+// those tagged with RouteProtocol and, if tailscaleIface is set, going out
+// that interface.
+func listRoutes(tailscaleIface string, table int) (map[string]string, error) {
+	filter := &netlink.Route{Table: table, Protocol: netlink.RouteProtocol(RouteProtocol)}
+	mask := netlink.RT_FILTER_TABLE | netlink.RT_FILTER_PROTOCOL
+	if tailscaleIface != "" {
+		link, err := nl.LinkByName(tailscaleIface)
+		if err != nil {
+			var notFound netlink.LinkNotFoundError
+			if errors.As(err, &notFound) {
+				// No interface, so none of our routes survived.
+				return nil, nil
+			}
+			return nil, fmt.Errorf("link %s: %w", tailscaleIface, err)
+		}
+		filter.LinkIndex = link.Attrs().Index
+		mask |= netlink.RT_FILTER_OIF
+	}
+	list, err := nl.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(list))
+	for _, r := range list {
+		if r.Dst == nil {
+			continue
+		}
+		prefix, ok := netipPrefix(r.Dst)
+		if !ok {
+			continue
+		}
+		via := ""
+		if gw, ok := netip.AddrFromSlice(r.Gw); ok {
+			via = gw.Unmap().String()
+		}
+		out[prefix.String()] = via
+	}
+	return out, nil
+}
+
+// listRules returns the rules tagged with RouteProtocol that look up table.
+func listRules(table int) ([]Rule, error) {
+	list, err := nl.RuleListFiltered(netlink.FAMILY_ALL, &netlink.Rule{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	var out []Rule
+	for _, r := range list {
+		// We never add rules matching everything (see EnsureRules).
+		if r.Protocol != RouteProtocol || (r.Src == nil && r.Dst == nil) {
+			continue
+		}
+		rule := Rule{Priority: r.Priority}
+		if p, ok := netipPrefix(r.Src); ok {
+			rule.Src = p.String()
+		}
+		if p, ok := netipPrefix(r.Dst); ok {
+			rule.Dst = p.String()
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func addRule(r Rule, table int) error {
+	rule, err := netlinkRule(r, table)
+	if err != nil {
+		return err
+	}
+	err = nl.RuleAdd(rule)
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+func delRule(r Rule, table int) error {
+	rule, err := netlinkRule(r, table)
+	if err != nil {
+		return err
+	}
+	err = nl.RuleDel(rule)
+	if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// netlinkRule converts r into a rule looking up table, tagged with RouteProtocol.
+func netlinkRule(r Rule, table int) (*netlink.Rule, error) {
+	rule := netlink.NewRule()
+	rule.Table = table
+	rule.Priority = r.Priority
+	rule.Protocol = RouteProtocol
+	var is6 []bool
+	if r.Src != "" {
+		prefix, err := netip.ParsePrefix(r.Src)
+		if err != nil {
+			return nil, fmt.Errorf("parse src: %w", err)
+		}
+		rule.Src = ipNet(prefix)
+		is6 = append(is6, prefix.Addr().Is6())
+	}
+	if r.Dst != "" {
+		prefix, err := netip.ParsePrefix(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("parse dst: %w", err)
+		}
+		rule.Dst = ipNet(prefix)
+		is6 = append(is6, prefix.Addr().Is6())
+	}
+	if len(is6) == 0 {
+		return nil, fmt.Errorf("need a source or destination")
+	}
+	if len(is6) == 2 && is6[0] != is6[1] {
+		return nil, fmt.Errorf("source %s and destination %s are not in the same address family", r.Src, r.Dst)
+	}
+	rule.Family = netlink.FAMILY_V4
+	if is6[0] {
+		rule.Family = netlink.FAMILY_V6
+	}
+	return rule, nil
+}
+
+// ipNet converts prefix to the *net.IPNet netlink expects.
+func ipNet(prefix netip.Prefix) *net.IPNet {
+	prefix = prefix.Masked()
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// netipPrefix converts a netlink *net.IPNet back to a netip.Prefix.
+func netipPrefix(n *net.IPNet) (netip.Prefix, bool) {
+	if n == nil {
+		return netip.Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(n.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits, _ := n.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), bits).Masked(), true
+}
+
+// watch delivers deletions of our routes in table and up transitions of
+// tailscaleIface to h until ctx is done or a subscription fails. Routes
+// flushed because the interface went down or away are not always notified
+// (IPv4 isn't), hence the link subscription.
+func watch(ctx context.Context, tailscaleIface string, table int, h watchHandlers) error {
+	done := make(chan struct{})
+	routeCh := make(chan netlink.RouteUpdate)
+	linkCh := make(chan netlink.LinkUpdate)
+	defer func() {
+		close(done)
+		// The subscriptions close their channels once done is closed; drain
+		// them so a pending send doesn't block that forever.
+		go func() {
+			for range routeCh {
+			}
+		}()
+		go func() {
+			for range linkCh {
+			}
+		}()
+	}()
+	errCh := make(chan error, 2)
+	onErr := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	if err := netlink.RouteSubscribeWithOptions(routeCh, done, netlink.RouteSubscribeOptions{ErrorCallback: onErr}); err != nil {
+		return fmt.Errorf("subscribe to routes: %w", err)
+	}
+	if err := netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{ErrorCallback: onErr}); err != nil {
+		return fmt.Errorf("subscribe to links: %w", err)
+	}
+
+	up := false
+	if tailscaleIface != "" {
+		if link, err := nl.LinkByName(tailscaleIface); err == nil {
+			up = link.Attrs().Flags&net.FlagUp != 0
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errCh:
+			return err
+		case u, ok := <-routeCh:
+			if !ok {
+				return errors.New("route subscription closed")
+			}
+			if u.Type != unix.RTM_DELROUTE || u.Table != table || u.Protocol != netlink.RouteProtocol(RouteProtocol) {
+				continue
+			}
+			if prefix, ok := netipPrefix(u.Dst); ok {
+				h.routeDeleted(prefix.String())
+			}
+		case u, ok := <-linkCh:
+			if !ok {
+				return errors.New("link subscription closed")
+			}
+			if tailscaleIface == "" || u.Attrs().Name != tailscaleIface {
+				continue
+			}
+			isUp := u.Header.Type == unix.RTM_NEWLINK && u.Attrs().Flags&net.FlagUp != 0
+			if isUp && !up {
+				h.linkUp()
+			}
+			up = isUp
+		}
+	}
+}
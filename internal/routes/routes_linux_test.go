@@ -0,0 +1,310 @@
+//go:build linux
+
+package routes
+
+import (
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeKernel is an in-memory netlinkOps with one interface, tailscale0.
+type fakeKernel struct {
+	local    []netip.Addr // tailscale0's addresses
+	routes   []netlink.Route
+	rules    []netlink.Rule
+	replaces int // RouteReplace calls
+	ruleAdds int // RuleAdd calls
+}
+
+const fakeLinkIndex = 7
+
+func withFakeKernel(t *testing.T, local ...string) *fakeKernel {
+	k := &fakeKernel{}
+	for _, a := range local {
+		k.local = append(k.local, netip.MustParseAddr(a))
+	}
+	orig := nl
+	nl = k
+	t.Cleanup(func() { nl = orig })
+	return k
+}
+
+func (k *fakeKernel) LinkByName(name string) (netlink.Link, error) {
+	if name != "tailscale0" {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Index: fakeLinkIndex}}, nil
+}
+
+func (k *fakeKernel) RouteReplace(r *netlink.Route) error {
+	k.replaces++
+	if gw, ok := netip.AddrFromSlice(r.Gw); ok && gw.Is6() && slices.Contains(k.local, gw) {
+		return syscall.EINVAL // Gateway can not be a local address
+	}
+	k.routes = slices.DeleteFunc(k.routes, func(o netlink.Route) bool { return sameRoute(&o, r) })
+	k.routes = append(k.routes, *r)
+	return nil
+}
+
+func (k *fakeKernel) RouteDel(r *netlink.Route) error {
+	n := len(k.routes)
+	k.routes = slices.DeleteFunc(k.routes, func(o netlink.Route) bool { return sameRoute(&o, r) && o.Protocol == r.Protocol })
+	if len(k.routes) == n {
+		return syscall.ESRCH
+	}
+	return nil
+}
+
+func (k *fakeKernel) RouteListFiltered(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	var out []netlink.Route
+	for _, r := range k.routes {
+		switch {
+		case mask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table,
+			mask&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != filter.Protocol,
+			mask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex:
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (k *fakeKernel) RuleAdd(r *netlink.Rule) error {
+	k.ruleAdds++
+	if slices.ContainsFunc(k.rules, func(o netlink.Rule) bool { return sameRule(&o, r) }) {
+		return syscall.EEXIST
+	}
+	k.rules = append(k.rules, *r)
+	return nil
+}
+
+func (k *fakeKernel) RuleDel(r *netlink.Rule) error {
+	n := len(k.rules)
+	k.rules = slices.DeleteFunc(k.rules, func(o netlink.Rule) bool { return sameRule(&o, r) })
+	if len(k.rules) == n {
+		return syscall.ENOENT
+	}
+	return nil
+}
+
+func (k *fakeKernel) RuleListFiltered(family int, filter *netlink.Rule, mask uint64) ([]netlink.Rule, error) {
+	var out []netlink.Rule
+	for _, r := range k.rules {
+		if mask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// sameRoute reports whether a and b are the same route to the kernel, which
+// replaces and deletes by table and destination.
+func sameRoute(a, b *netlink.Route) bool {
+	return a.Table == b.Table && a.Dst.String() == b.Dst.String()
+}
+
+func sameRule(a, b *netlink.Rule) bool {
+	return a.Table == b.Table && a.Priority == b.Priority && a.Family == b.Family &&
+		a.Protocol == b.Protocol && a.Src.String() == b.Src.String() && a.Dst.String() == b.Dst.String()
+}
+
+// kernelRoutes returns the routes in k as cidr -> gateway ("" for none).
+func (k *fakeKernel) kernelRoutes() map[string]string {
+	out := make(map[string]string)
+	for _, r := range k.routes {
+		gw := ""
+		if len(r.Gw) > 0 {
+			gw = r.Gw.String()
+		}
+		out[r.Dst.String()] = gw
+	}
+	return out
+}
+
+func mustIPNet(cidr string) *net.IPNet {
+	return ipNet(netip.MustParsePrefix(cidr))
+}
+
+func TestEnsureRoutesSelfMode(t *testing.T) {
+	k := withFakeKernel(t, "100.64.0.1", "fd7a:115c:a1e0::1")
+	// Left by an older release, via our own IPv4 address, and for a node
+	// that has since gone.
+	k.routes = []netlink.Route{
+		{Dst: mustIPNet("10.99.2.0/24"), Gw: net.ParseIP("100.64.0.1").To4(), LinkIndex: fakeLinkIndex, Table: MainTable, Protocol: RouteProtocol},
+		{Dst: mustIPNet("10.99.9.0/24"), Gw: net.ParseIP("100.64.0.1").To4(), LinkIndex: fakeLinkIndex, Table: MainTable, Protocol: RouteProtocol},
+	}
+
+	// Our own IPv6 address can't be the gateway.
+	if err := addRoute("fd00:99:0:2::/64", "fd7a:115c:a1e0::1", "tailscale0", MainTable, false); err == nil {
+		t.Error("addRoute via our own IPv6 address: want the kernel's EINVAL")
+	}
+
+	m := NewManager("tailscale0")
+	desired := map[string]string{"10.99.2.0/24": "", "fd00:99:0:2::/64": ""}
+	if err := m.EnsureRoutes(desired); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"10.99.2.0/24": "", "fd00:99:0:2::/64": ""}
+	if got := k.kernelRoutes(); !maps.Equal(got, want) {
+		t.Errorf("kernel routes = %v, want %v", got, want)
+	}
+	for _, r := range k.routes {
+		if r.LinkIndex != fakeLinkIndex || r.Flags != 0 {
+			t.Errorf("route %s: link %d, flags %#x; want out tailscale0 without onlink", r.Dst, r.LinkIndex, r.Flags)
+		}
+	}
+	if got := m.Routes(); !maps.Equal(got, desired) {
+		t.Errorf("Routes() = %v, want %v", got, desired)
+	}
+
+	// Nothing to do the second time, or for a new manager adopting them.
+	k.replaces = 0
+	if err := m.EnsureRoutes(desired); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewManager("tailscale0").EnsureRoutes(desired); err != nil {
+		t.Fatal(err)
+	}
+	if k.replaces != 0 {
+		t.Errorf("%d routes replaced, want none", k.replaces)
+	}
+}
+
+func TestEnsureRoutesPeerMode(t *testing.T) {
+	k := withFakeKernel(t, "100.64.0.1")
+	m := NewManager("tailscale0", WithOnLinkGateways())
+	if err := m.EnsureRoutes(map[string]string{"10.99.2.0/24": "100.64.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	// The serving peer changed.
+	if err := m.EnsureRoutes(map[string]string{"10.99.2.0/24": "100.64.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := k.kernelRoutes(), map[string]string{"10.99.2.0/24": "100.64.0.3"}; !maps.Equal(got, want) {
+		t.Errorf("kernel routes = %v, want %v", got, want)
+	}
+	if r := k.routes[0]; r.Flags != int(netlink.FLAG_ONLINK) {
+		t.Errorf("flags = %#x, want onlink", r.Flags)
+	}
+}
+
+func TestNetlinkRule(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		rule    Rule
+		family  int
+		wantErr bool
+	}{
+		{name: "dst", rule: Rule{Dst: "10.99.0.0/16", Priority: 100}, family: netlink.FAMILY_V4},
+		{name: "src and dst", rule: Rule{Src: "10.99.1.0/24", Dst: "10.99.0.0/16"}, family: netlink.FAMILY_V4},
+		{name: "ipv6 src", rule: Rule{Src: "fd00:99:0:1::/64"}, family: netlink.FAMILY_V6},
+		{name: "family mismatch", rule: Rule{Src: "10.99.1.0/24", Dst: "fd00:99::/48"}, wantErr: true},
+		{name: "empty", rule: Rule{Priority: 100}, wantErr: true},
+		{name: "bad cidr", rule: Rule{Dst: "10.99.0.0"}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := netlinkRule(tt.rule, 100)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Family != tt.family || r.Table != 100 || r.Priority != tt.rule.Priority || r.Protocol != RouteProtocol {
+				t.Errorf("got family %d table %d priority %d protocol %d", r.Family, r.Table, r.Priority, r.Protocol)
+			}
+			if got := ruleFromNetlink(t, r); got != tt.rule {
+				t.Errorf("round trip = %+v, want %+v", got, tt.rule)
+			}
+		})
+	}
+}
+
+// ruleFromNetlink converts r back via listRules.
+func ruleFromNetlink(t *testing.T, r *netlink.Rule) Rule {
+	t.Helper()
+	withFakeKernel(t).rules = []netlink.Rule{*r}
+	rules, err := listRules(r.Table)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("listRules = %v, %v", rules, err)
+	}
+	return rules[0]
+}
+
+func TestEnsureRules(t *testing.T) {
+	k := withFakeKernel(t)
+	m := NewManager("tailscale0", WithTable(100))
+	v4 := Rule{Dst: "10.99.0.0/16", Priority: 100}
+	v6 := Rule{Dst: "fd00:99::/48", Priority: 100}
+	if err := m.EnsureRules([]Rule{v4, v6}); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.rules) != 2 || k.rules[0].Family != netlink.FAMILY_V4 || k.rules[1].Family != netlink.FAMILY_V6 {
+		t.Fatalf("kernel rules = %v", k.rules)
+	}
+
+	if err := m.EnsureRules([]Rule{v6}); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.rules) != 1 || k.rules[0].Dst.String() != "fd00:99::/48" {
+		t.Errorf("kernel rules = %v, want only %s", k.rules, v6)
+	}
+
+	if err := m.EnsureRules([]Rule{{Priority: 100}}); err == nil {
+		t.Error("a rule matching everything should be rejected")
+	}
+	if err := NewManager("tailscale0").EnsureRules([]Rule{v4}); err == nil {
+		t.Error("rules for the main table should be rejected")
+	}
+}
+
+func TestAdoptRules(t *testing.T) {
+	k := withFakeKernel(t)
+	rule := func(r Rule, table int, protocol uint8) netlink.Rule {
+		nr, err := netlinkRule(r, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nr.Protocol = protocol
+		return *nr
+	}
+	keep := Rule{Dst: "10.99.0.0/16", Priority: 100}
+	stale := Rule{Dst: "10.98.0.0/16", Priority: 100} // cluster CIDR since changed
+	k.rules = []netlink.Rule{
+		rule(keep, 100, RouteProtocol),
+		rule(stale, 100, RouteProtocol),
+		rule(Rule{Dst: "10.97.0.0/16", Priority: 100}, 100, 0),             // an admin's
+		rule(Rule{Dst: "10.96.0.0/16", Priority: 100}, 200, RouteProtocol), // another table
+		{Table: 100, Priority: 100, Protocol: RouteProtocol},               // matches everything
+	}
+	want := slices.Delete(slices.Clone(k.rules), 1, 2)
+
+	m := NewManager("tailscale0", WithTable(100))
+	if err := m.EnsureRules([]Rule{keep}); err != nil {
+		t.Fatal(err)
+	}
+	if k.ruleAdds != 0 {
+		t.Errorf("%d rules added, want the existing one kept", k.ruleAdds)
+	}
+	if !slices.EqualFunc(k.rules, want, func(a, b netlink.Rule) bool { return sameRule(&a, &b) }) {
+		t.Errorf("kernel rules = %v, want %v", k.rules, want)
+	}
+
+	// Removing everything leaves the rules that aren't ours.
+	if err := m.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.rules) != 3 {
+		t.Errorf("kernel rules after RemoveAll = %v", k.rules)
+	}
+}
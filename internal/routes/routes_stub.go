@@ -2,6 +2,17 @@
 
 package routes
 
-// addRoute and delRoute are no-ops on non-Linux; route management is Linux-only.
-func addRoute(cidr, via, tailscaleIface string) error { return nil }
-func delRoute(cidr string) error                      { return nil }
+import "context"
+
+// Route and rule management is Linux-only; these are no-ops elsewhere.
+func addRoute(cidr, via, tailscaleIface string, table int, onLink bool) error { return nil }
+func delRoute(cidr string, table int) error                                   { return nil }
+func addRule(r Rule, table int) error                                         { return nil }
+func delRule(r Rule, table int) error                                         { return nil }
+func listRoutes(tailscaleIface string, table int) (map[string]string, error)  { return nil, nil }
+func listRules(table int) ([]Rule, error)                                     { return nil, nil }
+
+func watch(ctx context.Context, tailscaleIface string, table int, h watchHandlers) error {
+	<-ctx.Done()
+	return nil
+}
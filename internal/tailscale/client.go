@@ -4,13 +4,19 @@ package tailscale
 
 import (
 	"context"
+	"log/slog"
 	"net/netip"
+	"slices"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
 
 	"tailscale.com/client/local"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 )
 
+func logger() *slog.Logger { return logging.Component("tailscale") }
+
 // Client talks to the Tailscale daemon on the host (via socket).
 type Client struct {
 	lc *local.Client
@@ -31,34 +37,57 @@ func (c *Client) Status(ctx context.Context) (*ipnstate.Status, error) {
 	return c.lc.Status(ctx)
 }
 
+// Prefs returns tailscaled's current prefs (advertised routes, accept-routes).
+func (c *Client) Prefs(ctx context.Context) (*ipn.Prefs, error) {
+	return c.lc.GetPrefs(ctx)
+}
+
+// UnapprovedRoutes fetches status and returns which of advertised are not yet
+// approved for this node (see the package-level UnapprovedRoutes).
+func (c *Client) UnapprovedRoutes(ctx context.Context, advertised []netip.Prefix) ([]netip.Prefix, error) {
+	st, err := c.lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return UnapprovedRoutes(st, advertised), nil
+}
+
 // AdvertiseRoute advertises the given CIDR as a subnet route from this node.
 // The tailnet must allow this (e.g. --advertise-routes on join or ACL).
 // It merges with existing AdvertiseRoutes in prefs.
 func (c *Client) AdvertiseRoute(ctx context.Context, cidr netip.Prefix) error {
+	return c.AdvertiseRoutes(ctx, []netip.Prefix{cidr})
+}
+
+// AdvertiseRoutes advertises all of cidrs (e.g. the IPv4 and IPv6 pod CIDRs of
+// a dual-stack node) in a single prefs edit, merging with existing AdvertiseRoutes.
+func (c *Client) AdvertiseRoutes(ctx context.Context, cidrs []netip.Prefix) error {
 	prefs, err := c.lc.GetPrefs(ctx)
 	if err != nil {
 		return err
 	}
 	routes := prefs.AdvertiseRoutes
-	seen := false
-	for _, r := range routes {
-		if r == cidr {
-			seen = true
-			break
+	changed := false
+	for _, cidr := range cidrs {
+		if !slices.Contains(routes, cidr) {
+			routes = append(routes, cidr)
+			changed = true
 		}
 	}
-	if seen {
+	if !changed {
 		return nil
 	}
-	routes = append(routes, cidr)
 	mp := &ipn.MaskedPrefs{
 		AdvertiseRoutesSet: true,
 		Prefs: ipn.Prefs{
 			AdvertiseRoutes: routes,
 		},
 	}
-	_, err = c.lc.EditPrefs(ctx, mp)
-	return err
+	if _, err := c.lc.EditPrefs(ctx, mp); err != nil {
+		return err
+	}
+	logger().Info("updated advertised routes", logging.CIDRs(routes))
+	return nil
 }
 
 // UnadvertiseRoute removes the given CIDR from advertised routes.
@@ -80,8 +109,59 @@ func (c *Client) UnadvertiseRoute(ctx context.Context, cidr netip.Prefix) error
 			AdvertiseRoutes: newRoutes,
 		},
 	}
-	_, err = c.lc.EditPrefs(ctx, mp)
-	return err
+	if _, err := c.lc.EditPrefs(ctx, mp); err != nil {
+		return err
+	}
+	logger().Info("withdrew advertised route", logging.CIDR(cidr))
+	return nil
+}
+
+// SetOwnedRoutes makes the routes we own in prefs equal want, in a single prefs
+// edit (see OwnedRoutes). It returns the prefixes that were withdrawn.
+func (c *Client) SetOwnedRoutes(ctx context.Context, want []netip.Prefix, owned func(netip.Prefix) bool) (withdrawn []netip.Prefix, err error) {
+	prefs, err := c.lc.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	routes, withdrawn, changed := OwnedRoutes(prefs.AdvertiseRoutes, want, owned)
+	if !changed {
+		return nil, nil
+	}
+	mp := &ipn.MaskedPrefs{
+		AdvertiseRoutesSet: true,
+		Prefs: ipn.Prefs{
+			AdvertiseRoutes: routes,
+		},
+	}
+	if _, err := c.lc.EditPrefs(ctx, mp); err != nil {
+		return nil, err
+	}
+	logger().Info("updated advertised routes", logging.CIDRs(routes), slog.Any("withdrawn", withdrawn))
+	return withdrawn, nil
+}
+
+// OwnedRoutes returns the routes to advertise instead of advertised so the ones
+// we own equal want. owned reports whether an advertised prefix belongs to us
+// (e.g. it was one of our earlier pod CIDRs); owned prefixes not in want are
+// withdrawn, and routes advertised by anything else (exit node routes, other
+// subnet routers on this host) are kept. changed is false if routes is the
+// same as advertised.
+func OwnedRoutes(advertised, want []netip.Prefix, owned func(netip.Prefix) bool) (routes, withdrawn []netip.Prefix, changed bool) {
+	for _, r := range advertised {
+		if owned(r) && !slices.Contains(want, r) {
+			withdrawn = append(withdrawn, r)
+			continue
+		}
+		routes = append(routes, r)
+	}
+	changed = len(withdrawn) > 0
+	for _, r := range want {
+		if !slices.Contains(routes, r) {
+			routes = append(routes, r)
+			changed = true
+		}
+	}
+	return routes, withdrawn, changed
 }
 
 // SetAdvertiseRoutes sets the full list of advertised routes (replacing any existing).
@@ -112,25 +192,98 @@ func (c *Client) EnsureAcceptRoutes(ctx context.Context, accept bool) error {
 			RouteAll: accept,
 		},
 	}
-	_, err = c.lc.EditPrefs(ctx, mp)
-	return err
+	if _, err := c.lc.EditPrefs(ctx, mp); err != nil {
+		return err
+	}
+	logger().Info("set accept-routes", "accept", accept)
+	return nil
+}
+
+// UnapprovedRoutes returns the prefixes in advertised that the control plane
+// has not approved for this node. A subnet route is approved once it shows up
+// in our AllowedIPs (or, when we are its primary router, PrimaryRoutes);
+// until then peers won't send traffic for it to us.
+func UnapprovedRoutes(st *ipnstate.Status, advertised []netip.Prefix) []netip.Prefix {
+	var approved []netip.Prefix
+	if st != nil && st.Self != nil {
+		if st.Self.AllowedIPs != nil {
+			approved = append(approved, st.Self.AllowedIPs.AsSlice()...)
+		}
+		if st.Self.PrimaryRoutes != nil {
+			approved = append(approved, st.Self.PrimaryRoutes.AsSlice()...)
+		}
+	}
+	var unapproved []netip.Prefix
+	for _, p := range advertised {
+		if !slices.Contains(approved, p.Masked()) {
+			unapproved = append(unapproved, p)
+		}
+	}
+	return unapproved
+}
+
+// RouteOwners maps every subnet route in the tailnet to the peer currently
+// serving it, i.e. the peer that has the prefix in its PrimaryRoutes. Peers
+// that are offline are included; callers decide whether to use them.
+func RouteOwners(st *ipnstate.Status) map[netip.Prefix]*ipnstate.PeerStatus {
+	owners := make(map[netip.Prefix]*ipnstate.PeerStatus)
+	if st == nil {
+		return owners
+	}
+	for _, peer := range st.Peer {
+		if peer.PrimaryRoutes == nil {
+			continue
+		}
+		for _, p := range peer.PrimaryRoutes.All() {
+			owners[p.Masked()] = peer
+		}
+	}
+	return owners
+}
+
+// PeerTailscaleIPFor returns peer's Tailscale address in the same family as
+// prefix, like SelfTailscaleIPFor does for this node.
+func PeerTailscaleIPFor(peer *ipnstate.PeerStatus, prefix netip.Prefix) (netip.Addr, bool) {
+	match := netip.Addr.Is4
+	if prefix.Addr().Is6() {
+		match = netip.Addr.Is6
+	}
+	a := firstMatch(peer.TailscaleIPs, match)
+	return a, a.IsValid()
 }
 
 // SelfTailscaleIPv4 returns this node's Tailscale IPv4 address from status.
-// Using it as the route gateway forces traffic out tailscale0; Tailscale then
-// routes it to the peer that advertises the destination subnet.
 // Returns zero addr and false if not found.
 func SelfTailscaleIPv4(st *ipnstate.Status) (netip.Addr, bool) {
+	return selfTailscaleIP(st, netip.Addr.Is4)
+}
+
+// SelfTailscaleIPv6 is like SelfTailscaleIPv4 but returns this node's Tailscale
+// IPv6 address.
+func SelfTailscaleIPv6(st *ipnstate.Status) (netip.Addr, bool) {
+	return selfTailscaleIP(st, netip.Addr.Is6)
+}
+
+// SelfTailscaleIPFor returns this node's Tailscale address in the same family
+// as prefix (IPv4 for an IPv4 prefix, IPv6 for an IPv6 prefix).
+func SelfTailscaleIPFor(st *ipnstate.Status, prefix netip.Prefix) (netip.Addr, bool) {
+	if prefix.Addr().Is6() {
+		return SelfTailscaleIPv6(st)
+	}
+	return SelfTailscaleIPv4(st)
+}
+
+func selfTailscaleIP(st *ipnstate.Status, match func(netip.Addr) bool) (netip.Addr, bool) {
 	if st == nil || len(st.TailscaleIPs) == 0 {
 		return netip.Addr{}, false
 	}
-	a := firstIPv4(st.TailscaleIPs)
+	a := firstMatch(st.TailscaleIPs, match)
 	return a, a.IsValid()
 }
 
-func firstIPv4(addrs []netip.Addr) netip.Addr {
+func firstMatch(addrs []netip.Addr, match func(netip.Addr) bool) netip.Addr {
 	for _, a := range addrs {
-		if a.Is4() {
+		if match(a) {
 			return a
 		}
 	}
@@ -0,0 +1,85 @@
+package tailscale
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+func TestUnapprovedRoutes(t *testing.T) {
+	v4 := netip.MustParsePrefix("10.99.1.0/24")
+	v6 := netip.MustParsePrefix("fd00:99:0:1::/64")
+	allowed := views.SliceOf([]netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), v4})
+
+	st := &ipnstate.Status{Self: &ipnstate.PeerStatus{AllowedIPs: &allowed}}
+	got := UnapprovedRoutes(st, []netip.Prefix{v4, v6})
+	if want := []netip.Prefix{v6}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	primary := views.SliceOf([]netip.Prefix{v6})
+	st.Self.PrimaryRoutes = &primary
+	if got := UnapprovedRoutes(st, []netip.Prefix{v4, v6}); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+
+	if got := UnapprovedRoutes(nil, []netip.Prefix{v4}); !slices.Equal(got, []netip.Prefix{v4}) {
+		t.Errorf("nil status: got %v", got)
+	}
+}
+
+func TestOwnedRoutes(t *testing.T) {
+	p := netip.MustParsePrefix
+	old, cur := p("10.99.1.0/24"), p("10.99.2.0/24")
+	other := p("10.99.3.0/24") // inside the cluster CIDR, but not ours
+	exit := p("0.0.0.0/0")
+	owned := func(r netip.Prefix) bool { return r == old || r == cur }
+
+	for _, tt := range []struct {
+		name          string
+		advertised    []netip.Prefix
+		want          []netip.Prefix
+		wantRoutes    []netip.Prefix
+		wantWithdrawn []netip.Prefix
+		wantChanged   bool
+	}{
+		{
+			name:        "first advertisement",
+			advertised:  []netip.Prefix{exit},
+			want:        []netip.Prefix{cur},
+			wantRoutes:  []netip.Prefix{exit, cur},
+			wantChanged: true,
+		},
+		{
+			name:       "already advertised",
+			advertised: []netip.Prefix{cur, other},
+			want:       []netip.Prefix{cur},
+			wantRoutes: []netip.Prefix{cur, other},
+		},
+		{
+			name:          "pod CIDR changed",
+			advertised:    []netip.Prefix{old, other, exit},
+			want:          []netip.Prefix{cur},
+			wantRoutes:    []netip.Prefix{other, exit, cur},
+			wantWithdrawn: []netip.Prefix{old},
+			wantChanged:   true,
+		},
+		{
+			name:          "withdraw everything",
+			advertised:    []netip.Prefix{cur, other},
+			wantRoutes:    []netip.Prefix{other},
+			wantWithdrawn: []netip.Prefix{cur},
+			wantChanged:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, withdrawn, changed := OwnedRoutes(tt.advertised, tt.want, owned)
+			if !slices.Equal(routes, tt.wantRoutes) || !slices.Equal(withdrawn, tt.wantWithdrawn) || changed != tt.wantChanged {
+				t.Errorf("got %v, withdrawn %v, changed %v; want %v, withdrawn %v, changed %v", routes, withdrawn, changed, tt.wantRoutes, tt.wantWithdrawn, tt.wantChanged)
+			}
+		})
+	}
+}
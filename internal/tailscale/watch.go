@@ -0,0 +1,135 @@
+package tailscale
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lstoll/tailscale-cni/internal/logging"
+
+	"tailscale.com/ipn"
+)
+
+// Reconnect backoff for WatchChanges when tailscaled is down or restarting.
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// WatchChanges watches the LocalAPI IPN bus and calls onChange whenever state
+// of this node we depend on changes: the backend state (e.g. re-login),
+// advertised routes or accept-routes in prefs (e.g. someone ran `tailscale
+// set`), or this node's Tailscale addresses and approved routes. When only the
+// routes or online status of peers change it calls onPeersChange instead.
+// Netmap updates that don't touch any of those are ignored. When the watch
+// drops (e.g. tailscaled stopped) it calls onDisconnect, then reconnects with
+// backoff, calling onChange once the new session's state arrives. It blocks
+// until ctx is done.
+func (c *Client) WatchChanges(ctx context.Context, onChange, onPeersChange, onDisconnect func()) {
+	delay := watchRetryMin
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := c.watch(ctx, onChange, onPeersChange)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > watchRetryMax {
+			delay = watchRetryMin
+		}
+		logger().Warn("IPN bus watch ended; retrying", "delay", delay, logging.Err(err))
+		onDisconnect()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, watchRetryMax)
+	}
+}
+
+func (c *Client) watch(ctx context.Context, onChange, onPeersChange func()) error {
+	w, err := c.lc.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyInitialPrefs|ipn.NotifyInitialNetMap|ipn.NotifyRateLimit)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	var st watchState
+	lastSelf, lastPeers := "", ""
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		st.update(n)
+		selfFP, peersFP := st.fingerprint(), st.peersFingerprint()
+		switch {
+		case selfFP != lastSelf:
+			// onChange covers peers too.
+			logger().Debug("tailscale state changed", slog.String("state", st.state), slog.String("prefs", st.prefs))
+			onChange()
+		case peersFP != lastPeers:
+			logger().Debug("tailscale peers changed")
+			onPeersChange()
+		}
+		lastSelf, lastPeers = selfFP, peersFP
+	}
+}
+
+// watchState accumulates the parts of IPN bus notifications we care about;
+// each notification carries only the fields that changed.
+type watchState struct {
+	state   string
+	prefs   string
+	self    string
+	peers   string
+	hasInit bool
+}
+
+func (s *watchState) update(n ipn.Notify) {
+	if n.State != nil {
+		s.state = n.State.String()
+		s.hasInit = true
+	}
+	if n.Prefs != nil && n.Prefs.Valid() {
+		p := *n.Prefs
+		s.prefs = fmt.Sprintf("routes=%v routeAll=%v", p.AdvertiseRoutes().AsSlice(), p.RouteAll())
+	}
+	if nm := n.NetMap; nm != nil {
+		if nm.SelfNode.Valid() {
+			// AllowedIPs and PrimaryRoutes change when our routes are approved.
+			s.self = fmt.Sprint(nm.SelfNode.Addresses().AsSlice(), nm.SelfNode.AllowedIPs().AsSlice(), nm.SelfNode.PrimaryRoutes().AsSlice())
+		}
+		peers := make([]string, 0, len(nm.Peers))
+		for _, p := range nm.Peers {
+			online := p.Online().Valid() && p.Online().Get()
+			peers = append(peers, fmt.Sprintf("%s:%v:%v", p.StableID(), p.PrimaryRoutes().AsSlice(), online))
+		}
+		slices.Sort(peers)
+		s.peers = strings.Join(peers, ",")
+	}
+}
+
+// fingerprint summarises the watched state of this node; it changes iff
+// something we reconcile our own setup against changed. It is empty until the
+// initial state arrives so a partial first notification doesn't trigger a
+// reconcile on its own.
+func (s *watchState) fingerprint() string {
+	if !s.hasInit {
+		return ""
+	}
+	return strings.Join([]string{s.state, s.prefs, s.self}, "|")
+}
+
+// peersFingerprint summarises the routes and online status of peers, which
+// only other nodes' routes depend on. Like fingerprint it is empty until the
+// initial state arrives.
+func (s *watchState) peersFingerprint() string {
+	if !s.hasInit {
+		return ""
+	}
+	return s.peers
+}
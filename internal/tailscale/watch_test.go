@@ -0,0 +1,95 @@
+package tailscale
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestWatchStateFingerprint(t *testing.T) {
+	p := netip.MustParsePrefix
+	state := func(s ipn.State) ipn.Notify { return ipn.Notify{State: &s} }
+	prefs := func(routes []netip.Prefix, routeAll bool, hostname string) ipn.Notify {
+		v := (&ipn.Prefs{AdvertiseRoutes: routes, RouteAll: routeAll, Hostname: hostname}).View()
+		return ipn.Notify{Prefs: &v}
+	}
+	online := func(b bool) *bool { return &b }
+	self := &tailcfg.Node{
+		ID:         1,
+		Addresses:  []netip.Prefix{p("100.64.0.1/32")},
+		AllowedIPs: []netip.Prefix{p("100.64.0.1/32")},
+	}
+	peer := &tailcfg.Node{
+		ID:            2,
+		StableID:      "peer",
+		Name:          "peer.tailnet.ts.net.",
+		PrimaryRoutes: []netip.Prefix{p("10.99.2.0/24")},
+		Online:        online(true),
+	}
+	netMap := func(modify func(self, peer *tailcfg.Node)) ipn.Notify {
+		s, pr := *self, *peer
+		if modify != nil {
+			modify(&s, &pr)
+		}
+		return ipn.Notify{NetMap: &netmap.NetworkMap{SelfNode: s.View(), Peers: []tailcfg.NodeView{pr.View()}}}
+	}
+
+	initial := []ipn.Notify{
+		state(ipn.Running),
+		prefs([]netip.Prefix{p("10.99.1.0/24")}, true, "node"),
+		netMap(nil),
+	}
+	for _, tt := range []struct {
+		name        string
+		notify      ipn.Notify
+		self, peers bool // which fingerprint changes
+	}{
+		{"backend state", state(ipn.NeedsLogin), true, false},
+		{"same backend state", state(ipn.Running), false, false},
+		{"advertised routes", prefs([]netip.Prefix{p("10.99.1.0/24"), p("fd00:99:0:1::/64")}, true, "node"), true, false},
+		{"accept-routes", prefs([]netip.Prefix{p("10.99.1.0/24")}, false, "node"), true, false},
+		{"other prefs", prefs([]netip.Prefix{p("10.99.1.0/24")}, true, "renamed"), false, false},
+		{"our addresses", netMap(func(s, _ *tailcfg.Node) { s.Addresses = append(s.Addresses, p("fd7a:115c:a1e0::1/128")) }), true, false},
+		{"our routes approved", netMap(func(s, _ *tailcfg.Node) { s.AllowedIPs = append(s.AllowedIPs, p("10.99.1.0/24")) }), true, false},
+		{"peer routes", netMap(func(_, pr *tailcfg.Node) { pr.PrimaryRoutes = nil }), false, true},
+		{"peer offline", netMap(func(_, pr *tailcfg.Node) { pr.Online = online(false) }), false, true},
+		{"peer renamed", netMap(func(_, pr *tailcfg.Node) { pr.Name = "renamed.tailnet.ts.net." }), false, false},
+		{"same netmap", netMap(nil), false, false},
+		{"engine stats", ipn.Notify{Engine: &ipn.EngineStatus{RBytes: 1}}, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var st watchState
+			for _, n := range initial {
+				st.update(n)
+			}
+			self, peers := st.fingerprint(), st.peersFingerprint()
+			st.update(tt.notify)
+			if changed := st.fingerprint() != self; changed != tt.self {
+				t.Errorf("fingerprint changed = %v, want %v", changed, tt.self)
+			}
+			if changed := st.peersFingerprint() != peers; changed != tt.peers {
+				t.Errorf("peersFingerprint changed = %v, want %v", changed, tt.peers)
+			}
+		})
+	}
+}
+
+func TestWatchStateInitial(t *testing.T) {
+	var st watchState
+	v := (&ipn.Prefs{RouteAll: true}).View()
+	st.update(ipn.Notify{Prefs: &v})
+	if fp := st.fingerprint(); fp != "" {
+		t.Errorf("fingerprint before the initial state = %q, want empty", fp)
+	}
+	if fp := st.peersFingerprint(); fp != "" {
+		t.Errorf("peersFingerprint before the initial state = %q, want empty", fp)
+	}
+	s := ipn.Running
+	st.update(ipn.Notify{State: &s})
+	if st.fingerprint() == "" {
+		t.Error("fingerprint empty after the initial state")
+	}
+}
@@ -25,7 +25,7 @@ kubectl -n kube-system delete pods -l app=tailscale-cni
 
 echo ""
 echo "=== Applying Tailscale CNI DaemonSet ==="
-kubectl apply -f deploy/tailscale-cni-daemonset.yaml
+kubectl apply -f deploy/tailscale-cni-rbac.yaml -f deploy/tailscale-cni-daemonset.yaml
 
 echo ""
 echo "=== Waiting for DaemonSet pods ==="
@@ -30,4 +30,4 @@ for vm in control-plane node; do
 done
 
 echo "Done. Image $IMAGE_NAME is available on both nodes. Apply the DaemonSet:"
-echo "  kubectl apply -f $REPO_ROOT/deploy/tailscale-cni-daemonset.yaml"
+echo "  kubectl apply -f $REPO_ROOT/deploy/tailscale-cni-rbac.yaml -f $REPO_ROOT/deploy/tailscale-cni-daemonset.yaml"